@@ -5,6 +5,12 @@
 package ldap
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
 	"github.com/go-ldap/ldap/v3"
 )
 
@@ -12,4 +18,323 @@ type (
 	Control       = ldap.Control
 	ControlString = ldap.ControlString
 	ControlPaging = ldap.ControlPaging
+	SortKey       = ldap.SortKey
+)
+
+const (
+	ControlTypePaging                  = ldap.ControlTypePaging
+	ControlTypeServerSideSorting       = ldap.ControlTypeServerSideSorting
+	ControlTypeServerSideSortingResult = ldap.ControlTypeServerSideSortingResult
+	ControlTypeVLVRequest              = ldap.ControlTypeVLVRequest
+	ControlTypeVLVResponse             = ldap.ControlTypeVLVResponse
 )
+
+// FindControl returns the first control of the given type, or nil.
+func FindControl(controls []Control, controlType string) Control {
+	return ldap.FindControl(controls, controlType)
+}
+
+// encodeControls encodes the controls of an LDAPMessage:
+// controls [0] Controls OPTIONAL
+func encodeControls(controls []Control) *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	for _, control := range controls {
+		packet.AppendChild(control.Encode())
+	}
+	return packet
+}
+
+// decodeControl decodes a request control and reports its criticality. Unlike
+// ldap.DecodeControl it understands every request control the server
+// implements, and it reports a malformed control as an error instead of
+// panicking.
+func decodeControl(packet *ber.Packet) (control Control, criticality bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed control: %v", r)
+		}
+	}()
+	if len(packet.Children) == 0 {
+		return nil, false, errors.New("missing control type")
+	}
+	controlType, _ := packet.Children[0].Value.(string)
+	var value *ber.Packet
+	for _, child := range packet.Children[1:] {
+		if b, ok := child.Value.(bool); ok && child.Tag == ber.TagBoolean {
+			criticality = b
+		} else {
+			value = child
+		}
+	}
+	switch controlType {
+	case ControlTypeServerSideSorting:
+		control, err = decodeServerSideSorting(criticality, value)
+	case ControlTypeVLVRequest:
+		control, err = decodeVLV(criticality, value)
+	default:
+		control, err = ldap.DecodeControl(packet)
+	}
+	return control, criticality, err
+}
+
+// criticalControlsKey is the context key of the types of the controls a
+// request marked critical, for controls such as ControlPaging that don't
+// record it.
+type criticalControlsKey struct{}
+
+// isCriticalControl reports whether the request of ctx marked its control of
+// controlType critical.
+func isCriticalControl(ctx context.Context, controlType string) bool {
+	critical, _ := ctx.Value(criticalControlsKey{}).([]string)
+	return slices.Contains(critical, controlType)
+}
+
+// ControlServerSideSorting is the Server Side Sorting request control
+// (RFC 2891).
+type ControlServerSideSorting struct {
+	Criticality bool
+	SortKeys    []*SortKey
+}
+
+func (c *ControlServerSideSorting) GetControlType() string {
+	return ControlTypeServerSideSorting
+}
+
+// Encode encodes the control:
+//
+//	SortKeyList ::= SEQUENCE OF SEQUENCE {
+//	    attributeType   AttributeDescription,
+//	    orderingRule    [0] MatchingRuleId OPTIONAL,
+//	    reverseOrder    [1] BOOLEAN DEFAULT FALSE }
+func (c *ControlServerSideSorting) Encode() *ber.Packet {
+	keys := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeyList")
+	for _, key := range c.SortKeys {
+		seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKey")
+		seq.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, key.AttributeType, "attributeType"))
+		if key.MatchingRule != "" {
+			seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, key.MatchingRule, "orderingRule"))
+		}
+		if key.Reverse {
+			seq.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, key.Reverse, "reverseOrder"))
+		}
+		keys.AppendChild(seq)
+	}
+	return encodeControl(c.GetControlType(), c.Criticality, keys)
+}
+
+func (c *ControlServerSideSorting) String() string {
+	return fmt.Sprintf("Control Type: %s (%q)  Criticality: %t  SortKeys: %v", "Server Side Sorting", c.GetControlType(), c.Criticality, c.SortKeys)
+}
+
+func decodeServerSideSorting(criticality bool, value *ber.Packet) (*ControlServerSideSorting, error) {
+	if value == nil {
+		return nil, errors.New("server side sorting: missing control value")
+	}
+	keys, err := ber.DecodePacketErr(value.Data.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("server side sorting: %s", err)
+	}
+	c := &ControlServerSideSorting{Criticality: criticality}
+	for _, seq := range keys.Children {
+		if len(seq.Children) == 0 {
+			return nil, errors.New("server side sorting: missing attributeType")
+		}
+		key := &SortKey{AttributeType: ber.DecodeString(seq.Children[0].Data.Bytes())}
+		for _, child := range seq.Children[1:] {
+			switch child.Tag {
+			case 0:
+				key.MatchingRule = ber.DecodeString(child.Data.Bytes())
+			case 1:
+				key.Reverse = len(child.Data.Bytes()) == 1 && child.Data.Bytes()[0] != 0
+			}
+		}
+		if key.AttributeType == "" {
+			return nil, errors.New("server side sorting: empty attributeType")
+		}
+		c.SortKeys = append(c.SortKeys, key)
+	}
+	if len(c.SortKeys) == 0 {
+		return nil, errors.New("server side sorting: no sort key")
+	}
+	return c, nil
+}
+
+// ControlServerSideSortingResult is the Server Side Sorting response control
+// (RFC 2891). AttributeType names the attribute that caused a sort failure.
+type ControlServerSideSortingResult struct {
+	Result        LDAPResultCode
+	AttributeType string
+}
+
+func (c *ControlServerSideSortingResult) GetControlType() string {
+	return ControlTypeServerSideSortingResult
+}
+
+// Encode encodes the control:
+//
+//	SortResult ::= SEQUENCE {
+//	    sortResult  ENUMERATED,
+//	    attributeType [0] AttributeDescription OPTIONAL }
+func (c *ControlServerSideSortingResult) Encode() *ber.Packet {
+	result := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortResult")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(c.Result), "sortResult"))
+	if c.AttributeType != "" {
+		result.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, c.AttributeType, "attributeType"))
+	}
+	return encodeControl(c.GetControlType(), false, result)
+}
+
+func (c *ControlServerSideSortingResult) String() string {
+	return fmt.Sprintf("Control Type: %s (%q)  Result: %s  AttributeType: %q", "Server Side Sorting Result", c.GetControlType(), LDAPResultCodeMap[c.Result], c.AttributeType)
+}
+
+// ControlVLV is the Virtual List View request control
+// (draft-ietf-ldapext-ldapv3-vlv). The target entry is found by Offset within
+// ContentCount, or, when ByValue is set, as the first entry whose primary sort
+// key is greater than or equal to AssertionValue.
+type ControlVLV struct {
+	Criticality    bool
+	BeforeCount    int
+	AfterCount     int
+	Offset         int
+	ContentCount   int
+	ByValue        bool
+	AssertionValue string
+	ContextID      []byte
+}
+
+func (c *ControlVLV) GetControlType() string {
+	return ControlTypeVLVRequest
+}
+
+// Encode encodes the control:
+//
+//	VirtualListViewRequest ::= SEQUENCE {
+//	    beforeCount    INTEGER (0..maxInt),
+//	    afterCount     INTEGER (0..maxInt),
+//	    target       CHOICE {
+//	        byOffset        [0] SEQUENCE {
+//	            offset          INTEGER (1 .. maxInt),
+//	            contentCount    INTEGER (0 .. maxInt) },
+//	        greaterThanOrEqual [1] AssertionValue },
+//	    contextID     OCTET STRING OPTIONAL }
+func (c *ControlVLV) Encode() *ber.Packet {
+	req := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewRequest")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.BeforeCount, "beforeCount"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.AfterCount, "afterCount"))
+	if c.ByValue {
+		req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, c.AssertionValue, "greaterThanOrEqual"))
+	} else {
+		byOffset := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "byOffset")
+		byOffset.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.Offset, "offset"))
+		byOffset.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.ContentCount, "contentCount"))
+		req.AppendChild(byOffset)
+	}
+	if c.ContextID != nil {
+		req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(c.ContextID), "contextID"))
+	}
+	return encodeControl(c.GetControlType(), c.Criticality, req)
+}
+
+func (c *ControlVLV) String() string {
+	target := fmt.Sprintf("Offset: %d  ContentCount: %d", c.Offset, c.ContentCount)
+	if c.ByValue {
+		target = fmt.Sprintf("GreaterThanOrEqual: %q", c.AssertionValue)
+	}
+	return fmt.Sprintf("Control Type: %s (%q)  Criticality: %t  BeforeCount: %d  AfterCount: %d  %s", "Virtual List View", c.GetControlType(), c.Criticality, c.BeforeCount, c.AfterCount, target)
+}
+
+func decodeVLV(criticality bool, value *ber.Packet) (*ControlVLV, error) {
+	if value == nil {
+		return nil, errors.New("virtual list view: missing control value")
+	}
+	req, err := ber.DecodePacketErr(value.Data.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("virtual list view: %s", err)
+	}
+	if len(req.Children) < 3 {
+		return nil, errors.New("virtual list view: missing target")
+	}
+	c := &ControlVLV{Criticality: criticality}
+	before, err := ber.ParseInt64(req.Children[0].Data.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("virtual list view: beforeCount: %s", err)
+	}
+	after, err := ber.ParseInt64(req.Children[1].Data.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("virtual list view: afterCount: %s", err)
+	}
+	c.BeforeCount, c.AfterCount = int(before), int(after)
+	switch target := req.Children[2]; target.Tag {
+	case 0:
+		if len(target.Children) != 2 {
+			return nil, errors.New("virtual list view: bad byOffset target")
+		}
+		offset, err := ber.ParseInt64(target.Children[0].Data.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("virtual list view: offset: %s", err)
+		}
+		count, err := ber.ParseInt64(target.Children[1].Data.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("virtual list view: contentCount: %s", err)
+		}
+		c.Offset, c.ContentCount = int(offset), int(count)
+	case 1:
+		c.ByValue = true
+		c.AssertionValue = ber.DecodeString(target.Data.Bytes())
+	default:
+		return nil, fmt.Errorf("virtual list view: unknown target [%d]", target.Tag)
+	}
+	if len(req.Children) > 3 {
+		c.ContextID = req.Children[3].Data.Bytes()
+	}
+	if c.BeforeCount < 0 || c.AfterCount < 0 || c.Offset < 0 || c.ContentCount < 0 {
+		return nil, errors.New("virtual list view: negative count")
+	}
+	return c, nil
+}
+
+// ControlVLVResponse is the Virtual List View response control.
+type ControlVLVResponse struct {
+	TargetPosition int
+	ContentCount   int
+	Result         LDAPResultCode
+	ContextID      []byte
+}
+
+func (c *ControlVLVResponse) GetControlType() string {
+	return ControlTypeVLVResponse
+}
+
+// Encode encodes the control:
+//
+//	VirtualListViewResponse ::= SEQUENCE {
+//	    targetPosition    INTEGER (0 .. maxInt),
+//	    contentCount     INTEGER (0 .. maxInt),
+//	    virtualListViewResult ENUMERATED,
+//	    contextID     OCTET STRING OPTIONAL }
+func (c *ControlVLVResponse) Encode() *ber.Packet {
+	resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewResponse")
+	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.TargetPosition, "targetPosition"))
+	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.ContentCount, "contentCount"))
+	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(c.Result), "virtualListViewResult"))
+	if c.ContextID != nil {
+		resp.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(c.ContextID), "contextID"))
+	}
+	return encodeControl(c.GetControlType(), false, resp)
+}
+
+func (c *ControlVLVResponse) String() string {
+	return fmt.Sprintf("Control Type: %s (%q)  TargetPosition: %d  ContentCount: %d  Result: %s", "Virtual List View Response", c.GetControlType(), c.TargetPosition, c.ContentCount, LDAPResultCodeMap[c.Result])
+}
+
+// encodeControl encodes a control whose value is the BER encoding of value.
+func encodeControl(controlType string, criticality bool, value *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlType, "Control Type ("+ldap.ControlTypeMap[controlType]+")"))
+	if criticality {
+		packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, criticality, "Criticality"))
+	}
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value.Bytes()), "Control Value"))
+	return packet
+}
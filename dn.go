@@ -0,0 +1,169 @@
+package ldap
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DN is a distinguished name (RFC 4514): its RDNs from the entry's own up to
+// the one right below the root. The empty DN names the Root DSE.
+type DN []RDN
+
+// RDN is a relative distinguished name: one attribute type and value, or
+// several for multi-valued RDNs such as cn=Smith+uid=jsmith.
+type RDN []AttributeTypeAndValue
+
+// AttributeTypeAndValue is an attribute type and one of its values, unescaped.
+type AttributeTypeAndValue struct {
+	Type  string
+	Value string
+}
+
+// ParseDN parses the string representation of a DN. Values may hold escaped
+// special characters and \XX escapes of any byte, or be hex-encoded BER
+// (#04...), and spaces around the separators are ignored.
+func ParseDN(s string) (DN, error) {
+	parsed, err := ldap.ParseDN(s)
+	if err != nil {
+		return nil, err
+	}
+	dn := make(DN, len(parsed.RDNs))
+	for i, rdn := range parsed.RDNs {
+		dn[i] = make(RDN, len(rdn.Attributes))
+		for j, ava := range rdn.Attributes {
+			dn[i][j] = AttributeTypeAndValue{Type: ava.Type, Value: ava.Value}
+		}
+	}
+	return dn, nil
+}
+
+// String returns the RFC 4514 representation of dn.
+func (dn DN) String() string {
+	rdns := make([]string, len(dn))
+	for i, rdn := range dn {
+		rdns[i] = rdn.String()
+	}
+	return strings.Join(rdns, ",")
+}
+
+// Normalize returns dn in its normal form: attribute types and values
+// lower-cased, runs of spaces in values collapsed, and the values of
+// multi-valued RDNs sorted. Normalized DNs naming the same entry have the
+// same String.
+func (dn DN) Normalize() DN {
+	normalized := make(DN, len(dn))
+	for i, rdn := range dn {
+		normalized[i] = rdn.Normalize()
+	}
+	return normalized
+}
+
+// Equal reports whether dn and other name the same entry.
+func (dn DN) Equal(other DN) bool {
+	return len(dn) == len(other) && dn.hasSuffix(other)
+}
+
+// Parent returns the DN of dn's parent, the empty DN for entries right below
+// the root, and nil for the root itself.
+func (dn DN) Parent() DN {
+	if len(dn) == 0 {
+		return nil
+	}
+	return dn[1:]
+}
+
+// IsChildOf reports whether dn names an immediate subordinate of parent.
+func (dn DN) IsChildOf(parent DN) bool {
+	return len(dn) == len(parent)+1 && dn.hasSuffix(parent)
+}
+
+// IsDescendantOf reports whether dn names a subordinate of ancestor, at any
+// depth.
+func (dn DN) IsDescendantOf(ancestor DN) bool {
+	return len(dn) > len(ancestor) && dn.hasSuffix(ancestor)
+}
+
+// InSubtree reports whether dn is base or one of its subordinates.
+func (dn DN) InSubtree(base DN) bool {
+	return len(dn) >= len(base) && dn.hasSuffix(base)
+}
+
+// hasSuffix reports whether the last RDNs of dn are those of suffix.
+func (dn DN) hasSuffix(suffix DN) bool {
+	offset := len(dn) - len(suffix)
+	for i, rdn := range suffix {
+		if !dn[offset+i].Equal(rdn) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the RFC 4514 representation of rdn.
+func (rdn RDN) String() string {
+	avas := make([]string, len(rdn))
+	for i, ava := range rdn {
+		avas[i] = ava.String()
+	}
+	return strings.Join(avas, "+")
+}
+
+// Normalize returns rdn in its normal form, as DN.Normalize.
+func (rdn RDN) Normalize() RDN {
+	normalized := make(RDN, len(rdn))
+	for i, ava := range rdn {
+		normalized[i] = AttributeTypeAndValue{Type: strings.ToLower(ava.Type), Value: normalizeSpace(strings.ToLower(ava.Value))}
+	}
+	slices.SortFunc(normalized, func(a, b AttributeTypeAndValue) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return normalized
+}
+
+// Equal reports whether rdn and other hold the same attribute values, in any
+// order.
+func (rdn RDN) Equal(other RDN) bool {
+	if len(rdn) != len(other) {
+		return false
+	}
+	return slices.Equal(rdn.Normalize(), other.Normalize())
+}
+
+// String returns the RFC 4514 representation of ava, escaping the value's
+// special characters.
+func (ava AttributeTypeAndValue) String() string {
+	return ava.Type + "=" + escapeDNValue(ava.Value)
+}
+
+// escapeDNValue escapes the characters RFC 4514 requires to be escaped in
+// attribute values.
+func escapeDNValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '"', c == '+', c == ',', c == ';', c == '<', c == '>', c == '\\',
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(v)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// normalizeDN puts a DN in its normal form, reporting false when v is not a
+// valid DN.
+func normalizeDN(v string) (string, bool) {
+	dn, err := ParseDN(v)
+	if err != nil {
+		return "", false
+	}
+	return dn.Normalize().String(), true
+}
@@ -0,0 +1,113 @@
+package ldap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDN(t *testing.T) {
+	for _, tt := range []struct {
+		dn   string
+		want DN
+	}{
+		{"", DN{}},
+		{"cn=Smith\\, John,dc=example", DN{{{"cn", "Smith, John"}}, {{"dc", "example"}}}},
+		{"cn=a+uid=b,dc=example", DN{{{"cn", "a"}, {"uid", "b"}}, {{"dc", "example"}}}},
+		{" dc = a , dc=b ", DN{{{"dc", "a"}}, {{"dc", "b"}}}},
+		{"cn=\\4a\\C3\\A9r\\c3\\b4me,dc=b", DN{{{"cn", "Jérôme"}}, {{"dc", "b"}}}},
+		{"cn=#04024869,dc=b", DN{{{"cn", "Hi"}}, {{"dc", "b"}}}},
+	} {
+		dn, err := ParseDN(tt.dn)
+		if err != nil {
+			t.Errorf("%q: %s", tt.dn, err)
+			continue
+		}
+		if !reflect.DeepEqual(dn, tt.want) {
+			t.Errorf("%q: expected %#v, got %#v", tt.dn, tt.want, dn)
+		}
+	}
+	for _, dn := range []string{"cn", "cn=a,", "cn=a\\", "cn=\\zz"} {
+		if _, err := ParseDN(dn); err == nil {
+			t.Errorf("%q should not parse", dn)
+		}
+	}
+}
+
+func TestDNString(t *testing.T) {
+	for _, tt := range []struct {
+		dn, want string
+	}{
+		{"cn=Smith\\, John , dc=Example", "cn=Smith\\, John,dc=Example"},
+		{"cn=\\#1\\ ,dc=b", "cn=\\#1\\ ,dc=b"},
+		{"cn=a\\+b\\<c\\>\\;\\\"\\\\,dc=b", "cn=a\\+b\\<c\\>\\;\\\"\\\\,dc=b"},
+		{"CN=B+UID=A,DC=Example", "CN=B+UID=A,DC=Example"},
+	} {
+		dn, err := ParseDN(tt.dn)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.dn, err)
+		}
+		if s := dn.String(); s != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.dn, tt.want, s)
+		}
+		// the string representation parses back to the same DN
+		if again, err := ParseDN(dn.String()); err != nil || !reflect.DeepEqual(again, dn) {
+			t.Errorf("%q: %q does not parse back: %v", tt.dn, dn.String(), err)
+		}
+	}
+	dn, _ := ParseDN("CN=B+UID=A,  DC=Example")
+	if s := dn.Normalize().String(); s != "cn=b+uid=a,dc=example" {
+		t.Errorf("unexpected normal form %q", s)
+	}
+}
+
+func TestDNCompare(t *testing.T) {
+	parse := func(s string) DN {
+		t.Helper()
+		dn, err := ParseDN(s)
+		if err != nil {
+			t.Fatalf("%q: %s", s, err)
+		}
+		return dn
+	}
+	base := parse("ou=People, dc=Example,dc=com")
+	for _, tt := range []struct {
+		dn                                  string
+		equal, child, descendant, inSubtree bool
+	}{
+		{"OU=people,DC=example,DC=com", true, false, false, true},
+		{"ou=People,dc=example,dc=com", true, false, false, true},
+		{"ou=#040650656f706c65,dc=example,dc=com", true, false, false, true},
+		{"cn=Smith\\, John,ou=People,dc=example,dc=com", false, true, true, true},
+		{"cn=a+uid=b,ou=People,dc=example,dc=com", false, true, true, true},
+		{"cn=x,cn=a+uid=b,ou=People,dc=example,dc=com", false, false, true, true},
+		{"cn=People\\,dc=example,dc=com", false, false, false, false},
+		{"ou=People,dc=sub-example,dc=com", false, false, false, false},
+		{"dc=example,dc=com", false, false, false, false},
+		{"", false, false, false, false},
+	} {
+		dn := parse(tt.dn)
+		if dn.Equal(base) != tt.equal || dn.IsChildOf(base) != tt.child || dn.IsDescendantOf(base) != tt.descendant || dn.InSubtree(base) != tt.inSubtree {
+			t.Errorf("%q: expected equal %v, child %v, descendant %v, in subtree %v", tt.dn, tt.equal, tt.child, tt.descendant, tt.inSubtree)
+		}
+	}
+
+	if !parse("cn=a+uid=b,dc=c").Equal(parse("UID=B + CN=A, DC=C")) {
+		t.Errorf("multi-valued RDNs should compare in any order")
+	}
+	if !parse("cn=John  Smith,dc=c").Equal(parse("cn=john smith,dc=c")) {
+		t.Errorf("values should compare ignoring case and repeated spaces")
+	}
+	if parse("cn=a+uid=b,dc=c").Equal(parse("cn=a,dc=c")) {
+		t.Errorf("RDNs of different sizes should differ")
+	}
+
+	if p := parse("cn=Smith\\, John,ou=People,dc=example,dc=com").Parent(); !p.Equal(base) {
+		t.Errorf("unexpected parent %s", p)
+	}
+	if p := parse("dc=com").Parent(); p == nil || len(p) != 0 {
+		t.Errorf("the parent of dc=com should be the root, got %#v", p)
+	}
+	if p := parse("").Parent(); p != nil {
+		t.Errorf("the root should have no parent, got %#v", p)
+	}
+}
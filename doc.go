@@ -0,0 +1,81 @@
+// Package ldap is an LDAPv3 server library (RFC 4511), modeled after net/http:
+// handlers are registered for the operations they support by baseDN, and the
+// server is started with ListenAndServe.
+//
+// # Routing
+//
+// Handlers are routed by the RDNs of their baseDN, the most specific one
+// winning, so dc=example doesn't cover dc=sub-example. A baseDN prefixed with
+// "=" only handles the entry it names, and wildcard RDNs mount handlers on many
+// subtrees: "ou=*,dc=example" or "*,ou=hosts,dc=example". Operations on DNs no
+// handler covers fail with noSuchObject, or a referral to Server.Referrals,
+// and handlers refer to other servers by returning a *ReferralError. The
+// handlers NewServer registers for "" only answer while no other handler of
+// their operation is registered.
+//
+// DNs are parsed by ParseDN (RFC 4514), which handles escaped special
+// characters such as cn=Smith\, John, \XX and #-hex encoded values,
+// multi-valued RDNs and spaces around separators. DNs compare in their normal
+// form with DN.Equal, DN.IsChildOf, DN.IsDescendantOf and DN.InSubtree.
+//
+// # Searches
+//
+// Handlers return the entries of a search as a whole (Searcher) or write
+// them, with references and intermediate responses, to a SearchResultWriter as
+// they produce them (SearchStreamer). With Server.EnforceLDAP, the server
+// applies the search filter, attribute selection, size limit, scope and base
+// DN to the entries handlers return, so they needn't worry about LDAP
+// internals. It then also answers the Simple Paged Results (RFC 2696), Server
+// Side Sorting (RFC 2891) and Virtual List View controls, unless the handler
+// implements PagedSearcher, NativeSorter or VLVSearcher to serve them itself.
+//
+// Operations on a connection are processed concurrently, each in its own
+// goroutine, up to Server.MaxOutstanding, so a slow search doesn't hold up the
+// requests sent behind it. Abandoned and canceled operations see their context
+// canceled.
+//
+// # Filters
+//
+// ParseFilter and DecodeFilter turn the string representation (RFC 4515) and
+// the BER encoding of filters into a typed Filter: AndFilter, OrFilter,
+// NotFilter, EqualityFilter, SubstringsFilter, OrderingFilter, PresentFilter,
+// ApproxFilter and ExtensibleFilter. Handlers translating filters to their
+// backend's queries implement a FilterVisitor or use WalkFilter, and the
+// sqlfilter package translates them to SQL predicates. CompileFilter,
+// DecompileFilter and EscapeFilter work on the BER encoding and strings.
+//
+// MatchFilter evaluates a filter against an entry. With a schema, values are
+// compared with the EQUALITY, ORDERING and SUBSTR matching rules of their
+// attribute types, or the default rules of their syntax, and a filter on a
+// type also matches its subtypes; otherwise values are compared ignoring
+// case. Approximate matches compare the Soundex of words. Extensible match
+// filters may name any of these rules, Active Directory's bitwise rules
+// (MatchingRuleBitAnd, MatchingRuleBitOr) or the rules added with
+// RegisterMatchingRule.
+//
+// # Schema and Root DSE
+//
+// Server.Schema, built with the schema package from RFC 4512 definitions and
+// OpenLDAP .schema or LDIF files, is published at SubschemaDN and used by
+// EnforceLDAP to evaluate filters. Base-scope searches of the empty DN return a
+// Root DSE synthesised from the server's configuration: its naming contexts,
+// supported controls, extended operations (see ExtensionAdvertiser), SASL
+// mechanisms and subschemaSubentry. Server.RootDSEHook amends it, and
+// Server.RootDSE or a Searcher registered for "=" replaces it.
+//
+// # Extended operations
+//
+// Extenders receive the raw ExtendedRequest and answer an ExtendedResponse.
+// The server answers Who am I? (RFC 4532) itself, Password Modify (RFC 3062)
+// through PasswordModifiers routed by the DN whose password changes, and
+// Cancel (RFC 3909) by canceling the named operation.
+//
+// # SASL
+//
+// Mechanisms registered with Server.RegisterSASLMechanism are offered in SASL
+// binds (RFC 4513), and bind handlers implementing SASLBinder authorize the
+// identity they authenticate. NewSASLPlain provides PLAIN, NewSASLExternal
+// EXTERNAL with the client certificates of LDAPS and StartTLS connections,
+// and NewSASLSCRAMSHA256 and NewSASLSCRAMSHA512 SCRAM (RFC 5802, RFC 7677),
+// with their channel binding -PLUS variants.
+package ldap
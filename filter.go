@@ -7,10 +7,14 @@ package ldap
 import (
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
+
+	"go.linka.cloud/ldap/schema"
 )
 
 const (
@@ -45,364 +49,406 @@ const (
 	FilterSubstringsFinal   = 2
 )
 
-func CompileFilter(filter string) (*ber.Packet, error) {
+const (
+	FilterExtensibleMatchMatchingRule = 1
+	FilterExtensibleMatchType         = 2
+	FilterExtensibleMatchValue        = 3
+	FilterExtensibleMatchDNAttributes = 4
+)
+
+// ParseFilter parses the string representation of a search filter (RFC
+// 4515). Assertion values may escape any byte as \XX.
+func ParseFilter(filter string) (Filter, error) {
 	if len(filter) == 0 || filter[0] != '(' {
 		return nil, NewError(ErrorFilterCompile, errors.New("ldap: filter does not start with an '('"))
 	}
-	packet, pos, err := compileFilter(filter, 1)
+	p := &filterParser{filter: filter}
+	f, err := p.parseFilter()
 	if err != nil {
 		return nil, err
 	}
-	if pos != len(filter) {
-		return nil, NewError(ErrorFilterCompile, errors.New("ldap: finished compiling filter with extra at end: "+fmt.Sprint(filter[pos:])))
+	if p.pos != len(filter) {
+		return nil, NewError(ErrorFilterCompile, errors.New("ldap: finished compiling filter with extra at end: "+fmt.Sprint(filter[p.pos:])))
+	}
+	return f, nil
+}
+
+// CompileFilter compiles the string representation of a search filter (RFC
+// 4515) to its BER encoding.
+func CompileFilter(filter string) (*ber.Packet, error) {
+	f, err := ParseFilter(filter)
+	if err != nil {
+		return nil, err
 	}
-	return packet, nil
+	return f.Encode(), nil
 }
 
+// DecompileFilter returns the string representation (RFC 4515) of a search
+// filter, escaping the assertion values that need it.
 func DecompileFilter(packet *ber.Packet) (ret string, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = NewError(ErrorFilterDecompile, errors.New("ldap: error decompiling filter"))
 		}
 	}()
-	ret = "("
-	err = nil
-	childStr := ""
+	f, err := DecodeFilter(packet)
+	if err != nil {
+		return "", err
+	}
+	return f.String(), nil
+}
 
-	switch packet.Tag {
-	case FilterAnd:
-		ret += "&"
-		for _, child := range packet.Children {
-			childStr, err = DecompileFilter(child)
-			if err != nil {
-				return
-			}
-			ret += childStr
+// EscapeFilter escapes an assertion value for use in the string
+// representation of a filter: the special characters *, (, ), \ and NUL, and
+// the bytes that are not valid UTF-8, become \XX escapes.
+func EscapeFilter(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); {
+		r, size := utf8.DecodeRuneInString(v[i:])
+		switch {
+		case r == utf8.RuneError && size == 1, r == 0, r == '*', r == '(', r == ')', r == '\\':
+			fmt.Fprintf(&b, "\\%02x", v[i])
+		default:
+			b.WriteString(v[i : i+size])
 		}
-	case FilterOr:
-		ret += "|"
-		for _, child := range packet.Children {
-			childStr, err = DecompileFilter(child)
-			if err != nil {
-				return
-			}
-			ret += childStr
+		i += size
+	}
+	return b.String()
+}
+
+// filterParser is a recursive descent parser of the string representation of
+// filters.
+type filterParser struct {
+	filter string
+	pos    int
+}
+
+func (p *filterParser) errorf(format string, args ...any) error {
+	return NewError(ErrorFilterCompile, fmt.Errorf("ldap: "+format, args...))
+}
+
+// parseFilter parses "(" filtercomp ")".
+func (p *filterParser) parseFilter() (Filter, error) {
+	if p.pos+1 >= len(p.filter) {
+		return nil, p.errorf("unexpected end of filter")
+	}
+	if p.filter[p.pos] != '(' {
+		return nil, p.errorf("expected '(' at position %d", p.pos)
+	}
+	p.pos++
+	var f Filter
+	var err error
+	switch p.filter[p.pos] {
+	case '&':
+		p.pos++
+		var filters []Filter
+		if filters, err = p.parseSet(); err == nil {
+			f = AndFilter{Filters: filters}
 		}
-	case FilterNot:
-		ret += "!"
-		childStr, err = DecompileFilter(packet.Children[0])
-		if err != nil {
-			return
+	case '|':
+		p.pos++
+		var filters []Filter
+		if filters, err = p.parseSet(); err == nil {
+			f = OrFilter{Filters: filters}
 		}
-		ret += childStr
-
-	case FilterSubstrings:
-		ret += ber.DecodeString(packet.Children[0].Data.Bytes())
-		ret += "="
-		switch packet.Children[1].Children[0].Tag {
-		case FilterSubstringsInitial:
-			ret += ber.DecodeString(packet.Children[1].Children[0].Data.Bytes()) + "*"
-		case FilterSubstringsAny:
-			ret += "*" + ber.DecodeString(packet.Children[1].Children[0].Data.Bytes()) + "*"
-		case FilterSubstringsFinal:
-			ret += "*" + ber.DecodeString(packet.Children[1].Children[0].Data.Bytes())
+	case '!':
+		p.pos++
+		var child Filter
+		if child, err = p.parseFilter(); err == nil {
+			f = NotFilter{Filter: child}
 		}
-	case FilterEqualityMatch:
-		ret += ber.DecodeString(packet.Children[0].Data.Bytes())
-		ret += "="
-		ret += ber.DecodeString(packet.Children[1].Data.Bytes())
-	case FilterGreaterOrEqual:
-		ret += ber.DecodeString(packet.Children[0].Data.Bytes())
-		ret += ">="
-		ret += ber.DecodeString(packet.Children[1].Data.Bytes())
-	case FilterLessOrEqual:
-		ret += ber.DecodeString(packet.Children[0].Data.Bytes())
-		ret += "<="
-		ret += ber.DecodeString(packet.Children[1].Data.Bytes())
-	case FilterPresent:
-		ret += ber.DecodeString(packet.Data.Bytes())
-		ret += "=*"
-	case FilterApproxMatch:
-		ret += ber.DecodeString(packet.Children[0].Data.Bytes())
-		ret += "~="
-		ret += ber.DecodeString(packet.Children[1].Data.Bytes())
+	default:
+		f, err = p.parseItem()
 	}
-
-	ret += ")"
-	return
+	if err != nil {
+		return nil, err
+	}
+	if p.pos == len(p.filter) {
+		return nil, p.errorf("unexpected end of filter")
+	}
+	if p.filter[p.pos] != ')' {
+		return nil, p.errorf("expected ')' at position %d", p.pos)
+	}
+	p.pos++
+	return f, nil
 }
 
-func compileFilterSet(filter string, pos int, parent *ber.Packet) (int, error) {
-	for pos < len(filter) && filter[pos] == '(' {
-		child, newPos, err := compileFilter(filter, pos+1)
+// parseSet parses the filters of an and or or filter. They may be empty (RFC
+// 4526).
+func (p *filterParser) parseSet() ([]Filter, error) {
+	var filters []Filter
+	for p.pos < len(p.filter) && p.filter[p.pos] == '(' {
+		f, err := p.parseFilter()
 		if err != nil {
-			return pos, err
+			return nil, err
 		}
-		pos = newPos
-		parent.AppendChild(child)
+		filters = append(filters, f)
 	}
-	if pos == len(filter) {
-		return pos, NewError(ErrorFilterCompile, errors.New("ldap: unexpected end of filter"))
-	}
-
-	return pos + 1, nil
+	return filters, nil
 }
 
-func compileFilter(filter string, pos int) (*ber.Packet, int, error) {
-	var packet *ber.Packet
-	var err error
+// parseItem parses the simple, present, substrings and extensible filters:
+// an attribute description, the filter type, and a value running to the
+// closing parenthesis.
+func (p *filterParser) parseItem() (Filter, error) {
+	end := strings.IndexByte(p.filter[p.pos:], ')')
+	if end < 0 {
+		return nil, p.errorf("unexpected end of filter")
+	}
+	item := p.filter[p.pos : p.pos+end]
+	eq := strings.IndexByte(item, '=')
+	if eq < 0 {
+		return nil, p.errorf("missing filter type in %q", item)
+	}
+	description, value := item[:eq], item[eq+1:]
+	p.pos += end
 
-	defer func() {
-		if r := recover(); r != nil {
-			err = NewError(ErrorFilterCompile, errors.New("ldap: error compiling filter"))
+	tag := ber.Tag(FilterEqualityMatch)
+	switch {
+	case strings.HasSuffix(description, ":"):
+		return parseExtensibleMatch(description[:len(description)-1], value)
+	case strings.HasSuffix(description, ">"):
+		tag = FilterGreaterOrEqual
+	case strings.HasSuffix(description, "<"):
+		tag = FilterLessOrEqual
+	case strings.HasSuffix(description, "~"):
+		tag = FilterApproxMatch
+	}
+	attribute := description
+	if tag != FilterEqualityMatch {
+		attribute = description[:len(description)-1]
+	}
+	if !validFilterAttribute(attribute) {
+		return nil, p.errorf("invalid attribute description %q", attribute)
+	}
+
+	parts, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(parts) == 1:
+		switch tag {
+		case FilterGreaterOrEqual, FilterLessOrEqual:
+			return OrderingFilter{Attribute: attribute, Value: parts[0], LessOrEqual: tag == FilterLessOrEqual}, nil
+		case FilterApproxMatch:
+			return ApproxFilter{Attribute: attribute, Value: parts[0]}, nil
 		}
-	}()
+		return EqualityFilter{Attribute: attribute, Value: parts[0]}, nil
+	case tag != FilterEqualityMatch:
+		return nil, p.errorf("unescaped '*' in the value of %q", item)
+	case value == "*":
+		return PresentFilter{Attribute: attribute}, nil
+	}
+	f := SubstringsFilter{Attribute: attribute, Initial: parts[0], Final: parts[len(parts)-1]}
+	for _, part := range parts[1 : len(parts)-1] {
+		if part != "" {
+			f.Any = append(f.Any, part)
+		}
+	}
+	if f.Initial == "" && len(f.Any) == 0 && f.Final == "" {
+		return nil, p.errorf("empty substrings in %q", item)
+	}
+	return f, nil
+}
 
-	newPos := pos
-	switch filter[pos] {
-	case '(':
-		packet, newPos, err = compileFilter(filter, pos+1)
-		newPos++
-		return packet, newPos, err
-	case '&':
-		packet = ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterAnd, nil, FilterMap[FilterAnd])
-		newPos, err = compileFilterSet(filter, pos+1, packet)
-		return packet, newPos, err
-	case '|':
-		packet = ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterOr, nil, FilterMap[FilterOr])
-		newPos, err = compileFilterSet(filter, pos+1, packet)
-		return packet, newPos, err
-	case '!':
-		packet = ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterNot, nil, FilterMap[FilterNot])
-		var child *ber.Packet
-		child, newPos, err = compileFilter(filter, pos+1)
-		packet.AppendChild(child)
-		return packet, newPos, err
-	default:
-		attribute := ""
-		condition := ""
+// validFilterAttribute reports whether s can be the attribute description of
+// a filter: it is not empty and holds none of the filter's special characters.
+func validFilterAttribute(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "()*\\:<>~= \x00")
+}
 
-		for w := 0; newPos < len(filter) && filter[newPos] != ')'; newPos += w {
-			rune, width := utf8.DecodeRuneInString(filter[newPos:])
-			w = width
-			switch {
-			case packet != nil:
-				condition += fmt.Sprintf("%c", rune)
-			case filter[newPos] == '=':
-				packet = ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterEqualityMatch, nil, FilterMap[FilterEqualityMatch])
-			case filter[newPos] == '>' && filter[newPos+1] == '=':
-				packet = ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterGreaterOrEqual, nil, FilterMap[FilterGreaterOrEqual])
-				newPos++
-			case filter[newPos] == '<' && filter[newPos+1] == '=':
-				packet = ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterLessOrEqual, nil, FilterMap[FilterLessOrEqual])
-				newPos++
-			case filter[newPos] == '~' && filter[newPos+1] == '=':
-				packet = ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterApproxMatch, nil, FilterMap[FilterLessOrEqual])
-				newPos++
-			case packet == nil:
-				attribute += fmt.Sprintf("%c", filter[newPos])
+// unescapeFilterValue decodes the \XX escapes of an assertion value, split on
+// its unescaped asterisks.
+func unescapeFilterValue(v string) ([]string, error) {
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '*':
+			parts = append(parts, b.String())
+			b.Reset()
+		case '\\':
+			if i+2 >= len(v) || !isHex(v[i+1]) || !isHex(v[i+2]) {
+				return nil, NewError(ErrorFilterCompile, fmt.Errorf("ldap: invalid escape in %q", v))
 			}
-		}
-		if newPos == len(filter) {
-			err = NewError(ErrorFilterCompile, errors.New("ldap: unexpected end of filter"))
-			return packet, newPos, err
-		}
-		if packet == nil {
-			err = NewError(ErrorFilterCompile, errors.New("ldap: error parsing filter"))
-			return packet, newPos, err
-		}
-		// Handle FilterEqualityMatch as a separate case (is primitive, not constructed like the other filters)
-		if packet.Tag == FilterEqualityMatch && condition == "*" {
-			packet.TagType = ber.TypePrimitive
-			packet.Tag = FilterPresent
-			packet.Description = FilterMap[packet.Tag]
-			packet.Data.WriteString(attribute)
-			return packet, newPos + 1, nil
-		}
-		packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "Attribute"))
-		switch {
-		case packet.Tag == FilterEqualityMatch && condition[0] == '*' && condition[len(condition)-1] == '*':
-			// Any
-			packet.Tag = FilterSubstrings
-			packet.Description = FilterMap[packet.Tag]
-			seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Substrings")
-			seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterSubstringsAny, condition[1:len(condition)-1], "Any Substring"))
-			packet.AppendChild(seq)
-		case packet.Tag == FilterEqualityMatch && condition[0] == '*':
-			// Final
-			packet.Tag = FilterSubstrings
-			packet.Description = FilterMap[packet.Tag]
-			seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Substrings")
-			seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterSubstringsFinal, condition[1:], "Final Substring"))
-			packet.AppendChild(seq)
-		case packet.Tag == FilterEqualityMatch && condition[len(condition)-1] == '*':
-			// Initial
-			packet.Tag = FilterSubstrings
-			packet.Description = FilterMap[packet.Tag]
-			seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Substrings")
-			seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterSubstringsInitial, condition[:len(condition)-1], "Initial Substring"))
-			packet.AppendChild(seq)
+			c, _ := strconv.ParseUint(v[i+1:i+3], 16, 8)
+			b.WriteByte(byte(c))
+			i += 2
+		case '(', 0:
+			return nil, NewError(ErrorFilterCompile, fmt.Errorf("ldap: unescaped %q in %q", v[i], v))
 		default:
-			packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, condition, "Condition"))
+			b.WriteByte(v[i])
 		}
-		newPos++
-		return packet, newPos, err
 	}
+	return append(parts, b.String()), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// parseExtensibleMatch parses the extensible match of value described by
+// "type[:dn][:rule]" or "[:dn]:rule" (RFC 4515 3).
+func parseExtensibleMatch(description, value string) (Filter, error) {
+	parts := strings.Split(description, ":")
+	f := ExtensibleFilter{Attribute: parts[0]}
+	parts = parts[1:]
+	if slices.Contains(parts, "") {
+		return nil, NewError(ErrorFilterCompile, errors.New("ldap: invalid extensible match "+description+":="+value))
+	}
+	if len(parts) > 0 && strings.EqualFold(parts[0], "dn") {
+		f.DNAttributes = true
+		parts = parts[1:]
+	}
+	if len(parts) > 0 {
+		f.MatchingRule = parts[0]
+		parts = parts[1:]
+	}
+	if len(parts) > 0 || (f.Attribute == "" && f.MatchingRule == "") ||
+		(f.Attribute != "" && !validFilterAttribute(f.Attribute)) || (f.MatchingRule != "" && !validFilterAttribute(f.MatchingRule)) {
+		return nil, NewError(ErrorFilterCompile, errors.New("ldap: invalid extensible match "+description+":="+value))
+	}
+	values, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 1 {
+		return nil, NewError(ErrorFilterCompile, errors.New("ldap: unescaped '*' in extensible match "+description+":="+value))
+	}
+	f.Value = values[0]
+	return f, nil
 }
 
 func ServerApplyFilter(f *ber.Packet, entry *Entry) (bool, LDAPResultCode) {
-	switch FilterMap[f.Tag] {
-	default:
-		// Log.Fatalf("Unknown LDAP filter code: %d", f.Tag)
+	return ServerApplyFilterSchema(f, entry, nil)
+}
+
+// ServerApplyFilterSchema is ServerApplyFilter comparing values with the
+// matching rules sc gives their attribute types, see MatchFilter.
+func ServerApplyFilterSchema(f *ber.Packet, entry *Entry, sc *schema.Schema) (bool, LDAPResultCode) {
+	filter, err := DecodeFilter(f)
+	if err != nil {
 		return false, LDAPResultOperationsError
-	case "Equality Match":
-		if len(f.Children) != 2 {
-			return false, LDAPResultOperationsError
-		}
-		attribute := f.Children[0].Value.(string)
-		value := f.Children[1].Value.(string)
-		for _, a := range entry.Attributes {
-			if strings.EqualFold(a.Name, attribute) {
-				for _, v := range a.Values {
-					if strings.EqualFold(v, value) {
-						return true, LDAPResultSuccess
-					}
-				}
+	}
+	return MatchFilter(filter, entry, sc), LDAPResultSuccess
+}
+
+// MatchFilter reports whether entry matches f. Values are compared with the
+// matching rules sc gives their attribute types, falling back to their
+// syntax. A filter on an attribute type also applies to its subtypes. Without
+// a schema, and for attribute types it doesn't define, values are compared
+// ignoring case.
+func MatchFilter(f Filter, entry *Entry, sc *schema.Schema) bool {
+	switch f := f.(type) {
+	case AndFilter:
+		for _, child := range f.Filters {
+			if !MatchFilter(child, entry, sc) {
+				return false
 			}
 		}
-	case "Present":
-		for _, a := range entry.Attributes {
-			if strings.EqualFold(a.Name, f.Data.String()) {
-				return true, LDAPResultSuccess
+		return true
+	case OrFilter:
+		for _, child := range f.Filters {
+			if MatchFilter(child, entry, sc) {
+				return true
 			}
 		}
-	case "And":
-		for _, child := range f.Children {
-			ok, exitCode := ServerApplyFilter(child, entry)
-			if exitCode != LDAPResultSuccess {
-				return false, exitCode
+	case NotFilter:
+		return !MatchFilter(f.Filter, entry, sc)
+	case EqualityFilter:
+		rule := attributeRule(sc, f.Attribute, sc.EqualityRule)
+		value, ok := rule.normalize(f.Value)
+		if !ok {
+			return false
+		}
+		for _, a := range matchingAttributes(sc, entry, f.Attribute) {
+			for _, v := range a.Values {
+				if v, ok := rule.normalize(v); ok && v == value {
+					return true
+				}
 			}
-			if !ok {
-				return false, LDAPResultSuccess
+		}
+	case PresentFilter:
+		return len(matchingAttributes(sc, entry, f.Attribute)) > 0
+	case SubstringsFilter:
+		rule := attributeRule(sc, f.Attribute, sc.SubstringRule)
+		// absent components are empty, whatever the rule
+		normalize := func(v string) (string, bool) {
+			if v == "" {
+				return "", true
 			}
+			return rule.normalize(v)
+		}
+		initial, ok := normalize(f.Initial)
+		if !ok {
+			return false
 		}
-		return true, LDAPResultSuccess
-	case "Or":
-		anyOk := false
-		for _, child := range f.Children {
-			ok, exitCode := ServerApplyFilter(child, entry)
-			if exitCode != LDAPResultSuccess {
-				return false, exitCode
-			} else if ok {
-				anyOk = true
+		final, ok := normalize(f.Final)
+		if !ok {
+			return false
+		}
+		middle := make([]string, len(f.Any))
+		for i, v := range f.Any {
+			if middle[i], ok = normalize(v); !ok {
+				return false
 			}
 		}
-		if anyOk {
-			return true, LDAPResultSuccess
+		for _, a := range matchingAttributes(sc, entry, f.Attribute) {
+			for _, v := range a.Values {
+				if v, ok := rule.normalize(v); ok && matchSubstrings(v, initial, middle, final) {
+					return true
+				}
+			}
 		}
-	case "Not":
-		if len(f.Children) != 1 {
-			return false, LDAPResultOperationsError
+	case OrderingFilter:
+		rule := attributeOrderingRule(sc, f.Attribute)
+		if rule.valid != nil && !rule.valid(f.Value) {
+			return false
 		}
-		ok, exitCode := ServerApplyFilter(f.Children[0], entry)
-		if exitCode != LDAPResultSuccess {
-			return false, exitCode
-		} else if !ok {
-			return true, LDAPResultSuccess
+		for _, a := range matchingAttributes(sc, entry, f.Attribute) {
+			for _, v := range a.Values {
+				if rule.valid != nil && !rule.valid(v) {
+					continue
+				}
+				c := rule.compare(v, f.Value)
+				if c == 0 || (c < 0) == f.LessOrEqual {
+					return true
+				}
+			}
 		}
-	case "Substrings":
-		if len(f.Children) != 2 {
-			return false, LDAPResultOperationsError
+	case ApproxFilter:
+		rule := attributeRule(sc, f.Attribute, sc.EqualityRule)
+		value, ok := rule.normalize(f.Value)
+		if !ok {
+			return false
 		}
-		attribute := f.Children[0].Value.(string)
-		valueBytes := f.Children[1].Children[0].Data.Bytes()
-		valueLower := strings.ToLower(string(valueBytes[:]))
-		for _, a := range entry.Attributes {
-			if strings.ToLower(a.Name) == strings.ToLower(attribute) {
-				for _, v := range a.Values {
-					vLower := strings.ToLower(v)
-					switch f.Children[1].Children[0].Tag {
-					case FilterSubstringsInitial:
-						if strings.HasPrefix(vLower, valueLower) {
-							return true, LDAPResultSuccess
-						}
-					case FilterSubstringsAny:
-						if strings.Contains(vLower, valueLower) {
-							return true, LDAPResultSuccess
-						}
-					case FilterSubstringsFinal:
-						if strings.HasSuffix(vLower, valueLower) {
-							return true, LDAPResultSuccess
-						}
-					}
+		for _, a := range matchingAttributes(sc, entry, f.Attribute) {
+			for _, v := range a.Values {
+				if v, ok := rule.normalize(v); ok && approxMatch(rule, v, value) {
+					return true
 				}
 			}
 		}
-	case "FilterGreaterOrEqual": // TODO
-		return false, LDAPResultOperationsError
-	case "FilterLessOrEqual": // TODO
-		return false, LDAPResultOperationsError
-	case "FilterApproxMatch": // TODO
-		return false, LDAPResultOperationsError
-	case "FilterExtensibleMatch": // TODO
-		return false, LDAPResultOperationsError
+	case ExtensibleFilter:
+		return matchExtensible(f, entry, sc)
 	}
-
-	return false, LDAPResultSuccess
+	return false
 }
 
+// GetFilterObjectClass returns the lower-cased object class filter asserts
+// equality with, the last one when it names several.
 func GetFilterObjectClass(filter string) (string, error) {
-	f, err := CompileFilter(filter)
+	f, err := ParseFilter(filter)
 	if err != nil {
 		return "", err
 	}
-	return parseFilterObjectClass(f)
-}
-
-func parseFilterObjectClass(f *ber.Packet) (string, error) {
 	objectClass := ""
-	switch FilterMap[f.Tag] {
-	case "Equality Match":
-		if len(f.Children) != 2 {
-			return "", errors.New("Equality match must have only two children")
-		}
-		attribute := strings.ToLower(f.Children[0].Value.(string))
-		value := f.Children[1].Value.(string)
-		if attribute == "objectclass" {
-			objectClass = strings.ToLower(value)
-		}
-	case "And":
-		for _, child := range f.Children {
-			subType, err := parseFilterObjectClass(child)
-			if err != nil {
-				return "", err
-			}
-			if len(subType) > 0 {
-				objectClass = subType
-			}
+	WalkFilter(f, func(f Filter) bool {
+		if f, ok := f.(EqualityFilter); ok && strings.EqualFold(f.Attribute, "objectclass") {
+			objectClass = f.Value
 		}
-	case "Or":
-		for _, child := range f.Children {
-			subType, err := parseFilterObjectClass(child)
-			if err != nil {
-				return "", err
-			}
-			if len(subType) > 0 {
-				objectClass = subType
-			}
-		}
-	case "Not":
-		if len(f.Children) != 1 {
-			return "", errors.New("Not filter must have only one child")
-		}
-		subType, err := parseFilterObjectClass(f.Children[0])
-		if err != nil {
-			return "", err
-		}
-		if len(subType) > 0 {
-			objectClass = subType
-		}
-
-	}
+		return true
+	})
 	return strings.ToLower(objectClass), nil
 }
@@ -0,0 +1,352 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Filter is a search filter (RFC 4511 4.5.1). It is one of AndFilter,
+// OrFilter, NotFilter, EqualityFilter, SubstringsFilter, OrderingFilter,
+// PresentFilter, ApproxFilter and ExtensibleFilter.
+type Filter interface {
+	// Encode returns the BER encoding of the filter.
+	Encode() *ber.Packet
+	// String returns the string representation of the filter (RFC 4515).
+	String() string
+	// Accept calls the method of v for the filter's type.
+	Accept(v FilterVisitor) error
+}
+
+// FilterVisitor is implemented by the code translating filters, e.g. to
+// database queries. Its methods are called by Filter.Accept, and visit the
+// filters of AndFilter, OrFilter and NotFilter by calling their Accept method
+// in turn.
+type FilterVisitor interface {
+	VisitAnd(f AndFilter) error
+	VisitOr(f OrFilter) error
+	VisitNot(f NotFilter) error
+	VisitEquality(f EqualityFilter) error
+	VisitSubstrings(f SubstringsFilter) error
+	VisitOrdering(f OrderingFilter) error
+	VisitPresent(f PresentFilter) error
+	VisitApprox(f ApproxFilter) error
+	VisitExtensible(f ExtensibleFilter) error
+}
+
+// AndFilter matches entries matching all of its filters, and every entry when
+// it has none (RFC 4526).
+type AndFilter struct {
+	Filters []Filter
+}
+
+// OrFilter matches entries matching any of its filters, and none when it has
+// none (RFC 4526).
+type OrFilter struct {
+	Filters []Filter
+}
+
+// NotFilter matches entries that don't match its filter.
+type NotFilter struct {
+	Filter Filter
+}
+
+// EqualityFilter is (Attribute=Value).
+type EqualityFilter struct {
+	Attribute string
+	Value     string
+}
+
+// SubstringsFilter is (Attribute=Initial*Any*...*Final). Initial and Final
+// are empty when the filter doesn't constrain them.
+type SubstringsFilter struct {
+	Attribute string
+	Initial   string
+	Any       []string
+	Final     string
+}
+
+// OrderingFilter is (Attribute>=Value), or (Attribute<=Value) with
+// LessOrEqual.
+type OrderingFilter struct {
+	Attribute   string
+	Value       string
+	LessOrEqual bool
+}
+
+// PresentFilter is (Attribute=*).
+type PresentFilter struct {
+	Attribute string
+}
+
+// ApproxFilter is (Attribute~=Value).
+type ApproxFilter struct {
+	Attribute string
+	Value     string
+}
+
+// ExtensibleFilter is (Attribute:dn:MatchingRule:=Value), with :dn when
+// DNAttributes is set. Either Attribute or MatchingRule may be empty.
+type ExtensibleFilter struct {
+	MatchingRule string
+	Attribute    string
+	Value        string
+	DNAttributes bool
+}
+
+func (f AndFilter) Accept(v FilterVisitor) error        { return v.VisitAnd(f) }
+func (f OrFilter) Accept(v FilterVisitor) error         { return v.VisitOr(f) }
+func (f NotFilter) Accept(v FilterVisitor) error        { return v.VisitNot(f) }
+func (f EqualityFilter) Accept(v FilterVisitor) error   { return v.VisitEquality(f) }
+func (f SubstringsFilter) Accept(v FilterVisitor) error { return v.VisitSubstrings(f) }
+func (f OrderingFilter) Accept(v FilterVisitor) error   { return v.VisitOrdering(f) }
+func (f PresentFilter) Accept(v FilterVisitor) error    { return v.VisitPresent(f) }
+func (f ApproxFilter) Accept(v FilterVisitor) error     { return v.VisitApprox(f) }
+func (f ExtensibleFilter) Accept(v FilterVisitor) error { return v.VisitExtensible(f) }
+
+func (f AndFilter) Encode() *ber.Packet {
+	return encodeFilterSet(FilterAnd, f.Filters)
+}
+
+func (f OrFilter) Encode() *ber.Packet {
+	return encodeFilterSet(FilterOr, f.Filters)
+}
+
+func encodeFilterSet(tag ber.Tag, filters []Filter) *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, tag, nil, FilterMap[tag])
+	for _, f := range filters {
+		packet.AppendChild(f.Encode())
+	}
+	return packet
+}
+
+func (f NotFilter) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterNot, nil, FilterMap[FilterNot])
+	packet.AppendChild(f.Filter.Encode())
+	return packet
+}
+
+func (f EqualityFilter) Encode() *ber.Packet {
+	return encodeAttributeValueAssertion(FilterEqualityMatch, f.Attribute, f.Value)
+}
+
+func (f OrderingFilter) Encode() *ber.Packet {
+	if f.LessOrEqual {
+		return encodeAttributeValueAssertion(FilterLessOrEqual, f.Attribute, f.Value)
+	}
+	return encodeAttributeValueAssertion(FilterGreaterOrEqual, f.Attribute, f.Value)
+}
+
+func (f ApproxFilter) Encode() *ber.Packet {
+	return encodeAttributeValueAssertion(FilterApproxMatch, f.Attribute, f.Value)
+}
+
+func encodeAttributeValueAssertion(tag ber.Tag, attribute, value string) *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, tag, nil, FilterMap[tag])
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "Attribute"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Condition"))
+	return packet
+}
+
+func (f SubstringsFilter) Encode() *ber.Packet {
+	seq := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Substrings")
+	if f.Initial != "" {
+		seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterSubstringsInitial, f.Initial, "Initial Substring"))
+	}
+	for _, v := range f.Any {
+		seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterSubstringsAny, v, "Any Substring"))
+	}
+	if f.Final != "" {
+		seq.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterSubstringsFinal, f.Final, "Final Substring"))
+	}
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterSubstrings, nil, FilterMap[FilterSubstrings])
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, f.Attribute, "Attribute"))
+	packet.AppendChild(seq)
+	return packet
+}
+
+func (f PresentFilter) Encode() *ber.Packet {
+	// present filters are primitive, not constructed like the other filters
+	packet := ber.Encode(ber.ClassContext, ber.TypePrimitive, FilterPresent, nil, FilterMap[FilterPresent])
+	packet.Data.WriteString(f.Attribute)
+	return packet
+}
+
+func (f ExtensibleFilter) Encode() *ber.Packet {
+	packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterExtensibleMatch, nil, FilterMap[FilterExtensibleMatch])
+	if f.MatchingRule != "" {
+		packet.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterExtensibleMatchMatchingRule, f.MatchingRule, "Matching Rule"))
+	}
+	if f.Attribute != "" {
+		packet.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterExtensibleMatchType, f.Attribute, "Type"))
+	}
+	packet.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterExtensibleMatchValue, f.Value, "Match Value"))
+	if f.DNAttributes {
+		packet.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, FilterExtensibleMatchDNAttributes, true, "DN Attributes"))
+	}
+	return packet
+}
+
+func (f AndFilter) String() string {
+	return "(&" + filterSetString(f.Filters) + ")"
+}
+
+func (f OrFilter) String() string {
+	return "(|" + filterSetString(f.Filters) + ")"
+}
+
+func filterSetString(filters []Filter) string {
+	var b strings.Builder
+	for _, f := range filters {
+		b.WriteString(f.String())
+	}
+	return b.String()
+}
+
+func (f NotFilter) String() string {
+	return "(!" + f.Filter.String() + ")"
+}
+
+func (f EqualityFilter) String() string {
+	return "(" + f.Attribute + "=" + EscapeFilter(f.Value) + ")"
+}
+
+func (f SubstringsFilter) String() string {
+	var b strings.Builder
+	b.WriteString("(" + f.Attribute + "=" + EscapeFilter(f.Initial) + "*")
+	for _, v := range f.Any {
+		// empty components match anything
+		if v != "" {
+			b.WriteString(EscapeFilter(v) + "*")
+		}
+	}
+	b.WriteString(EscapeFilter(f.Final) + ")")
+	return b.String()
+}
+
+func (f OrderingFilter) String() string {
+	if f.LessOrEqual {
+		return "(" + f.Attribute + "<=" + EscapeFilter(f.Value) + ")"
+	}
+	return "(" + f.Attribute + ">=" + EscapeFilter(f.Value) + ")"
+}
+
+func (f PresentFilter) String() string {
+	return "(" + f.Attribute + "=*)"
+}
+
+func (f ApproxFilter) String() string {
+	return "(" + f.Attribute + "~=" + EscapeFilter(f.Value) + ")"
+}
+
+func (f ExtensibleFilter) String() string {
+	s := "(" + f.Attribute
+	if f.DNAttributes {
+		s += ":dn"
+	}
+	if f.MatchingRule != "" {
+		s += ":" + f.MatchingRule
+	}
+	return s + ":=" + EscapeFilter(f.Value) + ")"
+}
+
+// DecodeFilter decodes the BER encoding of a filter.
+func DecodeFilter(packet *ber.Packet) (Filter, error) {
+	switch packet.Tag {
+	case FilterAnd, FilterOr:
+		filters := make([]Filter, 0, len(packet.Children))
+		for _, child := range packet.Children {
+			f, err := DecodeFilter(child)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, f)
+		}
+		if packet.Tag == FilterAnd {
+			return AndFilter{Filters: filters}, nil
+		}
+		return OrFilter{Filters: filters}, nil
+	case FilterNot:
+		if len(packet.Children) != 1 {
+			return nil, NewError(ErrorFilterDecompile, errors.New("ldap: not filter must have only one child"))
+		}
+		f, err := DecodeFilter(packet.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		return NotFilter{Filter: f}, nil
+	case FilterEqualityMatch, FilterGreaterOrEqual, FilterLessOrEqual, FilterApproxMatch:
+		if len(packet.Children) != 2 {
+			return nil, NewError(ErrorFilterDecompile, fmt.Errorf("ldap: %s filter must have two children", strings.ToLower(FilterMap[packet.Tag])))
+		}
+		attribute, value := string(packet.Children[0].Data.Bytes()), string(packet.Children[1].Data.Bytes())
+		switch packet.Tag {
+		case FilterGreaterOrEqual, FilterLessOrEqual:
+			return OrderingFilter{Attribute: attribute, Value: value, LessOrEqual: packet.Tag == FilterLessOrEqual}, nil
+		case FilterApproxMatch:
+			return ApproxFilter{Attribute: attribute, Value: value}, nil
+		}
+		return EqualityFilter{Attribute: attribute, Value: value}, nil
+	case FilterSubstrings:
+		if len(packet.Children) != 2 {
+			return nil, NewError(ErrorFilterDecompile, errors.New("ldap: substrings filter must have two children"))
+		}
+		f := SubstringsFilter{Attribute: string(packet.Children[0].Data.Bytes())}
+		for _, part := range packet.Children[1].Children {
+			switch part.Tag {
+			case FilterSubstringsInitial:
+				f.Initial = string(part.Data.Bytes())
+			case FilterSubstringsAny:
+				f.Any = append(f.Any, string(part.Data.Bytes()))
+			case FilterSubstringsFinal:
+				f.Final = string(part.Data.Bytes())
+			default:
+				return nil, NewError(ErrorFilterDecompile, fmt.Errorf("ldap: unknown substring type %d", part.Tag))
+			}
+		}
+		return f, nil
+	case FilterPresent:
+		return PresentFilter{Attribute: packet.Data.String()}, nil
+	case FilterExtensibleMatch:
+		var f ExtensibleFilter
+		for _, child := range packet.Children {
+			switch child.Tag {
+			case FilterExtensibleMatchMatchingRule:
+				f.MatchingRule = string(child.Data.Bytes())
+			case FilterExtensibleMatchType:
+				f.Attribute = string(child.Data.Bytes())
+			case FilterExtensibleMatchValue:
+				f.Value = string(child.Data.Bytes())
+			case FilterExtensibleMatchDNAttributes:
+				f.DNAttributes = len(child.Data.Bytes()) > 0 && child.Data.Bytes()[0] != 0
+			}
+		}
+		if f.MatchingRule == "" && f.Attribute == "" {
+			return nil, NewError(ErrorFilterDecompile, errors.New("ldap: extensible match without a type nor a matching rule"))
+		}
+		return f, nil
+	}
+	return nil, NewError(ErrorFilterDecompile, fmt.Errorf("ldap: unknown filter type %d", packet.Tag))
+}
+
+// WalkFilter calls fn for f and, depth first, for the filters it combines.
+// When fn returns false, the filters combined by f are skipped.
+func WalkFilter(f Filter, fn func(Filter) bool) {
+	if !fn(f) {
+		return
+	}
+	switch f := f.(type) {
+	case AndFilter:
+		for _, child := range f.Filters {
+			WalkFilter(child, fn)
+		}
+	case OrFilter:
+		for _, child := range f.Filters {
+			WalkFilter(child, fn)
+		}
+	case NotFilter:
+		WalkFilter(f.Filter, fn)
+	}
+}
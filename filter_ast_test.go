@@ -0,0 +1,153 @@
+package ldap
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter("(&(objectClass=person)(|(cn=a*b\\2a*c)(uidNumber>=500)(sn~=smith))(!(mail=*))(ou:dn:caseExactMatch:=People))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AndFilter{Filters: []Filter{
+		EqualityFilter{Attribute: "objectClass", Value: "person"},
+		OrFilter{Filters: []Filter{
+			SubstringsFilter{Attribute: "cn", Initial: "a", Any: []string{"b*"}, Final: "c"},
+			OrderingFilter{Attribute: "uidNumber", Value: "500"},
+			ApproxFilter{Attribute: "sn", Value: "smith"},
+		}},
+		NotFilter{Filter: PresentFilter{Attribute: "mail"}},
+		ExtensibleFilter{MatchingRule: "caseExactMatch", Attribute: "ou", Value: "People", DNAttributes: true},
+	}}
+	if !reflect.DeepEqual(f, want) {
+		t.Fatalf("expected %#v, got %#v", want, f)
+	}
+
+	// the AST and the BER encoding convert both ways
+	decoded, err := DecodeFilter(ber.DecodePacket(f.Encode().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("expected %#v, got %#v", want, decoded)
+	}
+	le := OrderingFilter{Attribute: "uidNumber", Value: "(5)", LessOrEqual: true}
+	if s := le.String(); s != "(uidNumber<=\\285\\29)" {
+		t.Errorf("unexpected string %s", s)
+	}
+}
+
+func TestDecodeFilterErrors(t *testing.T) {
+	not := ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterNot, nil, "Not")
+	equality := ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterEqualityMatch, nil, "Equality Match")
+	equality.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "cn", "Attribute"))
+	extensible := ber.Encode(ber.ClassContext, ber.TypeConstructed, FilterExtensibleMatch, nil, "Extensible Match")
+	extensible.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, FilterExtensibleMatchValue, "x", "Match Value"))
+	unknown := ber.Encode(ber.ClassContext, ber.TypeConstructed, 12, nil, "Unknown")
+	for _, p := range []*ber.Packet{not, equality, extensible, unknown} {
+		if f, err := DecodeFilter(p); err == nil {
+			t.Errorf("%s should not decode, got %v", p.Description, f)
+		}
+		if ok, code := ServerApplyFilter(p, &Entry{}); ok || code != LDAPResultOperationsError {
+			t.Errorf("%s should fail to apply, got %v (%s)", p.Description, ok, LDAPResultCodeMap[code])
+		}
+	}
+}
+
+func TestWalkFilter(t *testing.T) {
+	f, err := ParseFilter("(&(cn=a)(!(sn=b))(|(uid=c)(mail=d)))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attributes []string
+	WalkFilter(f, func(f Filter) bool {
+		switch f := f.(type) {
+		case EqualityFilter:
+			attributes = append(attributes, f.Attribute)
+		case OrFilter:
+			return false
+		}
+		return true
+	})
+	if strings.Join(attributes, ",") != "cn,sn" {
+		t.Errorf("unexpected walk %v", attributes)
+	}
+}
+
+// prefixVisitor renders filters in a prefix notation, refusing extensible
+// matches.
+type prefixVisitor struct {
+	strings.Builder
+}
+
+func (v *prefixVisitor) set(op string, filters []Filter) error {
+	v.WriteString(op + "(")
+	for i, f := range filters {
+		if i > 0 {
+			v.WriteString(", ")
+		}
+		if err := f.Accept(v); err != nil {
+			return err
+		}
+	}
+	v.WriteString(")")
+	return nil
+}
+
+func (v *prefixVisitor) VisitAnd(f AndFilter) error { return v.set("and", f.Filters) }
+func (v *prefixVisitor) VisitOr(f OrFilter) error   { return v.set("or", f.Filters) }
+func (v *prefixVisitor) VisitNot(f NotFilter) error { return v.set("not", []Filter{f.Filter}) }
+func (v *prefixVisitor) VisitEquality(f EqualityFilter) error {
+	v.WriteString("eq(" + f.Attribute + ", " + f.Value + ")")
+	return nil
+}
+func (v *prefixVisitor) VisitSubstrings(f SubstringsFilter) error {
+	v.WriteString("like(" + f.Attribute + ", " + f.Initial + "%" + strings.Join(f.Any, "%") + "%" + f.Final + ")")
+	return nil
+}
+func (v *prefixVisitor) VisitOrdering(f OrderingFilter) error {
+	op := "ge"
+	if f.LessOrEqual {
+		op = "le"
+	}
+	v.WriteString(op + "(" + f.Attribute + ", " + f.Value + ")")
+	return nil
+}
+func (v *prefixVisitor) VisitPresent(f PresentFilter) error {
+	v.WriteString("has(" + f.Attribute + ")")
+	return nil
+}
+func (v *prefixVisitor) VisitApprox(f ApproxFilter) error {
+	v.WriteString("sounds(" + f.Attribute + ", " + f.Value + ")")
+	return nil
+}
+func (v *prefixVisitor) VisitExtensible(f ExtensibleFilter) error {
+	return errors.New("extensible matches are not supported")
+}
+
+func TestFilterVisitor(t *testing.T) {
+	f, err := ParseFilter("(&(uid=bob)(|(cn=b*o*b)(uidNumber<=500))(!(mail=*))(sn~=smith))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &prefixVisitor{}
+	if err := f.Accept(v); err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "and(eq(uid, bob), or(like(cn, b%o%b), le(uidNumber, 500)), not(has(mail)), sounds(sn, smith))" {
+		t.Errorf("unexpected rendering %s", v.String())
+	}
+
+	f, err = ParseFilter("(|(uid=bob)(uid:dn:=bob))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Accept(&prefixVisitor{}); err == nil {
+		t.Errorf("the visitor error is not returned")
+	}
+}
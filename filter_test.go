@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
+
+	"go.linka.cloud/ldap/schema"
 )
 
 type compileTest struct {
@@ -24,7 +26,20 @@ var testFilters = []compileTest{
 	{filterStr: "(sn<=Møller)", filterType: FilterLessOrEqual},
 	{filterStr: "(sn=*)", filterType: FilterPresent},
 	{filterStr: "(sn~=Müller)", filterType: FilterApproxMatch},
-	// { filterStr: "()", filterType: FilterExtensibleMatch },
+	{filterStr: "(cn=a*b*c)", filterType: FilterSubstrings},
+	{filterStr: "(cn=*a*b*)", filterType: FilterSubstrings},
+	{filterStr: "(cn=a*b*c*d)", filterType: FilterSubstrings},
+	{filterStr: "(cn=\\2a\\28x\\29*\\5c)", filterType: FilterSubstrings},
+	{filterStr: "(cn=\\00\\ff)", filterType: FilterEqualityMatch},
+	{filterStr: "(sn>=M\\c3ller)", filterType: FilterGreaterOrEqual},
+	{filterStr: "(cn;lang-de=Müller)", filterType: FilterEqualityMatch},
+	{filterStr: "(&)", filterType: FilterAnd},
+	{filterStr: "(|)", filterType: FilterOr},
+	{filterStr: "(ou:dn:=people)", filterType: FilterExtensibleMatch},
+	{filterStr: "(uid:caseExactMatch:=Bob)", filterType: FilterExtensibleMatch},
+	{filterStr: "(:2.5.13.5:=x)", filterType: FilterExtensibleMatch},
+	{filterStr: "(o:dn:caseIgnoreMatch:=Acme)", filterType: FilterExtensibleMatch},
+	{filterStr: "(:dn:2.5.13.5:=Acme)", filterType: FilterExtensibleMatch},
 }
 
 func TestFilter(t *testing.T) {
@@ -53,6 +68,8 @@ type binTestFilter struct {
 
 var binTestFilters = []binTestFilter{
 	{bin: []byte{0x87, 0x06, 0x6d, 0x65, 0x6d, 0x62, 0x65, 0x72}, str: "(member=*)"},
+	{bin: []byte{0xa4, 0x0f, 0x04, 0x02, 0x63, 0x6e, 0x30, 0x09, 0x80, 0x01, 0x61, 0x81, 0x01, 0x62, 0x82, 0x01, 0x63}, str: "(cn=a*b*c)"},
+	{bin: []byte{0xa9, 0x16, 0x81, 0x08, 0x32, 0x2e, 0x35, 0x2e, 0x31, 0x33, 0x2e, 0x35, 0x82, 0x02, 0x63, 0x6e, 0x83, 0x03, 0x4a, 0x69, 0x6d, 0x84, 0x01, 0x01}, str: "(cn:dn:2.5.13.5:=Jim)"},
 }
 
 func TestFiltersDecode(t *testing.T) {
@@ -80,6 +97,46 @@ func TestFiltersEncode(t *testing.T) {
 	}
 }
 
+func TestFilterCompileErrors(t *testing.T) {
+	for _, filter := range []string{
+		"", "cn=a", "(cn=a", "(cn=a))", "(&(cn=a)", "(!(cn=a)(sn=b))", "(!)", "((cn=a))",
+		"(=a)", "(c n=a)", "(cn)", "(cn>=a*)", "(cn~=*)", "(cn=**)", "(cn=a(b)",
+		"(cn=a\\2)", "(cn=a\\zz)", "(cn=\\)", "(cn:=a*b)",
+	} {
+		if p, err := CompileFilter(filter); err == nil {
+			s, _ := DecompileFilter(p)
+			t.Errorf("%q should not compile, got %s", filter, s)
+		}
+	}
+}
+
+// FuzzFilter checks that decompiled filters compile back to the same filter.
+func FuzzFilter(f *testing.F) {
+	for _, i := range testFilters {
+		f.Add(i.filterStr)
+	}
+	f.Fuzz(func(t *testing.T, filter string) {
+		p, err := CompileFilter(filter)
+		if err != nil {
+			return
+		}
+		s, err := DecompileFilter(p)
+		if err != nil {
+			t.Fatalf("DecompileFilter(CompileFilter(%q)): %s", filter, err)
+		}
+		q, err := CompileFilter(s)
+		if err != nil {
+			t.Fatalf("CompileFilter(%q), decompiled from %q: %s", s, filter, err)
+		}
+		if !reflect.DeepEqual(p.Bytes(), q.Bytes()) {
+			t.Fatalf("%q compiles to %x, decompiled as %q which compiles to %x", filter, p.Bytes(), s, q.Bytes())
+		}
+		if s2, _ := DecompileFilter(q); s2 != s {
+			t.Fatalf("%q decompiles to %q then %q", filter, s, s2)
+		}
+	})
+}
+
 func BenchmarkFilterCompile(b *testing.B) {
 	b.StopTimer()
 	filters := make([]string, len(testFilters))
@@ -135,3 +192,150 @@ func TestGetFilterObjectClass(t *testing.T) {
 		t.Errorf("GetFilterObjectClass failed")
 	}
 }
+
+func TestServerApplyFilterSchema(t *testing.T) {
+	sc := schema.New()
+	if err := sc.LoadFile("schema/testdata/core.schema"); err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range []string{
+		"( 1.3.6.1.1.1.1.0 NAME 'uidNumber' EQUALITY integerMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.27 SINGLE-VALUE )",
+		"( 1.3.6.1.4.1.99999.1.2 NAME 'token' EQUALITY caseExactMatch SUBSTR caseExactSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )",
+		"( 2.5.4.49 NAME 'distinguishedName' EQUALITY distinguishedNameMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.12 )",
+		"( 2.5.4.31 NAME 'member' SUP distinguishedName )",
+		"( 1.3.6.1.4.1.99999.1.3 NAME 'employeeCode' SYNTAX 1.3.6.1.4.1.1466.115.121.1.36 )",
+	} {
+		at, err := schema.ParseAttributeType(def)
+		if err == nil {
+			err = sc.AddAttributeType(at)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entry := &Entry{DN: "uid=bob,dc=example,dc=com", Attributes: []*EntryAttribute{
+		{Name: "objectClass", Values: []string{"top", "person"}},
+		{Name: "cn", Values: []string{"Bob  Smith"}},
+		{Name: "sn", Values: []string{"Smith"}},
+		{Name: "uidNumber", Values: []string{"500"}},
+		{Name: "telephoneNumber", Values: []string{"+1 555-0100"}},
+		{Name: "token", Values: []string{"AbCdEf"}},
+		{Name: "member", Values: []string{"CN=Alice, DC=Example,DC=com"}},
+		{Name: "createTimestamp", Values: []string{"20240102030405Z"}},
+		{Name: "employeeCode", Values: []string{"12 34"}},
+		{Name: "nickname", Values: []string{"Bobby"}},
+	}}
+	for _, tt := range []struct {
+		filter        string
+		schema, plain bool
+	}{
+		{"(uidNumber=0500)", true, false},
+		{"(uidNumber=500)", true, true},
+		{"(uidNumber=abc)", false, false},
+		{"(telephoneNumber=+15550100)", true, false},
+		{"(telephoneNumber=*555 01*)", true, false},
+		{"(cn=bob smith)", true, false},
+		{"(commonName=BOB  SMITH)", true, false},
+		{"(2.5.4.3=Bob  Smith)", true, false},
+		{"(name=smith)", true, false},
+		{"(name=*)", true, false},
+		{"(token=abcdef)", false, true},
+		{"(token=AbCdEf)", true, true},
+		{"(token=Ab*Ef)", true, true},
+		{"(token=ab*)", false, true},
+		{"(member=cn=alice,dc=example,dc=com)", true, false},
+		{"(createTimestamp=20240102040405+0100)", true, false},
+		{"(employeeCode=1234)", true, false},
+		{"(nickname=bobby)", true, true},
+		{"(objectClass=PERSON)", true, true},
+		{"(cn=B*b*S*h)", true, true},
+		{"(cn=B*S*b)", false, false},
+		{"(&(sn=smith)(!(uidNumber=501)))", true, true},
+		{"(uidNumber>=499)", true, true},
+		{"(uidNumber>=1000)", false, true},
+		{"(uidNumber<=60)", false, true},
+		{"(uidNumber<=0500)", true, false},
+		{"(uidNumber>=abc)", false, false},
+		{"(createTimestamp>=20240102040405+0100)", true, false},
+		{"(createTimestamp<=20240102030404Z)", false, false},
+		{"(sn>=SMITH)", true, true},
+		{"(sn<=Smiss)", false, false},
+		{"(sn~=smyth)", true, true},
+		{"(cn~=bob smithe)", true, true},
+		{"(cn~=smith bob)", false, false},
+		{"(cn~=rob)", false, false},
+		{"(token~=abcdef)", true, true},
+		{"(uidNumber~=0500)", true, false},
+	} {
+		f, err := CompileFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.filter, err.Error())
+		}
+		if ok, code := ServerApplyFilterSchema(f, entry, sc); code != LDAPResultSuccess || ok != tt.schema {
+			t.Errorf("%s with a schema: expected %v, got %v (%s)", tt.filter, tt.schema, ok, LDAPResultCodeMap[code])
+		}
+		if ok, code := ServerApplyFilter(f, entry); code != LDAPResultSuccess || ok != tt.plain {
+			t.Errorf("%s without a schema: expected %v, got %v (%s)", tt.filter, tt.plain, ok, LDAPResultCodeMap[code])
+		}
+	}
+}
+
+func TestExtensibleMatch(t *testing.T) {
+	for _, filter := range []string{"(:=x)", "(:dn:=x)", "(cn::=x)", "(cn:dn::=x)", "(cn:dn:2.5.13.5:extra:=x)"} {
+		if _, err := CompileFilter(filter); err == nil {
+			t.Errorf("%s should not compile", filter)
+		}
+	}
+
+	RegisterMatchingRule("1.3.6.1.4.1.99999.3.1", func(value, assertion string) bool {
+		return len(value) == len(assertion)
+	})
+	sc := schema.New()
+	if err := sc.LoadFile("schema/testdata/core.schema"); err != nil {
+		t.Fatal(err)
+	}
+	entry := &Entry{DN: "uid=Bob+cn=Bob Smith,ou=People,dc=example,dc=com", Attributes: []*EntryAttribute{
+		{Name: "uid", Values: []string{"Bob"}},
+		{Name: "sn", Values: []string{"Smith"}},
+		{Name: "userAccountControl", Values: []string{"66050"}},
+		{Name: "groupType", Values: []string{"-2147483646"}},
+		{Name: "description", Values: []string{"quota 20"}},
+	}}
+	for _, tt := range []struct {
+		filter string
+		match  bool
+	}{
+		{"(uid:=bob)", true},
+		{"(uid:caseExactMatch:=bob)", false},
+		{"(uid:caseExactMatch:=Bob)", true},
+		{"(:2.5.13.5:=Smith)", true},
+		{"(:caseExactMatch:=smith)", false},
+		{"(ou:=people)", false},
+		{"(ou:dn:=people)", true},
+		{"(name:dn:=bob smith)", true},
+		{"(:dn:caseIgnoreMatch:=EXAMPLE)", true},
+		{"(:caseIgnoreMatch:=EXAMPLE)", false},
+		{"(cn:dn:caseExactMatch:=bob smith)", false},
+		{"(sn:caseIgnoreSubstringsMatch:=s\\2ath)", true},
+		{"(sn:caseIgnoreSubstringsMatch:=smith)", false},
+		{"(sn:caseIgnoreOrderingMatch:=t)", true},
+		{"(sn:caseIgnoreOrderingMatch:=smith)", false},
+		{"(sn:unknownMatch:=Smith)", false},
+		{"(userAccountControl:1.2.840.113556.1.4.803:=2)", true},
+		{"(userAccountControl:1.2.840.113556.1.4.803:=3)", false},
+		{"(userAccountControl:1.2.840.113556.1.4.804:=3)", true},
+		{"(groupType:1.2.840.113556.1.4.803:=2147483648)", true},
+		{"(description:1.2.840.113556.1.4.803:=2)", false},
+		{"(sn:1.3.6.1.4.1.99999.3.1:=abcde)", true},
+		{"(!(sn:1.3.6.1.4.1.99999.3.1:=abcd))", true},
+	} {
+		f, err := CompileFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.filter, err.Error())
+		}
+		if ok, code := ServerApplyFilterSchema(f, entry, sc); code != LDAPResultSuccess || ok != tt.match {
+			t.Errorf("%s: expected %v, got %v (%s)", tt.filter, tt.match, ok, LDAPResultCodeMap[code])
+		}
+	}
+}
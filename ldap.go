@@ -6,6 +6,7 @@ package ldap
 
 import (
 	"fmt"
+	"strings"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
 	"github.com/go-ldap/ldap/v3"
@@ -33,6 +34,7 @@ const (
 	ApplicationSearchResultReference = 19
 	ApplicationExtendedRequest       = 23
 	ApplicationExtendedResponse      = 24
+	ApplicationIntermediateResponse  = 25
 )
 
 var ApplicationMap = map[ber.Tag]string{
@@ -56,8 +58,17 @@ var ApplicationMap = map[ber.Tag]string{
 	ApplicationSearchResultReference: "Search Result Reference",
 	ApplicationExtendedRequest:       "Extended Request",
 	ApplicationExtendedResponse:      "Extended Response",
+	ApplicationIntermediateResponse:  "Intermediate Response",
 }
 
+// Extended operation names
+const (
+	ExtendedOperationStartTLS       = "1.3.6.1.4.1.1466.20037"
+	ExtendedOperationWhoAmI         = "1.3.6.1.4.1.4203.1.11.3"
+	ExtendedOperationPasswordModify = "1.3.6.1.4.1.4203.1.11.1"
+	ExtendedOperationCancel         = "1.3.6.1.1.8"
+)
+
 // LDAP Result Codes
 const (
 	LDAPResultSuccess                      = 0
@@ -91,6 +102,8 @@ const (
 	LDAPResultUnavailable                  = 52
 	LDAPResultUnwillingToPerform           = 53
 	LDAPResultLoopDetect                   = 54
+	LDAPResultSortControlMissing           = 60
+	LDAPResultOffsetRangeError             = 61
 	LDAPResultNamingViolation              = 64
 	LDAPResultObjectClassViolation         = 65
 	LDAPResultNotAllowedOnNonLeaf          = 66
@@ -99,6 +112,10 @@ const (
 	LDAPResultObjectClassModsProhibited    = 69
 	LDAPResultAffectsMultipleDSAs          = 71
 	LDAPResultOther                        = 80
+	LDAPResultCanceled                     = 118
+	LDAPResultNoSuchOperation              = 119
+	LDAPResultTooLate                      = 120
+	LDAPResultCannotCancel                 = 121
 
 	ErrorNetwork         = 200
 	ErrorFilterCompile   = 201
@@ -138,6 +155,8 @@ var LDAPResultCodeMap = map[LDAPResultCode]string{
 	LDAPResultUnavailable:                  "Unavailable",
 	LDAPResultUnwillingToPerform:           "Unwilling To Perform",
 	LDAPResultLoopDetect:                   "Loop Detect",
+	LDAPResultSortControlMissing:           "Sort Control Missing",
+	LDAPResultOffsetRangeError:             "Offset Range Error",
 	LDAPResultNamingViolation:              "Naming Violation",
 	LDAPResultObjectClassViolation:         "Object Class Violation",
 	LDAPResultNotAllowedOnNonLeaf:          "Not Allowed On Non Leaf",
@@ -146,6 +165,10 @@ var LDAPResultCodeMap = map[LDAPResultCode]string{
 	LDAPResultObjectClassModsProhibited:    "Object Class Mods Prohibited",
 	LDAPResultAffectsMultipleDSAs:          "Affects Multiple DSAs",
 	LDAPResultOther:                        "Other",
+	LDAPResultCanceled:                     "Canceled",
+	LDAPResultNoSuchOperation:              "No Such Operation",
+	LDAPResultTooLate:                      "Too Late",
+	LDAPResultCannotCancel:                 "Cannot Cancel",
 }
 
 // Other LDAP constants
@@ -170,9 +193,32 @@ type ModifyDNRequest struct {
 	NewSuperior  string
 }
 
+// ExtendedRequest is an extended operation request (RFC 4511 4.12). Value is
+// the raw requestValue, nil when the request has none.
 type ExtendedRequest struct {
-	Name  string
-	Value string
+	Name     string
+	Value    []byte
+	Controls []Control
+}
+
+// PasswordModifyRequest is a Password Modify request (RFC 3062). UserIdentity
+// is the request's userIdentity, or the bound DN when the client sent none.
+type PasswordModifyRequest struct {
+	UserIdentity string
+	OldPassword  string
+	NewPassword  string
+}
+
+// ExtendedResponse is the response to an extended operation. Name and Value
+// are the optional responseName and responseValue; a nil Value is omitted.
+// Diagnostic is sent as the errorMessage, which defaults to the description
+// of ResultCode.
+type ExtendedResponse struct {
+	ResultCode LDAPResultCode
+	Diagnostic string
+	Name       string
+	Value      []byte
+	Controls   []Control
 }
 
 func DebugBinaryFile(fileName string) error {
@@ -192,6 +238,17 @@ func NewError(resultCode LDAPResultCode, err error) error {
 	return &Error{ResultCode: resultCode, Err: err}
 }
 
+// ReferralError is returned by Adder, Modifier, Deleter, ModifyDNr and
+// Comparer handlers to refer the client to other servers: the operation
+// ends with a referral to URLs.
+type ReferralError struct {
+	URLs []string
+}
+
+func (e *ReferralError) Error() string {
+	return "referral to " + strings.Join(e.URLs, ", ")
+}
+
 func getLDAPResultCode(packet *ber.Packet) (code LDAPResultCode, description string) {
 	if len(packet.Children) >= 2 {
 		response := packet.Children[1]
@@ -0,0 +1,431 @@
+package ldap
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+
+	"go.linka.cloud/ldap/schema"
+)
+
+// matchingRule implements an equality or substrings matching rule: values
+// match when their normalized forms do. normalize reports false for values
+// the rule cannot compare, which never match. Approximate matches of textual
+// rules compare how the words of the values sound.
+type matchingRule struct {
+	normalize func(v string) (string, bool)
+	textual   bool
+}
+
+// legacyRule compares values ignoring case, as filters are evaluated without
+// a schema.
+var legacyRule = matchingRule{normalize: func(v string) (string, bool) {
+	return strings.ToLower(v), true
+}, textual: true}
+
+var (
+	caseIgnoreRule = matchingRule{normalize: func(v string) (string, bool) {
+		return normalizeSpace(strings.ToLower(v)), true
+	}, textual: true}
+	caseExactRule = matchingRule{normalize: func(v string) (string, bool) {
+		return normalizeSpace(v), true
+	}, textual: true}
+	numericStringRule = matchingRule{normalize: func(v string) (string, bool) {
+		v = strings.ReplaceAll(v, " ", "")
+		return v, strings.Trim(v, "0123456789") == ""
+	}}
+	telephoneNumberRule = matchingRule{normalize: func(v string) (string, bool) {
+		return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(v)), true
+	}}
+	integerRule = matchingRule{normalize: func(v string) (string, bool) {
+		i, ok := new(big.Int).SetString(strings.TrimSpace(v), 10)
+		if !ok {
+			return "", false
+		}
+		return i.String(), true
+	}}
+	distinguishedNameRule = matchingRule{normalize: normalizeDN}
+	generalizedTimeRule   = matchingRule{normalize: func(v string) (string, bool) {
+		t, err := ber.ParseGeneralizedTime([]byte(v))
+		if err != nil {
+			return "", false
+		}
+		return t.UTC().Format(time.RFC3339Nano), true
+	}}
+	octetStringRule = matchingRule{normalize: func(v string) (string, bool) {
+		return v, true
+	}}
+	booleanRule = matchingRule{normalize: func(v string) (string, bool) {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		return v, v == "TRUE" || v == "FALSE"
+	}}
+)
+
+// matchingRules are the equality and substrings matching rules filters are
+// evaluated with, by lower-cased name and OID.
+var matchingRules = func() map[string]matchingRule {
+	rules := map[string]matchingRule{}
+	for _, r := range []struct {
+		names []string
+		rule  matchingRule
+	}{
+		{[]string{
+			"caseIgnoreMatch", "2.5.13.2", "caseIgnoreSubstringsMatch", "2.5.13.4",
+			"caseIgnoreIA5Match", "1.3.6.1.4.1.1466.109.114.2", "caseIgnoreIA5SubstringsMatch", "1.3.6.1.4.1.1466.109.114.3",
+			"caseIgnoreListMatch", "2.5.13.11", "caseIgnoreListSubstringsMatch", "2.5.13.12",
+			// descriptors are case insensitive
+			"objectIdentifierMatch", "2.5.13.0",
+		}, caseIgnoreRule},
+		{[]string{
+			"caseExactMatch", "2.5.13.5", "caseExactSubstringsMatch", "2.5.13.7",
+			"caseExactIA5Match", "1.3.6.1.4.1.1466.109.114.1",
+		}, caseExactRule},
+		{[]string{"numericStringMatch", "2.5.13.8", "numericStringSubstringsMatch", "2.5.13.10"}, numericStringRule},
+		{[]string{"telephoneNumberMatch", "2.5.13.20", "telephoneNumberSubstringsMatch", "2.5.13.21"}, telephoneNumberRule},
+		{[]string{"integerMatch", "2.5.13.14"}, integerRule},
+		{[]string{"distinguishedNameMatch", "2.5.13.1", "uniqueMemberMatch", "2.5.13.23"}, distinguishedNameRule},
+		{[]string{"generalizedTimeMatch", "2.5.13.27"}, generalizedTimeRule},
+		{[]string{"octetStringMatch", "2.5.13.17"}, octetStringRule},
+		{[]string{"booleanMatch", "2.5.13.13"}, booleanRule},
+	} {
+		for _, name := range r.names {
+			rules[strings.ToLower(name)] = r.rule
+		}
+	}
+	return rules
+}()
+
+// syntaxRules are the rules used for attribute types of a syntax that name no
+// matching rule, by syntax OID.
+var syntaxRules = map[string]matchingRule{
+	"1.3.6.1.4.1.1466.115.121.1.7":  booleanRule,
+	"1.3.6.1.4.1.1466.115.121.1.12": distinguishedNameRule,
+	"1.3.6.1.4.1.1466.115.121.1.24": generalizedTimeRule,
+	"1.3.6.1.4.1.1466.115.121.1.27": integerRule,
+	"1.3.6.1.4.1.1466.115.121.1.36": numericStringRule,
+	"1.3.6.1.4.1.1466.115.121.1.40": octetStringRule,
+	"1.3.6.1.4.1.1466.115.121.1.50": telephoneNumberRule,
+}
+
+// syntaxOrderingRules are the ordering rules used for attribute types of a
+// syntax that name no ordering rule, by syntax OID.
+var syntaxOrderingRules = map[string]orderingRule{
+	"1.3.6.1.4.1.1466.115.121.1.24": orderingRules["generalizedtimeorderingmatch"],
+	"1.3.6.1.4.1.1466.115.121.1.27": orderingRules["integerorderingmatch"],
+	"1.3.6.1.4.1.1466.115.121.1.36": orderingRules["numericstringorderingmatch"],
+	"1.3.6.1.4.1.1466.115.121.1.40": orderingRules["octetstringorderingmatch"],
+}
+
+// attributeRule returns the rule comparing the values of attribute: the one
+// sc gives its type through rule, or the default rule of its syntax. Without
+// a schema, for unknown attribute types and rules, values are compared
+// ignoring case.
+func attributeRule(sc *schema.Schema, attribute string, rule func(*schema.AttributeType) *schema.MatchingRule) matchingRule {
+	if sc == nil {
+		return legacyRule
+	}
+	at := sc.AttributeType(attribute)
+	if at == nil {
+		return legacyRule
+	}
+	if mr := rule(at); mr != nil {
+		if r, ok := matchingRules[strings.ToLower(mr.OID)]; ok {
+			return r
+		}
+		return legacyRule
+	}
+	if r, ok := syntaxRules[sc.SyntaxOID(at)]; ok {
+		return r
+	}
+	return legacyRule
+}
+
+// attributeOrderingRule returns the rule ordering the values of attribute: the
+// ORDERING rule sc gives its type, or the default rule of its syntax. Values
+// are otherwise ordered lexically, ignoring case.
+func attributeOrderingRule(sc *schema.Schema, attribute string) orderingRule {
+	if sc == nil {
+		return defaultOrderingRule
+	}
+	at := sc.AttributeType(attribute)
+	if at == nil {
+		return defaultOrderingRule
+	}
+	if mr := sc.OrderingRule(at); mr != nil {
+		if r, ok := orderingRules[strings.ToLower(mr.OID)]; ok {
+			return r
+		}
+		return defaultOrderingRule
+	}
+	if r, ok := syntaxOrderingRules[sc.SyntaxOID(at)]; ok {
+		return r
+	}
+	return defaultOrderingRule
+}
+
+// matchingAttributes returns the attributes of entry that a filter on
+// attribute applies to: with a schema, the attributes of its type, named by
+// any of its names or OID, and of its subtypes.
+func matchingAttributes(sc *schema.Schema, entry *Entry, attribute string) []*EntryAttribute {
+	var at *schema.AttributeType
+	if sc != nil {
+		at = sc.AttributeType(attribute)
+	}
+	var attrs []*EntryAttribute
+	for _, a := range entry.Attributes {
+		if describes(sc, at, a.Name, attribute) {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs
+}
+
+// describes reports whether a filter on attribute, of type at when sc defines
+// it, applies to the attribute named name.
+func describes(sc *schema.Schema, at *schema.AttributeType, name, attribute string) bool {
+	if at != nil {
+		if t := sc.AttributeType(name); t != nil {
+			return sc.IsSubtype(t, at)
+		}
+	}
+	return strings.EqualFold(name, attribute)
+}
+
+// matchSubstrings reports whether v holds initial, every middle part in turn,
+// and final, without overlap.
+func matchSubstrings(v, initial string, middle []string, final string) bool {
+	if !strings.HasPrefix(v, initial) {
+		return false
+	}
+	v = v[len(initial):]
+	for _, a := range middle {
+		i := strings.Index(v, a)
+		if i < 0 {
+			return false
+		}
+		v = v[i+len(a):]
+	}
+	return strings.HasSuffix(v, final)
+}
+
+// approxMatch reports whether v approximately matches value, both normalized
+// by rule: the words of value sound like words of v, in the same order. Values
+// of rules that aren't textual approximately match when they are equal.
+func approxMatch(rule matchingRule, v, value string) bool {
+	if v == value || !rule.textual {
+		return v == value
+	}
+	words := strings.Fields(value)
+	if len(words) == 0 {
+		return false
+	}
+	for _, w := range strings.Fields(v) {
+		if soundex(w) == soundex(words[0]) {
+			words = words[1:]
+			if len(words) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// soundexCodes are the Soundex digits of letters, 0 for the ones that are
+// not coded.
+var soundexCodes = [26]byte{
+	'0', '1', '2', '3', '0', '1', '2', '0', '0', '2', '2', '4', '5',
+	'5', '0', '1', '2', '6', '2', '3', '0', '1', '0', '2', '0', '2',
+}
+
+// soundex returns the Soundex code of word, a letter followed by three
+// digits. Words that don't start with a letter are their own code.
+func soundex(word string) string {
+	word = strings.ToLower(word)
+	if word == "" || word[0] < 'a' || word[0] > 'z' {
+		return word
+	}
+	code := []byte{word[0] - 'a' + 'A'}
+	last := soundexCodes[word[0]-'a']
+	for i := 1; i < len(word) && len(code) < 4; i++ {
+		c := word[i]
+		if c < 'a' || c > 'z' {
+			continue
+		}
+		d := soundexCodes[c-'a']
+		switch {
+		case c == 'h' || c == 'w':
+			// h and w don't separate letters with the same code
+			continue
+		case d != '0' && d != last:
+			code = append(code, d)
+		}
+		last = d
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// Matching rules of Active Directory, evaluated by extensible match filters
+// such as (userAccountControl:1.2.840.113556.1.4.803:=2).
+const (
+	MatchingRuleBitAnd = "1.2.840.113556.1.4.803"
+	MatchingRuleBitOr  = "1.2.840.113556.1.4.804"
+)
+
+// MatchingRuleFunc reports whether an attribute value matches the assertion
+// value of an extensible match filter.
+type MatchingRuleFunc func(value, assertion string) bool
+
+var (
+	customRulesMu sync.RWMutex
+	customRules   = map[string]MatchingRuleFunc{
+		MatchingRuleBitAnd: bitRule(func(v, a uint64) bool { return v&a == a }),
+		MatchingRuleBitOr:  bitRule(func(v, a uint64) bool { return v&a != 0 }),
+	}
+)
+
+// RegisterMatchingRule makes extensible match filters naming rule, by name
+// or OID, evaluate with match. It replaces the server's own implementation of
+// the rule, if any.
+func RegisterMatchingRule(rule string, match MatchingRuleFunc) {
+	customRulesMu.Lock()
+	defer customRulesMu.Unlock()
+	customRules[strings.ToLower(rule)] = match
+}
+
+// bitRule compares values as 64 bits integers, signed or not.
+func bitRule(match func(v, a uint64) bool) MatchingRuleFunc {
+	parse := func(s string) (uint64, bool) {
+		s = strings.TrimSpace(s)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return uint64(i), true
+		}
+		u, err := strconv.ParseUint(s, 10, 64)
+		return u, err == nil
+	}
+	return func(value, assertion string) bool {
+		v, ok := parse(value)
+		if !ok {
+			return false
+		}
+		a, ok := parse(assertion)
+		return ok && match(v, a)
+	}
+}
+
+// substringsRules are the names and OIDs of the substrings matching rules,
+// whose extensible match assertions are substring patterns.
+var substringsRules = map[string]bool{
+	"caseignoresubstringsmatch": true, "2.5.13.4": true,
+	"caseexactsubstringsmatch": true, "2.5.13.7": true,
+	"numericstringsubstringsmatch": true, "2.5.13.10": true,
+	"caseignorelistsubstringsmatch": true, "2.5.13.12": true,
+	"telephonenumbersubstringsmatch": true, "2.5.13.21": true,
+	"caseignoreia5substringsmatch": true, "1.3.6.1.4.1.1466.109.114.3": true,
+}
+
+// extensibleRule returns the function evaluating extensible matches with
+// the matching rule named rule: a registered one, or one of the server's
+// equality, ordering (the value is less than the assertion) and substrings
+// rules.
+func extensibleRule(rule string) (MatchingRuleFunc, bool) {
+	rule = strings.ToLower(rule)
+	customRulesMu.RLock()
+	match, ok := customRules[rule]
+	customRulesMu.RUnlock()
+	if ok {
+		return match, true
+	}
+	if r, ok := orderingRules[rule]; ok {
+		return func(value, assertion string) bool {
+			if r.valid != nil && (!r.valid(value) || !r.valid(assertion)) {
+				return false
+			}
+			return r.compare(value, assertion) < 0
+		}, true
+	}
+	r, ok := matchingRules[rule]
+	if !ok {
+		return nil, false
+	}
+	if substringsRules[rule] {
+		return func(value, assertion string) bool {
+			parts := strings.Split(assertion, "*")
+			for i, part := range parts {
+				part, ok := r.normalize(part)
+				if !ok {
+					return false
+				}
+				parts[i] = part
+			}
+			v, ok := r.normalize(value)
+			return ok && len(parts) > 1 && matchSubstrings(v, parts[0], parts[1:len(parts)-1], parts[len(parts)-1])
+		}, true
+	}
+	return func(value, assertion string) bool {
+		v, ok := r.normalize(value)
+		a, aok := r.normalize(assertion)
+		return ok && aok && v == a
+	}, true
+}
+
+// matchExtensible evaluates m against entry (RFC 4511 4.5.1.7.7): the
+// values of its attribute, or of all the entry's attributes when it names
+// none, are compared with its matching rule, or the attribute's equality
+// rule. With DNAttributes, the attribute values of the entry's DN are
+// compared too. Unknown matching rules never match.
+func matchExtensible(m ExtensibleFilter, entry *Entry, sc *schema.Schema) bool {
+	var match MatchingRuleFunc
+	if m.MatchingRule != "" {
+		var ok bool
+		if match, ok = extensibleRule(m.MatchingRule); !ok {
+			return false
+		}
+	} else {
+		rule := attributeRule(sc, m.Attribute, sc.EqualityRule)
+		match = func(value, assertion string) bool {
+			v, ok := rule.normalize(value)
+			a, aok := rule.normalize(assertion)
+			return ok && aok && v == a
+		}
+	}
+	attrs := entry.Attributes
+	if m.Attribute != "" {
+		attrs = matchingAttributes(sc, entry, m.Attribute)
+	}
+	for _, a := range attrs {
+		for _, v := range a.Values {
+			if match(v, m.Value) {
+				return true
+			}
+		}
+	}
+	if !m.DNAttributes {
+		return false
+	}
+	dn, err := ParseDN(entry.DN)
+	if err != nil {
+		return false
+	}
+	var at *schema.AttributeType
+	if sc != nil {
+		at = sc.AttributeType(m.Attribute)
+	}
+	for _, rdn := range dn {
+		for _, ava := range rdn {
+			if m.Attribute != "" && !describes(sc, at, ava.Type, m.Attribute) {
+				continue
+			}
+			if match(ava.Value, m.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
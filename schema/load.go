@@ -0,0 +1,318 @@
+package schema
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadFile loads the definitions of an OpenLDAP .schema file, or of an LDIF
+// file when its extension is .ldif.
+func (s *Schema) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".ldif") {
+		err = s.LoadLDIF(f)
+	} else {
+		err = s.LoadSchema(f)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadSchema loads definitions in the OpenLDAP .schema format: attributetype,
+// objectclass, ldapsyntax and objectidentifier directives, continued on lines
+// starting with white space.
+func (s *Schema) LoadSchema(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	var stmt strings.Builder
+	start, line := 0, 0
+	flush := func() error {
+		if stmt.Len() == 0 {
+			return nil
+		}
+		defer stmt.Reset()
+		if err := s.loadDirective(stmt.String()); err != nil {
+			return fmt.Errorf("line %d: %w", start, err)
+		}
+		return nil
+	}
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		if strings.HasPrefix(text, "#") || strings.TrimSpace(text) == "" {
+			continue
+		}
+		if text[0] == ' ' || text[0] == '\t' {
+			if stmt.Len() == 0 {
+				return fmt.Errorf("line %d: continuation line without a directive", line)
+			}
+			stmt.WriteByte(' ')
+			stmt.WriteString(strings.TrimSpace(text))
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		start = line
+		stmt.WriteString(text)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (s *Schema) loadDirective(stmt string) error {
+	// the directive may be followed by a tab, as in inetorgperson.schema
+	directive, def := strings.TrimSpace(stmt), ""
+	if i := strings.IndexAny(directive, " \t"); i >= 0 {
+		directive, def = directive[:i], directive[i+1:]
+	}
+	switch strings.ToLower(directive) {
+	case "attributetype", "attributetypes":
+		return s.addAttributeTypeDefinition(def)
+	case "objectclass", "objectclasses":
+		return s.addObjectClassDefinition(def)
+	case "ldapsyntax", "ldapsyntaxes":
+		return s.addSyntaxDefinition(def)
+	case "objectidentifier":
+		return s.addMacro(def)
+	default:
+		return fmt.Errorf("unknown directive %s", directive)
+	}
+}
+
+// LoadLDIF loads the definitions held by the entries of an LDIF file, either a
+// subschema entry (attributeTypes, objectClasses, matchingRules, ldapSyntaxes)
+// or OpenLDAP cn=config schema entries (olcAttributeTypes, olcObjectClasses,
+// olcLdapSyntaxes, olcObjectIdentifier). Other attributes are ignored.
+func (s *Schema) LoadLDIF(r io.Reader) error {
+	values, err := readLDIF(r)
+	if err != nil {
+		return err
+	}
+	// definitions only refer to the kinds added before them
+	for _, kind := range []struct {
+		names []string
+		add   func(string) error
+	}{
+		{[]string{"olcobjectidentifier"}, s.addMacro},
+		{[]string{"ldapsyntaxes", "olcldapsyntaxes"}, s.addSyntaxDefinition},
+		{[]string{"matchingrules"}, s.addMatchingRuleDefinition},
+		{[]string{"attributetypes", "olcattributetypes"}, s.addAttributeTypeDefinition},
+		{[]string{"objectclasses", "olcobjectclasses"}, s.addObjectClassDefinition},
+	} {
+		for _, v := range values {
+			for _, name := range kind.names {
+				if v.name != name {
+					continue
+				}
+				if err := kind.add(trimOrdering(v.value)); err != nil {
+					return fmt.Errorf("line %d: %w", v.line, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type ldifValue struct {
+	line  int
+	name  string
+	value string
+}
+
+// readLDIF returns the attribute values of every entry of an LDIF file, with
+// lower-cased attribute names stripped of their options.
+func readLDIF(r io.Reader) ([]ldifValue, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	var values []ldifValue
+	var current *ldifValue
+	var folded strings.Builder
+	end := func() error {
+		if current == nil {
+			return nil
+		}
+		v, err := parseLDIFLine(folded.String())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", current.line, err)
+		}
+		v.line = current.line
+		values = append(values, v)
+		current = nil
+		folded.Reset()
+		return nil
+	}
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		switch {
+		case strings.HasPrefix(text, " "):
+			// a folded line continues the previous one
+			if current == nil {
+				return nil, fmt.Errorf("line %d: continuation line without an attribute", line)
+			}
+			folded.WriteString(text[1:])
+		case strings.HasPrefix(text, "#"):
+			if current != nil {
+				if err := end(); err != nil {
+					return nil, err
+				}
+			}
+		case strings.TrimSpace(text) == "":
+			if err := end(); err != nil {
+				return nil, err
+			}
+		default:
+			if err := end(); err != nil {
+				return nil, err
+			}
+			current = &ldifValue{line: line}
+			folded.WriteString(text)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func parseLDIFLine(line string) (ldifValue, error) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return ldifValue{}, errors.New("missing ':'")
+	}
+	name, _, _ = strings.Cut(name, ";")
+	v := ldifValue{name: strings.ToLower(strings.TrimSpace(name))}
+	switch {
+	case strings.HasPrefix(value, ":"):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return ldifValue{}, fmt.Errorf("%s: %w", name, err)
+		}
+		v.value = string(b)
+	case strings.HasPrefix(value, "<"):
+		return ldifValue{}, fmt.Errorf("%s: URL values are not supported", name)
+	default:
+		v.value = strings.TrimLeft(value, " ")
+	}
+	return v, nil
+}
+
+// trimOrdering removes the {n} prefix OpenLDAP puts on ordered values.
+func trimOrdering(value string) string {
+	if !strings.HasPrefix(value, "{") {
+		return value
+	}
+	end := strings.IndexByte(value, '}')
+	if end < 0 {
+		return value
+	}
+	for _, c := range value[1:end] {
+		if c < '0' || c > '9' {
+			return value
+		}
+	}
+	return strings.TrimSpace(value[end+1:])
+}
+
+func (s *Schema) addMacro(def string) error {
+	fields := strings.Fields(def)
+	if len(fields) != 2 {
+		return fmt.Errorf("malformed objectidentifier %q", def)
+	}
+	oid, err := s.expandOID(fields[1])
+	if err != nil {
+		return err
+	}
+	s.macros[strings.ToLower(fields[0])] = oid
+	return nil
+}
+
+// expandOID replaces an OID macro, alone or followed by ":suffix", with the
+// OID it stands for.
+func (s *Schema) expandOID(oid string) (string, error) {
+	if oid == "" || (oid[0] >= '0' && oid[0] <= '9') {
+		return oid, nil
+	}
+	name, suffix, hasSuffix := strings.Cut(oid, ":")
+	base, ok := s.macros[strings.ToLower(name)]
+	switch {
+	case !ok && hasSuffix:
+		return "", fmt.Errorf("unknown OID macro %s", name)
+	case !ok:
+		// OpenLDAP tolerates non-numeric OIDs such as "foo-oid"
+		return oid, nil
+	case hasSuffix:
+		return base + "." + suffix, nil
+	default:
+		return base, nil
+	}
+}
+
+func (s *Schema) addSyntaxDefinition(def string) error {
+	syn, err := ParseSyntax(def)
+	if err != nil {
+		return err
+	}
+	if syn.OID, err = s.expandOID(syn.OID); err != nil {
+		return err
+	}
+	return s.AddSyntax(syn)
+}
+
+func (s *Schema) addMatchingRuleDefinition(def string) error {
+	mr, err := ParseMatchingRule(def)
+	if err != nil {
+		return err
+	}
+	if mr.OID, err = s.expandOID(mr.OID); err != nil {
+		return err
+	}
+	if mr.Syntax, err = s.expandOID(mr.Syntax); err != nil {
+		return err
+	}
+	return s.AddMatchingRule(mr)
+}
+
+func (s *Schema) addAttributeTypeDefinition(def string) error {
+	at, err := ParseAttributeType(def)
+	if err != nil {
+		return err
+	}
+	if at.OID, err = s.expandOID(at.OID); err != nil {
+		return err
+	}
+	if at.Syntax, err = s.expandOID(at.Syntax); err != nil {
+		return err
+	}
+	return s.AddAttributeType(at)
+}
+
+func (s *Schema) addObjectClassDefinition(def string) error {
+	oc, err := ParseObjectClass(def)
+	if err != nil {
+		return err
+	}
+	if oc.OID, err = s.expandOID(oc.OID); err != nil {
+		return err
+	}
+	return s.AddObjectClass(oc)
+}
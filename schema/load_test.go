@@ -0,0 +1,106 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadFile(t *testing.T) {
+	for _, path := range []string{"testdata/core.schema", "testdata/core.ldif"} {
+		t.Run(path, func(t *testing.T) {
+			s := New()
+			if err := s.LoadFile(path); err != nil {
+				t.Fatal(err)
+			}
+			at := s.AttributeType("surname")
+			if at == nil || at.OID != "2.5.4.4" || s.Superior(at).Name() != "name" {
+				t.Errorf("sn not loaded: %+v", at)
+			}
+			quota := s.AttributeType("linkaQuota")
+			if quota == nil || quota.OID != "1.3.6.1.4.1.99999.1.1" || !quota.SingleValue || quota.Equality != "integerMatch" {
+				t.Errorf("OID macros not expanded: %+v", quota)
+			}
+			account := s.ObjectClass("linkaAccount")
+			if account == nil || account.OID != "1.3.6.1.4.1.99999.2.1" {
+				t.Fatalf("linkaAccount not loaded: %+v", account)
+			}
+			must := []string{}
+			for _, at := range s.Must(account) {
+				must = append(must, at.Name())
+			}
+			if strings.Join(must, ",") != "objectClass,sn,cn,uid" {
+				t.Errorf("unexpected required attributes %v", must)
+			}
+			if at := s.AttributeType("telephoneNumber"); at == nil || at.SyntaxLength != 32 {
+				t.Errorf("telephoneNumber not loaded: %+v", at)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, schema := range []string{
+		"\tattributetype ( 1.2.3 NAME 'x' SUP name )",
+		"attributetype ( 1.2.3 NAME 'x' SUP name",
+		"nameform ( 1.2.3 NAME 'x' )",
+		"attributetype ( Unknown:1 NAME 'x' SUP name )",
+		"objectidentifier Foo",
+	} {
+		if err := New().LoadSchema(strings.NewReader(schema)); err == nil {
+			t.Errorf("%q should not load", schema)
+		}
+	}
+	err := New().LoadSchema(strings.NewReader("# comment\n\nattributetype ( 1.2.3 NAME 'x'\n  SUP missing )\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("expected an error on line 3, got %v", err)
+	}
+	err = New().LoadLDIF(strings.NewReader("dn: cn=schema\nattributeTypes:: !!!\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+}
+
+func TestLoadOpenLDAP(t *testing.T) {
+	s := New()
+	for _, name := range []string{"core", "cosine", "inetorgperson"} {
+		if err := s.LoadFile("testdata/openldap/" + name + ".schema"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	person := s.ObjectClass("inetOrgPerson")
+	if person == nil || person.OID != "2.16.840.1.113730.3.2.2" {
+		t.Fatalf("inetOrgPerson not loaded: %+v", person)
+	}
+	names := func(attrs []*AttributeType) string {
+		var names []string
+		for _, at := range attrs {
+			names = append(names, at.Name())
+		}
+		return strings.Join(names, ",")
+	}
+	if must := names(s.Must(person)); must != "objectClass,sn,cn" {
+		t.Errorf("unexpected required attributes %s", must)
+	}
+	may := s.May(person)
+	for _, name := range []string{"audio", "homePhone", "labeledURI", "mail", "uid", "userPKCS12", "title", "description"} {
+		if !containsType(may, s.AttributeType(name)) {
+			t.Errorf("inetOrgPerson should allow %s", name)
+		}
+	}
+	// cosine refers to attribute types by any of their names, in any case
+	if account := s.ObjectClass("account"); account == nil || names(s.Must(account)) != "objectClass,uid" {
+		t.Errorf("account not loaded: %+v", account)
+	}
+	if dns := s.ObjectClass("dNSDomain"); dns == nil || !containsType(s.May(dns), s.AttributeType("aRecord")) {
+		t.Errorf("dNSDomain not loaded: %+v", dns)
+	}
+	if org := s.ObjectClass("pilotOrganization"); org == nil || len(org.Superiors) != 2 {
+		t.Errorf("pilotOrganization not loaded: %+v", org)
+	}
+	if at := s.AttributeType("gn"); at == nil || s.Superior(at).Name() != "name" || s.EqualityRule(at).Name() != "caseIgnoreMatch" {
+		t.Errorf("givenName not loaded: %+v", at)
+	}
+	if at := s.AttributeType("pkcs9email"); at == nil || at.OID != "1.2.840.113549.1.9.1" || at.SyntaxLength != 128 {
+		t.Errorf("email not loaded: %+v", at)
+	}
+}
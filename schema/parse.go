@@ -0,0 +1,409 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// token is a lexical element of an RFC 4512 definition: one of '(', ')', '$',
+// a quoted string (kind "'") or a bare word (kind 'w').
+type token struct {
+	kind byte
+	text string
+}
+
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		switch c := s[i]; c {
+		case ' ', '\t', '\r', '\n':
+			i++
+		case '(', ')', '$':
+			toks = append(toks, token{kind: c})
+			i++
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated quoted string")
+			}
+			toks = append(toks, token{kind: '\'', text: unescapeQDString(s[i+1 : i+1+end])})
+			i += end + 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n()$'", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, token{kind: 'w', text: s[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// unescapeQDString decodes the \27 and \5C escapes of a qdstring.
+func unescapeQDString(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	r := strings.NewReplacer(`\27`, `'`, `\5C`, `\`, `\5c`, `\`)
+	return r.Replace(s)
+}
+
+func escapeQDString(s string) string {
+	return strings.NewReplacer(`\`, `\5C`, `'`, `\27`).Replace(s)
+}
+
+// flagKeywords are the keywords that take no value.
+var flagKeywords = map[string]bool{
+	"OBSOLETE":             true,
+	"SINGLE-VALUE":         true,
+	"COLLECTIVE":           true,
+	"NO-USER-MODIFICATION": true,
+	"ABSTRACT":             true,
+	"STRUCTURAL":           true,
+	"AUXILIARY":            true,
+}
+
+// description is a parsed definition before it is interpreted for its kind.
+type description struct {
+	oid    string
+	fields map[string][]string
+	err    error
+}
+
+func parseDescription(def string) (*description, error) {
+	toks, err := tokenize(def)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) < 2 || toks[0].kind != '(' || (toks[1].kind != 'w' && toks[1].kind != '\'') {
+		return nil, errors.New("definition must start with '(' and an OID")
+	}
+	d := &description{oid: toks[1].text, fields: map[string][]string{}}
+	i := 2
+	for {
+		if i >= len(toks) {
+			return nil, errors.New("missing closing ')'")
+		}
+		t := toks[i]
+		i++
+		if t.kind == ')' {
+			break
+		}
+		if t.kind != 'w' {
+			return nil, fmt.Errorf("unexpected %q, expected a keyword", t.text)
+		}
+		kw := strings.ToUpper(t.text)
+		if _, ok := d.fields[kw]; ok {
+			return nil, fmt.Errorf("duplicate %s", kw)
+		}
+		if flagKeywords[kw] {
+			d.fields[kw] = nil
+			continue
+		}
+		var values []string
+		if values, i, err = parseValues(toks, i); err != nil {
+			return nil, fmt.Errorf("%s: %w", kw, err)
+		}
+		d.fields[kw] = values
+	}
+	if i != len(toks) {
+		return nil, errors.New("unexpected text after closing ')'")
+	}
+	return d, nil
+}
+
+// parseValues reads a single value or a parenthesized list of values,
+// separated by '$' for oids, starting at toks[i].
+func parseValues(toks []token, i int) ([]string, int, error) {
+	if i >= len(toks) {
+		return nil, i, errors.New("missing value")
+	}
+	switch t := toks[i]; t.kind {
+	case 'w', '\'':
+		return []string{t.text}, i + 1, nil
+	case '(':
+		var values []string
+		for i++; i < len(toks); i++ {
+			switch t := toks[i]; t.kind {
+			case ')':
+				if len(values) == 0 {
+					return nil, i, errors.New("empty list")
+				}
+				return values, i + 1, nil
+			case '$':
+			default:
+				values = append(values, t.text)
+			}
+		}
+		return nil, i, errors.New("unterminated list")
+	default:
+		return nil, i, errors.New("missing value")
+	}
+}
+
+// check reports keywords not in allowed, other than X- extensions.
+func (d *description) check(allowed ...string) error {
+	if d.err != nil {
+		return d.err
+	}
+	for kw := range d.fields {
+		if strings.HasPrefix(kw, "X-") {
+			continue
+		}
+		known := false
+		for _, a := range allowed {
+			if kw == a {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown keyword %s", kw)
+		}
+	}
+	return nil
+}
+
+func (d *description) flag(kw string) bool {
+	_, ok := d.fields[kw]
+	return ok
+}
+
+func (d *description) list(kw string) []string {
+	return d.fields[kw]
+}
+
+// one returns the single value of kw, recording an error when there are more.
+func (d *description) one(kw string) string {
+	values := d.fields[kw]
+	if len(values) > 1 && d.err == nil {
+		d.err = fmt.Errorf("%s takes a single value", kw)
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (d *description) extensions() map[string][]string {
+	var ext map[string][]string
+	for kw, values := range d.fields {
+		if strings.HasPrefix(kw, "X-") {
+			if ext == nil {
+				ext = map[string][]string{}
+			}
+			ext[kw] = values
+		}
+	}
+	return ext
+}
+
+// parseNoidlen splits a SYNTAX value into its OID and optional {length}.
+func parseNoidlen(s string) (string, int, error) {
+	open := strings.IndexByte(s, '{')
+	if open < 0 {
+		return s, 0, nil
+	}
+	if !strings.HasSuffix(s, "}") {
+		return "", 0, fmt.Errorf("malformed syntax %q", s)
+	}
+	n, err := strconv.Atoi(s[open+1 : len(s)-1])
+	if err != nil || n < 0 {
+		return "", 0, fmt.Errorf("malformed syntax length %q", s)
+	}
+	return s[:open], n, nil
+}
+
+// ParseAttributeType parses an AttributeTypeDescription (RFC 4512 4.1.2).
+func ParseAttributeType(def string) (*AttributeType, error) {
+	d, err := parseDescription(def)
+	if err != nil {
+		return nil, fmt.Errorf("attribute type: %w", err)
+	}
+	at := &AttributeType{
+		OID:                d.oid,
+		Names:              d.list("NAME"),
+		Description:        d.one("DESC"),
+		Obsolete:           d.flag("OBSOLETE"),
+		Superior:           d.one("SUP"),
+		Equality:           d.one("EQUALITY"),
+		Ordering:           d.one("ORDERING"),
+		Substring:          d.one("SUBSTR"),
+		SingleValue:        d.flag("SINGLE-VALUE"),
+		Collective:         d.flag("COLLECTIVE"),
+		NoUserModification: d.flag("NO-USER-MODIFICATION"),
+		Usage:              Usage(d.one("USAGE")),
+		Extensions:         d.extensions(),
+	}
+	if syntax := d.one("SYNTAX"); syntax != "" {
+		if at.Syntax, at.SyntaxLength, err = parseNoidlen(syntax); err != nil {
+			return nil, fmt.Errorf("attribute type %s: %w", at.OID, err)
+		}
+	}
+	if err := d.check("NAME", "DESC", "OBSOLETE", "SUP", "EQUALITY", "ORDERING", "SUBSTR", "SYNTAX",
+		"SINGLE-VALUE", "COLLECTIVE", "NO-USER-MODIFICATION", "USAGE"); err != nil {
+		return nil, fmt.Errorf("attribute type %s: %w", at.OID, err)
+	}
+	switch at.Usage {
+	case "":
+		at.Usage = UserApplications
+	case UserApplications, DirectoryOperation, DistributedOperation, DSAOperation:
+	default:
+		return nil, fmt.Errorf("attribute type %s: unknown usage %s", at.OID, at.Usage)
+	}
+	if at.Superior == "" && at.Syntax == "" {
+		return nil, fmt.Errorf("attribute type %s: neither SUP nor SYNTAX", at.OID)
+	}
+	return at, nil
+}
+
+// ParseObjectClass parses an ObjectClassDescription (RFC 4512 4.1.1).
+func ParseObjectClass(def string) (*ObjectClass, error) {
+	d, err := parseDescription(def)
+	if err != nil {
+		return nil, fmt.Errorf("object class: %w", err)
+	}
+	oc := &ObjectClass{
+		OID:         d.oid,
+		Names:       d.list("NAME"),
+		Description: d.one("DESC"),
+		Obsolete:    d.flag("OBSOLETE"),
+		Superiors:   d.list("SUP"),
+		Kind:        Structural,
+		Must:        d.list("MUST"),
+		May:         d.list("MAY"),
+		Extensions:  d.extensions(),
+	}
+	kinds := 0
+	for kind, kw := range kindKeywords {
+		if d.flag(kw) {
+			oc.Kind = ObjectClassKind(kind)
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return nil, fmt.Errorf("object class %s: more than one kind", oc.OID)
+	}
+	if err := d.check("NAME", "DESC", "OBSOLETE", "SUP", "ABSTRACT", "STRUCTURAL", "AUXILIARY", "MUST", "MAY"); err != nil {
+		return nil, fmt.Errorf("object class %s: %w", oc.OID, err)
+	}
+	return oc, nil
+}
+
+// ParseMatchingRule parses a MatchingRuleDescription (RFC 4512 4.1.3).
+func ParseMatchingRule(def string) (*MatchingRule, error) {
+	d, err := parseDescription(def)
+	if err != nil {
+		return nil, fmt.Errorf("matching rule: %w", err)
+	}
+	mr := &MatchingRule{
+		OID:         d.oid,
+		Names:       d.list("NAME"),
+		Description: d.one("DESC"),
+		Obsolete:    d.flag("OBSOLETE"),
+		Syntax:      d.one("SYNTAX"),
+		Extensions:  d.extensions(),
+	}
+	if err := d.check("NAME", "DESC", "OBSOLETE", "SYNTAX"); err != nil {
+		return nil, fmt.Errorf("matching rule %s: %w", mr.OID, err)
+	}
+	if mr.Syntax == "" {
+		return nil, fmt.Errorf("matching rule %s: missing SYNTAX", mr.OID)
+	}
+	return mr, nil
+}
+
+// ParseSyntax parses a SyntaxDescription (RFC 4512 4.1.5).
+func ParseSyntax(def string) (*Syntax, error) {
+	d, err := parseDescription(def)
+	if err != nil {
+		return nil, fmt.Errorf("syntax: %w", err)
+	}
+	s := &Syntax{
+		OID:         d.oid,
+		Description: d.one("DESC"),
+		Extensions:  d.extensions(),
+	}
+	if err := d.check("DESC"); err != nil {
+		return nil, fmt.Errorf("syntax %s: %w", s.OID, err)
+	}
+	return s, nil
+}
+
+// definition renders RFC 4512 descriptions.
+type definition struct {
+	b strings.Builder
+}
+
+func newDefinition(oid string) *definition {
+	d := &definition{}
+	d.b.WriteString("( ")
+	d.b.WriteString(oid)
+	return d
+}
+
+func (d *definition) qdescrs(kw string, names []string) {
+	switch len(names) {
+	case 0:
+	case 1:
+		fmt.Fprintf(&d.b, " %s '%s'", kw, names[0])
+	default:
+		fmt.Fprintf(&d.b, " %s (", kw)
+		for _, name := range names {
+			fmt.Fprintf(&d.b, " '%s'", name)
+		}
+		d.b.WriteString(" )")
+	}
+}
+
+func (d *definition) qdstring(kw, s string) {
+	if s != "" {
+		fmt.Fprintf(&d.b, " %s '%s'", kw, escapeQDString(s))
+	}
+}
+
+func (d *definition) oid(kw, oid string) {
+	if oid != "" {
+		fmt.Fprintf(&d.b, " %s %s", kw, oid)
+	}
+}
+
+func (d *definition) oids(kw string, oids []string) {
+	switch len(oids) {
+	case 0:
+	case 1:
+		d.oid(kw, oids[0])
+	default:
+		fmt.Fprintf(&d.b, " %s ( %s )", kw, strings.Join(oids, " $ "))
+	}
+}
+
+func (d *definition) flag(kw string, set bool) {
+	if set {
+		d.b.WriteString(" ")
+		d.b.WriteString(kw)
+	}
+}
+
+func (d *definition) extensions(ext map[string][]string) {
+	kws := make([]string, 0, len(ext))
+	for kw := range ext {
+		kws = append(kws, kw)
+	}
+	sort.Strings(kws)
+	for _, kw := range kws {
+		values := make([]string, len(ext[kw]))
+		for i, v := range ext[kw] {
+			values[i] = escapeQDString(v)
+		}
+		d.qdescrs(kw, values)
+	}
+}
+
+func (d *definition) String() string {
+	return d.b.String() + " )"
+}
@@ -0,0 +1,300 @@
+// Package schema models LDAP schemas (RFC 4512): attribute types, object
+// classes, matching rules and syntaxes. Definitions are parsed from their
+// RFC 4512 descriptions, OpenLDAP .schema files or LDIF.
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Schema is a set of definitions, looked up by OID or, ignoring case, by any of
+// their names. A Schema must not be modified while it is being read.
+type Schema struct {
+	syntaxes       registry[*Syntax]
+	matchingRules  registry[*MatchingRule]
+	attributeTypes registry[*AttributeType]
+	objectClasses  registry[*ObjectClass]
+
+	// macros are the OID macros declared with objectidentifier
+	macros map[string]string
+}
+
+// New returns a schema holding the system definitions every LDAP server knows:
+// the RFC 4517 syntaxes and matching rules and the operational attributes and
+// object classes of RFC 4512. Files such as OpenLDAP's core.schema build on
+// them, and may redefine them.
+func New() *Schema {
+	s := &Schema{macros: map[string]string{}}
+	for _, def := range systemSyntaxes {
+		syn, err := ParseSyntax(def)
+		if err != nil {
+			panic(err)
+		}
+		syn.system = true
+		mustAdd(s.AddSyntax(syn))
+	}
+	for _, def := range systemMatchingRules {
+		mr, err := ParseMatchingRule(def)
+		if err != nil {
+			panic(err)
+		}
+		mr.system = true
+		mustAdd(s.AddMatchingRule(mr))
+	}
+	for _, def := range systemAttributeTypes {
+		at, err := ParseAttributeType(def)
+		if err != nil {
+			panic(err)
+		}
+		at.system = true
+		mustAdd(s.AddAttributeType(at))
+	}
+	for _, def := range systemObjectClasses {
+		oc, err := ParseObjectClass(def)
+		if err != nil {
+			panic(err)
+		}
+		oc.system = true
+		mustAdd(s.AddObjectClass(oc))
+	}
+	return s
+}
+
+func mustAdd(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// AddSyntax adds an LDAP syntax to the schema.
+func (s *Schema) AddSyntax(syn *Syntax) error {
+	return s.syntaxes.add("syntax", syn, syn.OID, nil, syn.system)
+}
+
+// AddMatchingRule adds a matching rule to the schema.
+func (s *Schema) AddMatchingRule(mr *MatchingRule) error {
+	return s.matchingRules.add("matching rule", mr, mr.OID, mr.Names, mr.system)
+}
+
+// AddAttributeType adds an attribute type to the schema. Its superior type
+// must already be defined.
+func (s *Schema) AddAttributeType(at *AttributeType) error {
+	if at.Superior != "" && s.AttributeType(at.Superior) == nil {
+		return fmt.Errorf("attribute type %s: unknown superior type %s", at.OID, at.Superior)
+	}
+	return s.attributeTypes.add("attribute type", at, at.OID, at.Names, at.system)
+}
+
+// AddObjectClass adds an object class to the schema. Its superior classes and
+// the attribute types it lists must already be defined.
+func (s *Schema) AddObjectClass(oc *ObjectClass) error {
+	for _, sup := range oc.Superiors {
+		if s.ObjectClass(sup) == nil {
+			return fmt.Errorf("object class %s: unknown superior class %s", oc.OID, sup)
+		}
+	}
+	for _, name := range append(append([]string{}, oc.Must...), oc.May...) {
+		if s.AttributeType(name) == nil {
+			return fmt.Errorf("object class %s: unknown attribute type %s", oc.OID, name)
+		}
+	}
+	return s.objectClasses.add("object class", oc, oc.OID, oc.Names, oc.system)
+}
+
+// Syntax returns the syntax with the given OID, or nil.
+func (s *Schema) Syntax(oid string) *Syntax {
+	return s.syntaxes.get(oid)
+}
+
+// MatchingRule returns the matching rule with the given name or OID, or nil.
+func (s *Schema) MatchingRule(name string) *MatchingRule {
+	return s.matchingRules.get(name)
+}
+
+// AttributeType returns the attribute type with the given name or OID, or nil.
+func (s *Schema) AttributeType(name string) *AttributeType {
+	return s.attributeTypes.get(name)
+}
+
+// ObjectClass returns the object class with the given name or OID, or nil.
+func (s *Schema) ObjectClass(name string) *ObjectClass {
+	return s.objectClasses.get(name)
+}
+
+// Syntaxes returns the syntaxes in the order they were defined.
+func (s *Schema) Syntaxes() []*Syntax {
+	return append([]*Syntax{}, s.syntaxes.list...)
+}
+
+// MatchingRules returns the matching rules in the order they were defined.
+func (s *Schema) MatchingRules() []*MatchingRule {
+	return append([]*MatchingRule{}, s.matchingRules.list...)
+}
+
+// AttributeTypes returns the attribute types in the order they were defined.
+func (s *Schema) AttributeTypes() []*AttributeType {
+	return append([]*AttributeType{}, s.attributeTypes.list...)
+}
+
+// ObjectClasses returns the object classes in the order they were defined.
+func (s *Schema) ObjectClasses() []*ObjectClass {
+	return append([]*ObjectClass{}, s.objectClasses.list...)
+}
+
+// Superior returns the superior type of at, or nil when it has none.
+func (s *Schema) Superior(at *AttributeType) *AttributeType {
+	if at.Superior == "" {
+		return nil
+	}
+	return s.AttributeType(at.Superior)
+}
+
+// IsSubtype reports whether at is super or one of its subtypes.
+func (s *Schema) IsSubtype(at, super *AttributeType) bool {
+	for seen := 0; at != nil && seen <= len(s.attributeTypes.list); seen++ {
+		if at == super {
+			return true
+		}
+		at = s.Superior(at)
+	}
+	return false
+}
+
+// EqualityRule returns the equality matching rule of at, inherited from its
+// superior types when it names none, or nil.
+func (s *Schema) EqualityRule(at *AttributeType) *MatchingRule {
+	return s.inheritedRule(at, func(at *AttributeType) string { return at.Equality })
+}
+
+// OrderingRule returns the ordering matching rule of at, inherited from its
+// superior types when it names none, or nil.
+func (s *Schema) OrderingRule(at *AttributeType) *MatchingRule {
+	return s.inheritedRule(at, func(at *AttributeType) string { return at.Ordering })
+}
+
+// SubstringRule returns the substrings matching rule of at, inherited from
+// its superior types when it names none, or nil.
+func (s *Schema) SubstringRule(at *AttributeType) *MatchingRule {
+	return s.inheritedRule(at, func(at *AttributeType) string { return at.Substring })
+}
+
+// SyntaxOID returns the OID of the syntax of at, inherited from its superior
+// types when it names none.
+func (s *Schema) SyntaxOID(at *AttributeType) string {
+	for seen := 0; at != nil && seen <= len(s.attributeTypes.list); seen++ {
+		if at.Syntax != "" {
+			return at.Syntax
+		}
+		at = s.Superior(at)
+	}
+	return ""
+}
+
+func (s *Schema) inheritedRule(at *AttributeType, rule func(*AttributeType) string) *MatchingRule {
+	// seen guards against superior chains looping through redefinitions
+	for seen := 0; at != nil && seen <= len(s.attributeTypes.list); seen++ {
+		if name := rule(at); name != "" {
+			return s.MatchingRule(name)
+		}
+		at = s.Superior(at)
+	}
+	return nil
+}
+
+// Must returns the attribute types required by oc, including the ones
+// required by its superior classes.
+func (s *Schema) Must(oc *ObjectClass) []*AttributeType {
+	return s.classAttributes(oc, func(oc *ObjectClass) []string { return oc.Must }, map[*ObjectClass]bool{})
+}
+
+// May returns the attribute types allowed by oc, including the ones allowed
+// by its superior classes.
+func (s *Schema) May(oc *ObjectClass) []*AttributeType {
+	return s.classAttributes(oc, func(oc *ObjectClass) []string { return oc.May }, map[*ObjectClass]bool{})
+}
+
+func (s *Schema) classAttributes(oc *ObjectClass, names func(*ObjectClass) []string, seen map[*ObjectClass]bool) []*AttributeType {
+	if seen[oc] {
+		return nil
+	}
+	seen[oc] = true
+	var attrs []*AttributeType
+	for _, sup := range oc.Superiors {
+		if sup := s.ObjectClass(sup); sup != nil {
+			attrs = append(attrs, s.classAttributes(sup, names, seen)...)
+		}
+	}
+	for _, name := range names(oc) {
+		if at := s.AttributeType(name); at != nil && !containsType(attrs, at) {
+			attrs = append(attrs, at)
+		}
+	}
+	return attrs
+}
+
+func containsType(attrs []*AttributeType, at *AttributeType) bool {
+	for _, a := range attrs {
+		if a == at {
+			return true
+		}
+	}
+	return false
+}
+
+// registry keeps the definitions of one kind in definition order, indexed by
+// lower-cased OID and names.
+type registry[T comparable] struct {
+	list   []T
+	index  map[string]T
+	system map[T]bool
+}
+
+func (r *registry[T]) get(name string) T {
+	return r.index[strings.ToLower(name)]
+}
+
+// add registers def. A definition may only replace a system definition with
+// the same OID.
+func (r *registry[T]) add(kind string, def T, oid string, names []string, system bool) error {
+	if r.index == nil {
+		r.index = map[string]T{}
+		r.system = map[T]bool{}
+	}
+	if oid == "" {
+		return fmt.Errorf("%s without an OID", kind)
+	}
+	var zero T
+	old := r.index[strings.ToLower(oid)]
+	if old != zero && !r.system[old] {
+		return fmt.Errorf("duplicate %s %s", kind, oid)
+	}
+	for _, name := range names {
+		if other := r.index[strings.ToLower(name)]; other != zero && other != old {
+			return fmt.Errorf("%s %s: name %s is already used", kind, oid, name)
+		}
+	}
+	if old != zero {
+		for key, d := range r.index {
+			if d == old {
+				delete(r.index, key)
+			}
+		}
+		delete(r.system, old)
+		for i, d := range r.list {
+			if d == old {
+				r.list[i] = def
+			}
+		}
+	} else {
+		r.list = append(r.list, def)
+	}
+	r.index[strings.ToLower(oid)] = def
+	for _, name := range names {
+		r.index[strings.ToLower(name)] = def
+	}
+	if system {
+		r.system[def] = true
+	}
+	return nil
+}
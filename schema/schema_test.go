@@ -0,0 +1,132 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAttributeType(t *testing.T) {
+	at, err := ParseAttributeType(`( 2.5.4.20 NAME 'telephoneNumber' DESC 'RFC2256: Telephone Number\27s'
+		EQUALITY telephoneNumberMatch SUBSTR telephoneNumberSubstringsMatch
+		SYNTAX 1.3.6.1.4.1.1466.115.121.1.50{32} X-ORIGIN ( 'RFC 4519' 'RFC 2256' ) )`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &AttributeType{
+		OID:          "2.5.4.20",
+		Names:        []string{"telephoneNumber"},
+		Description:  "RFC2256: Telephone Number's",
+		Equality:     "telephoneNumberMatch",
+		Substring:    "telephoneNumberSubstringsMatch",
+		Syntax:       "1.3.6.1.4.1.1466.115.121.1.50",
+		SyntaxLength: 32,
+		Usage:        UserApplications,
+		Extensions:   map[string][]string{"X-ORIGIN": {"RFC 4519", "RFC 2256"}},
+	}
+	if !reflect.DeepEqual(at, want) {
+		t.Errorf("expected %+v, got %+v", want, at)
+	}
+	s := at.String()
+	if s != `( 2.5.4.20 NAME 'telephoneNumber' DESC 'RFC2256: Telephone Number\27s' EQUALITY telephoneNumberMatch SUBSTR telephoneNumberSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.50{32} X-ORIGIN ( 'RFC 4519' 'RFC 2256' ) )` {
+		t.Errorf("unexpected description %s", s)
+	}
+	again, err := ParseAttributeType(s)
+	if err != nil || !reflect.DeepEqual(again, want) {
+		t.Errorf("description does not round trip: %+v, %v", again, err)
+	}
+}
+
+func TestParseObjectClass(t *testing.T) {
+	oc, err := ParseObjectClass("( 2.5.6.6 NAME 'person' SUP top STRUCTURAL MUST ( sn $ cn ) MAY ( userPassword $ telephoneNumber ) )")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oc.Kind != Structural || !reflect.DeepEqual(oc.Superiors, []string{"top"}) ||
+		!reflect.DeepEqual(oc.Must, []string{"sn", "cn"}) || !reflect.DeepEqual(oc.May, []string{"userPassword", "telephoneNumber"}) {
+		t.Errorf("unexpected object class %+v", oc)
+	}
+	if s := oc.String(); s != "( 2.5.6.6 NAME 'person' SUP top STRUCTURAL MUST ( sn $ cn ) MAY ( userPassword $ telephoneNumber ) )" {
+		t.Errorf("unexpected description %s", s)
+	}
+	oc, err = ParseObjectClass("( 2.5.6.0 NAME 'top' ABSTRACT MUST objectClass )")
+	if err != nil || oc.Kind != Abstract {
+		t.Errorf("expected an abstract class, got %+v, %v", oc, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, def := range []string{
+		"",
+		"2.5.4.3 NAME 'cn' SUP name",
+		"( 2.5.4.3 NAME 'cn' SUP name",
+		"( 2.5.4.3 NAME 'cn SUP name )",
+		"( 2.5.4.3 NAME 'cn' SUP name ) trailing",
+		"( 2.5.4.3 NAME 'cn' NAME 'commonName' SUP name )",
+		"( 2.5.4.3 NAME 'cn' SUP ( name $ description ) )",
+		"( 2.5.4.3 NAME 'cn' )",
+		"( 2.5.4.3 NAME 'cn' SUP name UNKNOWN foo )",
+		"( 2.5.4.3 NAME 'cn' SUP name USAGE everything )",
+		"( 2.5.4.3 NAME 'cn' SYNTAX 1.2.3{x} )",
+		"( 2.5.4.3 NAME () SUP name )",
+	} {
+		if at, err := ParseAttributeType(def); err == nil {
+			t.Errorf("%q should not parse, got %+v", def, at)
+		}
+	}
+	if _, err := ParseObjectClass("( 2.5.6.0 NAME 'top' ABSTRACT AUXILIARY )"); err == nil {
+		t.Errorf("an object class cannot have two kinds")
+	}
+	if _, err := ParseMatchingRule("( 2.5.13.2 NAME 'caseIgnoreMatch' )"); err == nil {
+		t.Errorf("a matching rule requires a syntax")
+	}
+}
+
+func TestSchema(t *testing.T) {
+	s := New()
+	if at := s.AttributeType("OBJECTCLASS"); at == nil || at.OID != "2.5.4.0" {
+		t.Errorf("objectClass not found by name: %+v", at)
+	}
+	if at := s.AttributeType("2.5.18.10"); at == nil || at.Name() != "subschemaSubentry" || !at.Operational() {
+		t.Errorf("subschemaSubentry not found by OID: %+v", at)
+	}
+	if mr := s.MatchingRule("caseignorematch"); mr == nil || mr.OID != "2.5.13.2" {
+		t.Errorf("caseIgnoreMatch not found: %+v", mr)
+	}
+	if syn := s.Syntax("1.3.6.1.4.1.1466.115.121.1.27"); syn == nil || syn.Description != "INTEGER" {
+		t.Errorf("INTEGER syntax not found: %+v", syn)
+	}
+
+	cn, _ := ParseAttributeType("( 2.5.4.3 NAME ( 'cn' 'commonName' ) SUP name )")
+	if err := s.AddAttributeType(cn); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddAttributeType(cn); err == nil {
+		t.Errorf("duplicate attribute types should be rejected")
+	}
+	other, _ := ParseAttributeType("( 1.2.3.4 NAME 'commonName' SUP name )")
+	if err := s.AddAttributeType(other); err == nil {
+		t.Errorf("duplicate names should be rejected")
+	}
+	orphan, _ := ParseAttributeType("( 1.2.3.5 NAME 'orphan' SUP missing )")
+	if err := s.AddAttributeType(orphan); err == nil {
+		t.Errorf("unknown superior types should be rejected")
+	}
+	if sup := s.Superior(s.AttributeType("commonName")); sup == nil || sup.Name() != "name" {
+		t.Errorf("expected cn to inherit from name, got %+v", sup)
+	}
+
+	// system definitions can be redefined, keeping their place
+	name, _ := ParseAttributeType("( 2.5.4.41 NAME 'name' EQUALITY caseIgnoreMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15{32768} )")
+	before := len(s.AttributeTypes())
+	if err := s.AddAttributeType(name); err != nil {
+		t.Fatal(err)
+	}
+	if s.AttributeType("name") != name || len(s.AttributeTypes()) != before {
+		t.Errorf("system attribute type not replaced")
+	}
+
+	person, _ := ParseObjectClass("( 2.5.6.6 NAME 'person' SUP top MUST cn MAY description )")
+	if err := s.AddObjectClass(person); err == nil {
+		t.Errorf("object classes allowing unknown attribute types should be rejected")
+	}
+}
@@ -0,0 +1,209 @@
+package schema
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Usage is the application of an attribute type (RFC 4512 4.1.2).
+type Usage string
+
+const (
+	UserApplications     Usage = "userApplications"
+	DirectoryOperation   Usage = "directoryOperation"
+	DistributedOperation Usage = "distributedOperation"
+	DSAOperation         Usage = "dSAOperation"
+)
+
+// ObjectClassKind is the kind of an object class. The zero value is
+// Structural, the kind of classes whose definition doesn't name one.
+type ObjectClassKind int
+
+const (
+	Structural ObjectClassKind = iota
+	Abstract
+	Auxiliary
+)
+
+var kindKeywords = [...]string{
+	Structural: "STRUCTURAL",
+	Abstract:   "ABSTRACT",
+	Auxiliary:  "AUXILIARY",
+}
+
+func (k ObjectClassKind) String() string {
+	return kindKeywords[k]
+}
+
+// AttributeType is an attribute type definition. Matching rules and the
+// syntax are left empty when they are inherited from the superior type.
+type AttributeType struct {
+	OID                string
+	Names              []string
+	Description        string
+	Obsolete           bool
+	Superior           string
+	Equality           string
+	Ordering           string
+	Substring          string
+	Syntax             string
+	SyntaxLength       int
+	SingleValue        bool
+	Collective         bool
+	NoUserModification bool
+	Usage              Usage
+	Extensions         map[string][]string
+
+	system bool
+}
+
+// Name returns the first name of the attribute type, or its OID.
+func (at *AttributeType) Name() string {
+	return firstName(at.Names, at.OID)
+}
+
+// HasName reports whether name is one of the names or the OID of at, ignoring
+// case.
+func (at *AttributeType) HasName(name string) bool {
+	return hasName(at.Names, at.OID, name)
+}
+
+// Operational reports whether the attribute type is an operational attribute.
+func (at *AttributeType) Operational() bool {
+	return at.Usage != "" && at.Usage != UserApplications
+}
+
+// String returns the RFC 4512 description of the attribute type.
+func (at *AttributeType) String() string {
+	d := newDefinition(at.OID)
+	d.qdescrs("NAME", at.Names)
+	d.qdstring("DESC", at.Description)
+	d.flag("OBSOLETE", at.Obsolete)
+	d.oid("SUP", at.Superior)
+	d.oid("EQUALITY", at.Equality)
+	d.oid("ORDERING", at.Ordering)
+	d.oid("SUBSTR", at.Substring)
+	if at.SyntaxLength > 0 {
+		d.oid("SYNTAX", at.Syntax+"{"+strconv.Itoa(at.SyntaxLength)+"}")
+	} else {
+		d.oid("SYNTAX", at.Syntax)
+	}
+	d.flag("SINGLE-VALUE", at.SingleValue)
+	d.flag("COLLECTIVE", at.Collective)
+	d.flag("NO-USER-MODIFICATION", at.NoUserModification)
+	if at.Operational() {
+		d.oid("USAGE", string(at.Usage))
+	}
+	d.extensions(at.Extensions)
+	return d.String()
+}
+
+// ObjectClass is an object class definition.
+type ObjectClass struct {
+	OID         string
+	Names       []string
+	Description string
+	Obsolete    bool
+	Superiors   []string
+	Kind        ObjectClassKind
+	Must        []string
+	May         []string
+	Extensions  map[string][]string
+
+	system bool
+}
+
+// Name returns the first name of the object class, or its OID.
+func (oc *ObjectClass) Name() string {
+	return firstName(oc.Names, oc.OID)
+}
+
+// HasName reports whether name is one of the names or the OID of oc, ignoring
+// case.
+func (oc *ObjectClass) HasName(name string) bool {
+	return hasName(oc.Names, oc.OID, name)
+}
+
+// String returns the RFC 4512 description of the object class.
+func (oc *ObjectClass) String() string {
+	d := newDefinition(oc.OID)
+	d.qdescrs("NAME", oc.Names)
+	d.qdstring("DESC", oc.Description)
+	d.flag("OBSOLETE", oc.Obsolete)
+	d.oids("SUP", oc.Superiors)
+	d.flag(oc.Kind.String(), true)
+	d.oids("MUST", oc.Must)
+	d.oids("MAY", oc.May)
+	d.extensions(oc.Extensions)
+	return d.String()
+}
+
+// MatchingRule is a matching rule definition.
+type MatchingRule struct {
+	OID         string
+	Names       []string
+	Description string
+	Obsolete    bool
+	Syntax      string
+	Extensions  map[string][]string
+
+	system bool
+}
+
+// Name returns the first name of the matching rule, or its OID.
+func (mr *MatchingRule) Name() string {
+	return firstName(mr.Names, mr.OID)
+}
+
+// HasName reports whether name is one of the names or the OID of mr, ignoring
+// case.
+func (mr *MatchingRule) HasName(name string) bool {
+	return hasName(mr.Names, mr.OID, name)
+}
+
+// String returns the RFC 4512 description of the matching rule.
+func (mr *MatchingRule) String() string {
+	d := newDefinition(mr.OID)
+	d.qdescrs("NAME", mr.Names)
+	d.qdstring("DESC", mr.Description)
+	d.flag("OBSOLETE", mr.Obsolete)
+	d.oid("SYNTAX", mr.Syntax)
+	d.extensions(mr.Extensions)
+	return d.String()
+}
+
+// Syntax is an LDAP syntax definition.
+type Syntax struct {
+	OID         string
+	Description string
+	Extensions  map[string][]string
+
+	system bool
+}
+
+// String returns the RFC 4512 description of the syntax.
+func (s *Syntax) String() string {
+	d := newDefinition(s.OID)
+	d.qdstring("DESC", s.Description)
+	d.extensions(s.Extensions)
+	return d.String()
+}
+
+func firstName(names []string, oid string) string {
+	if len(names) > 0 {
+		return names[0]
+	}
+	return oid
+}
+
+func hasName(names []string, oid, name string) bool {
+	if name == oid {
+		return true
+	}
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
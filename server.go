@@ -8,9 +8,11 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
-	"github.com/go-ldap/ldap/v3"
+
+	"go.linka.cloud/ldap/schema"
 )
 
 type Binder interface {
@@ -19,6 +21,26 @@ type Binder interface {
 type Searcher interface {
 	Search(ctx context.Context, boundDN string, req SearchRequest, conn net.Conn) (ServerSearchResult, error)
 }
+
+// SearchStreamer is an alternative to Searcher for handlers that produce their
+// results incrementally: entries and references are sent to the client as they
+// are written to w instead of being collected in ServerSearchResult.Entries.
+// The returned ServerSearchResult carries the final result code and controls.
+type SearchStreamer interface {
+	SearchStream(ctx context.Context, boundDN string, req SearchRequest, w SearchResultWriter, conn net.Conn) (ServerSearchResult, error)
+}
+
+// SearchResultWriter sends search results to the client. With EnforceLDAP,
+// WriteEntry applies the search filter, scope and attribute selection, silently
+// dropping entries that don't match, and returns ErrSizeLimitExceeded once the
+// request's size limit is reached, which then ends the search with
+// sizeLimitExceeded. Once the search is abandoned, every write returns an
+// error: handlers should stop on the first one.
+type SearchResultWriter interface {
+	WriteEntry(entry *Entry) error
+	WriteReference(urls ...string) error
+	WriteIntermediate(name string, value []byte) error
+}
 type Adder interface {
 	Add(ctx context.Context, boundDN string, req AddRequest, conn net.Conn) (LDAPResultCode, error)
 }
@@ -35,11 +57,22 @@ type Comparer interface {
 	Compare(ctx context.Context, boundDN string, req CompareRequest, conn net.Conn) (LDAPResultCode, error)
 }
 type Abandoner interface {
-	Abandon(ctx context.Context, boundDN string, conn net.Conn) error
+	Abandon(ctx context.Context, boundDN string, messageID uint64, conn net.Conn) error
 }
+
+// Extender handles extended operations. The server answers Who am I? (RFC
+// 4532) itself from the bound DN unless an Extender is registered for the
+// bound DN's subtree.
 type Extender interface {
-	Extended(ctx context.Context, boundDN string, req ExtendedRequest, conn net.Conn) (LDAPResultCode, error)
+	Extended(ctx context.Context, boundDN string, req ExtendedRequest, conn net.Conn) (ExtendedResponse, error)
 }
+
+// PasswordModifier handles the Password Modify extended operation (RFC 3062).
+// An empty req.NewPassword asks for a generated password, returned as genPasswd.
+type PasswordModifier interface {
+	PasswordModify(ctx context.Context, boundDN string, req PasswordModifyRequest, conn net.Conn) (genPassword string, resultCode LDAPResultCode, err error)
+}
+
 type Unbinder interface {
 	Unbind(ctx context.Context, boundDN string, conn net.Conn) (LDAPResultCode, error)
 }
@@ -48,6 +81,14 @@ type Closer interface {
 }
 
 type Server struct {
+	// The handlers of each operation are registered by baseDN. They handle
+	// the operations on the subtree of the entry it names, or only on that
+	// entry when it is prefixed with "=", and an RDN written * matches any
+	// RDN, type=* any RDN of that attribute type. Searches and updates of
+	// DNs no handler covers fail with noSuchObject, or a referral to
+	// Referrals, and the other operations fall back to the handlers
+	// registered for "" by NewServer. These only cover every DN while no
+	// other handler of their operation is registered.
 	BindFns     map[string]Binder
 	SearchFns   map[string]Searcher
 	AddFns      map[string]Adder
@@ -58,11 +99,49 @@ type Server struct {
 	AbandonFns  map[string]Abandoner
 	ExtendedFns map[string]Extender
 	UnbindFns   map[string]Unbinder
-	CloseFns    map[string]Closer
-	StartTLS    *tls.Config
+	// PasswordModifyFns are routed by the DN whose password changes.
+	PasswordModifyFns map[string]PasswordModifier
+	CloseFns          map[string]Closer
+	StartTLS          *tls.Config
+	// EnforceLDAP applies the search filter, attribute selection, size limit,
+	// scope and base DN to the entries handlers return, and pages, sorts and
+	// serves VLV requests (RFC 2696, RFC 2891) on their behalf.
 	EnforceLDAP bool
 	Stats       *Stats
 
+	// Schema, when set, is published at SubschemaDN.
+	Schema *schema.Schema
+
+	// RootDSE, when set, answers base-scope searches of the empty DN instead
+	// of the Root DSE the server synthesises from what is registered, as does
+	// a Searcher registered for "=". Searchers registered for "" cover every
+	// other DN but leave the Root DSE to the server: use RootDSEHook to amend
+	// it.
+	RootDSE Searcher
+	// RootDSEHook can amend the synthesised Root DSE before it is returned,
+	// e.g. to add vendorName. Operational attributes are named "+name".
+	RootDSEHook func(ctx context.Context, boundDN string, dse *Entry, conn net.Conn)
+
+	// SASLMechanisms are the mechanisms offered in SASL binds, by upper-case
+	// name. See RegisterSASLMechanism.
+	SASLMechanisms map[string]SASLMechanism
+
+	// MaxOutstanding limits how many operations a single connection may have in
+	// flight at once. Once reached, the connection stops reading requests until
+	// one completes. 0 means no limit. Operations run concurrently, but Bind
+	// and StartTLS wait for the outstanding ones as RFC 4511 requires.
+	MaxOutstanding int
+
+	// Referrals, when set, are returned in a referral to searches and updates
+	// of DNs no handler is registered for, instead of noSuchObject. Handlers
+	// refer to their own URLs by returning a *ReferralError.
+	Referrals []string
+
+	// routers route DNs to the baseDNs of the handler maps, by operation.
+	// routersGen is bumped by the registration methods to invalidate them.
+	routers    sync.Map
+	routersGen atomic.Uint64
+
 	done chan struct{}
 }
 
@@ -95,7 +174,9 @@ func NewServer() *Server {
 	s.AbandonFns = make(map[string]Abandoner)
 	s.ExtendedFns = make(map[string]Extender)
 	s.UnbindFns = make(map[string]Unbinder)
+	s.PasswordModifyFns = make(map[string]PasswordModifier)
 	s.CloseFns = make(map[string]Closer)
+	s.SASLMechanisms = make(map[string]SASLMechanism)
 	s.BindFunc("", d)
 	s.SearchFunc("", d)
 	s.AddFunc("", d)
@@ -106,6 +187,7 @@ func NewServer() *Server {
 	s.AbandonFunc("", d)
 	s.ExtendedFunc("", d)
 	s.UnbindFunc("", d)
+	s.PasswordModifyFunc("", d)
 	s.CloseFunc("", d)
 	s.Stats = nil
 	s.done = make(chan struct{})
@@ -114,46 +196,69 @@ func NewServer() *Server {
 
 func (server *Server) BindFunc(baseDN string, f Binder) {
 	server.BindFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) SearchFunc(baseDN string, f Searcher) {
 	server.SearchFns[baseDN] = f
+	server.routersGen.Add(1)
+}
+
+// SearchStreamFunc registers a streaming search handler. Handlers registered
+// with SearchFunc that also implement SearchStreamer are streamed as well.
+func (server *Server) SearchStreamFunc(baseDN string, f SearchStreamer) {
+	server.SearchFns[baseDN] = streamingSearcher{f}
+	server.routersGen.Add(1)
 }
 
 func (server *Server) AddFunc(baseDN string, f Adder) {
 	server.AddFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) ModifyFunc(baseDN string, f Modifier) {
 	server.ModifyFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) DeleteFunc(baseDN string, f Deleter) {
 	server.DeleteFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) ModifyDNFunc(baseDN string, f ModifyDNr) {
 	server.ModifyDNFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) CompareFunc(baseDN string, f Comparer) {
 	server.CompareFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) AbandonFunc(baseDN string, f Abandoner) {
 	server.AbandonFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) ExtendedFunc(baseDN string, f Extender) {
 	server.ExtendedFns[baseDN] = f
+	server.routersGen.Add(1)
+}
+
+func (server *Server) PasswordModifyFunc(baseDN string, f PasswordModifier) {
+	server.PasswordModifyFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) UnbindFunc(baseDN string, f Unbinder) {
 	server.UnbindFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) CloseFunc(baseDN string, f Closer) {
 	server.CloseFns[baseDN] = f
+	server.routersGen.Add(1)
 }
 
 func (server *Server) ListenAndServeTLS(listenString string, certFile string, keyFile string) error {
@@ -259,14 +364,31 @@ func (server *Server) Close() error {
 	return nil
 }
 
-func (server *Server) handleConnection(ctx context.Context, conn net.Conn) {
+// responseTags are the tags of the responses to the requests that have one.
+var responseTags = map[ber.Tag]uint8{
+	ApplicationBindRequest:     ApplicationBindResponse,
+	ApplicationSearchRequest:   ApplicationSearchResultDone,
+	ApplicationModifyRequest:   ApplicationModifyResponse,
+	ApplicationAddRequest:      ApplicationAddResponse,
+	ApplicationDelRequest:      ApplicationDelResponse,
+	ApplicationModifyDNRequest: ApplicationModifyDNResponse,
+	ApplicationCompareRequest:  ApplicationCompareResponse,
+	ApplicationExtendedRequest: ApplicationExtendedResponse,
+}
+
+func (server *Server) handleConnection(ctx context.Context, netConn net.Conn) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	conn := newServerConn(netConn, server.MaxOutstanding)
+	// operations get their own context so they can be cancelled when the
+	// connection goes away while Close handlers still run under ctx
+	opCtx, cancelOps := context.WithCancel(ctx)
+	defer cancelOps()
 	boundDN := "" // "" == anonymous
 	// If we're listening on SSL and get a new connection it'll already be tls.Conn
 	// otherwise if we're doing StartTLS then the connection might have already
 	// been upgraded
-	_, connectionTLSActive := conn.(*tls.Conn)
+	_, connectionTLSActive := netConn.(*tls.Conn)
 handler:
 	for {
 		// read incoming LDAP packet
@@ -297,16 +419,31 @@ handler:
 		}
 		// handle controls if present
 		controls := []Control{}
+		var critical []string
 		if len(packet.Children) > 2 {
 			for _, child := range packet.Children[2].Children {
-				if c, err := ldap.DecodeControl(child); err == nil {
+				if c, criticality, err := decodeControl(child); err == nil {
 					controls = append(controls, c)
+					if criticality {
+						critical = append(critical, c.GetControlType())
+					}
 				} else {
 					Log.Printf("Failed to decode control: %s", err.Error())
 				}
 			}
 		}
 
+		// RFC 4511 4.1.1.1: a message ID must not be reused while its request
+		// is outstanding
+		if response, ok := responseTags[req.Tag]; ok && conn.inFlight(messageID) {
+			Log.Printf("Message ID %d is already in use", messageID)
+			if err = sendPacket(conn, encodeLDAPResponse(messageID, response, LDAPResultProtocolError, "message ID already in use")); err != nil {
+				Log.Printf("sendPacket error %s", err.Error())
+				break handler
+			}
+			continue
+		}
+
 		// Log.Printf("DEBUG: handling operation: %s [%d]", ApplicationMap[req.Tag], req.Tag)
 		// ber.PrintPacket(packet) // DEBUG
 
@@ -321,117 +458,138 @@ handler:
 			break handler
 
 		case ApplicationBindRequest:
+			untrack := conn.track(messageID)
+			// RFC 4511 4.2.1: all outstanding operations must complete before a
+			// bind is processed, and no new ones are read until it is done
+			conn.wait()
 			server.Stats.countBinds(1)
-			ldapResultCode := HandleBindRequest(ctx, req, server.BindFns, conn)
-			if ldapResultCode == LDAPResultSuccess {
-				boundDN, ok = req.Children[1].Value.(string)
-				if !ok {
-					Log.Printf("Malformed Bind DN")
-					break handler
+			var ldapResultCode LDAPResultCode
+			var serverSaslCreds []byte
+			if len(req.Children) == 3 && req.Children[2].Tag == LDAPBindAuthSASL {
+				var dn string
+				ldapResultCode, serverSaslCreds, dn = HandleSASLBindRequest(ctx, req, server, conn)
+				if ldapResultCode == LDAPResultSuccess {
+					boundDN = dn
+				}
+			} else {
+				// any other bind aborts a SASL exchange in progress
+				conn.sasl = nil
+				ldapResultCode = handleBindRequest(ctx, req, server, conn)
+				if ldapResultCode == LDAPResultSuccess {
+					boundDN, ok = req.Children[1].Value.(string)
+					if !ok {
+						Log.Printf("Malformed Bind DN")
+						break handler
+					}
 				}
 			}
-			responsePacket := encodeBindResponse(messageID, ldapResultCode)
-			if err = sendPacket(conn, responsePacket); err != nil {
+			responsePacket := encodeBindResponse(messageID, ldapResultCode, serverSaslCreds)
+			err = sendPacket(conn, responsePacket)
+			untrack()
+			if err != nil {
 				Log.Printf("sendPacket error %s", err.Error())
 				break handler
 			}
 		case ApplicationSearchRequest:
 			server.Stats.countSearches(1)
-			if err := HandleSearchRequest(ctx, req, &controls, messageID, boundDN, server, conn); err != nil {
-				Log.Printf("handleSearchRequest error %s", err.Error()) // TODO: make this more testable/better err handling - stop using Log, stop using breaks?
-				e := err.(*Error)
-				if err = sendPacket(conn, encodeSearchDone(messageID, e.ResultCode)); err != nil {
-					Log.Printf("sendPacket error %s", err.Error())
-					break handler
-				}
-				break handler
-			} else {
-				if err = sendPacket(conn, encodeSearchDone(messageID, LDAPResultSuccess)); err != nil {
-					Log.Printf("sendPacket error %s", err.Error())
-					break handler
+			searchCtx := context.WithValue(opCtx, criticalControlsKey{}, critical)
+			conn.dispatch(searchCtx, messageID, func(ctx context.Context) {
+				searchResp, err := handleSearchRequest(ctx, req, &controls, messageID, boundDN, server, conn)
+				if err != nil {
+					Log.Printf("handleSearchRequest error %s", err.Error()) // TODO: make this more testable/better err handling - stop using Log, stop using breaks?
+					var code LDAPResultCode = LDAPResultOperationsError
+					var e *Error
+					if errors.As(err, &e) {
+						code = e.ResultCode
+					}
+					searchResp = ServerSearchResult{ResultCode: code, Controls: searchResp.Controls}
 				}
-			}
+				respond(ctx, conn, encodeSearchDone(messageID, searchResp))
+			})
 		case ApplicationUnbindRequest:
 			server.Stats.countUnbinds(1)
 			break handler // simply disconnect
 		case ApplicationExtendedRequest:
-			if len(req.Children) == 1 {
-				name := ber.DecodeString(req.Children[0].Data.Bytes())
-				if name == "1.3.6.1.4.1.1466.20037" && server.StartTLS != nil && !connectionTLSActive {
-					responseType := uint8(ApplicationExtendedResponse)
-					// start tls
-					// Log.Println("START_TLS")
-					// ber.PrintPacket(req)
-					ldapResultCode := LDAPResultCode(LDAPResultSuccess)
-					responsePacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
-					responsePacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
-					response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(responseType), nil, ApplicationMap[ber.Tag(responseType)])
-					response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldapResultCode), "resultCode: "))
-					response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN: "))
-					response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "errorMessage: "))
-					// No clue what 0x8a is, seems to be correct from testing
-					// value taken from looking at Samba's StartTLS via wireshark
-					response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, 0x8a, name, "responseName: "))
-					responsePacket.AppendChild(response)
-					// Log.Println("START_TLS response")
-					// ber.PrintPacket(responsePacket)
-					if err = sendPacket(conn, responsePacket); err != nil {
-						Log.Printf("sendPacket error %s", err.Error())
-						break handler
-					}
+			if len(req.Children) > 0 && ber.DecodeString(req.Children[0].Data.Bytes()) == ExtendedOperationStartTLS {
+				untrack := conn.track(messageID)
+				// RFC 4511 4.14.1: StartTLS is only processed once every
+				// outstanding operation has completed
+				conn.wait()
+				res := ExtendedResponse{ResultCode: LDAPResultSuccess, Name: ExtendedOperationStartTLS}
+				switch {
+				case server.StartTLS == nil:
+					res.ResultCode, res.Diagnostic = LDAPResultProtocolError, "StartTLS is not supported"
+				case connectionTLSActive:
+					res.ResultCode, res.Diagnostic = LDAPResultOperationsError, "TLS is already established"
+				}
+				err = sendPacket(conn, encodeExtendedResponse(messageID, res))
+				if err == nil && res.ResultCode == LDAPResultSuccess {
 					connectionTLSActive = true
-					conn = tls.Server(conn, server.StartTLS)
-					break
+					conn.setConn(tls.Server(conn.Conn, server.StartTLS))
+				}
+				untrack()
+				if err != nil {
+					Log.Printf("sendPacket error %s", err.Error())
+					break handler
 				}
+				break
 			}
-			ldapResultCode := HandleExtendedRequest(ctx, req, boundDN, server.ExtendedFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationExtendedResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				Log.Printf("sendPacket error %s", err.Error())
-				break handler
+			if len(req.Children) > 0 && ber.DecodeString(req.Children[0].Data.Bytes()) == ExtendedOperationCancel {
+				conn.dispatchUncancelable(opCtx, messageID, func(ctx context.Context) {
+					respond(ctx, conn, encodeExtendedResponse(messageID, HandleCancelRequest(ctx, req, conn)))
+				})
+				break
 			}
+			conn.dispatch(opCtx, messageID, func(ctx context.Context) {
+				var res ExtendedResponse
+				if len(req.Children) > 0 && ber.DecodeString(req.Children[0].Data.Bytes()) == ExtendedOperationPasswordModify {
+					res = HandlePasswordModifyRequest(ctx, req, boundDN, server, conn)
+				} else {
+					res = handleExtendedRequest(ctx, req, &controls, boundDN, server, conn)
+				}
+				respond(ctx, conn, encodeExtendedResponse(messageID, res))
+			})
 		case ApplicationAbandonRequest:
-			HandleAbandonRequest(ctx, req, boundDN, server.AbandonFns, conn)
-			break handler
+			// there is no response to an abandon request, whatever the outcome
+			untrack := conn.track(messageID)
+			if err := handleAbandonRequest(ctx, req, boundDN, server, conn); err != nil {
+				Log.Printf("AbandonFn Error %s", err.Error())
+			}
+			untrack()
 
 		case ApplicationAddRequest:
-			ldapResultCode := HandleAddRequest(ctx, req, boundDN, server.AddFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationAddResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				Log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			conn.dispatch(opCtx, messageID, func(ctx context.Context) {
+				ldapResultCode, referrals := handleAddRequest(ctx, req, boundDN, server, conn)
+				respond(ctx, conn, encodeLDAPResponse(messageID, ApplicationAddResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode], referrals...))
+			})
 		case ApplicationModifyRequest:
-			ldapResultCode := HandleModifyRequest(ctx, req, boundDN, server.ModifyFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationModifyResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				Log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			conn.dispatch(opCtx, messageID, func(ctx context.Context) {
+				ldapResultCode, referrals := handleModifyRequest(ctx, req, boundDN, server, conn)
+				respond(ctx, conn, encodeLDAPResponse(messageID, ApplicationModifyResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode], referrals...))
+			})
 		case ApplicationDelRequest:
-			ldapResultCode := HandleDeleteRequest(ctx, req, boundDN, server.DeleteFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationDelResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				Log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			conn.dispatch(opCtx, messageID, func(ctx context.Context) {
+				ldapResultCode, referrals := handleDeleteRequest(ctx, req, boundDN, server, conn)
+				respond(ctx, conn, encodeLDAPResponse(messageID, ApplicationDelResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode], referrals...))
+			})
 		case ApplicationModifyDNRequest:
-			ldapResultCode := HandleModifyDNRequest(ctx, req, boundDN, server.ModifyDNFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationModifyDNResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				Log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			conn.dispatch(opCtx, messageID, func(ctx context.Context) {
+				ldapResultCode, referrals := handleModifyDNRequest(ctx, req, boundDN, server, conn)
+				respond(ctx, conn, encodeLDAPResponse(messageID, ApplicationModifyDNResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode], referrals...))
+			})
 		case ApplicationCompareRequest:
-			ldapResultCode := HandleCompareRequest(ctx, req, boundDN, server.CompareFns, conn)
-			responsePacket := encodeLDAPResponse(messageID, ApplicationCompareResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode])
-			if err = sendPacket(conn, responsePacket); err != nil {
-				Log.Printf("sendPacket error %s", err.Error())
-				break handler
-			}
+			conn.dispatch(opCtx, messageID, func(ctx context.Context) {
+				ldapResultCode, referrals := handleCompareRequest(ctx, req, boundDN, server, conn)
+				respond(ctx, conn, encodeLDAPResponse(messageID, ApplicationCompareResponse, ldapResultCode, LDAPResultCodeMap[ldapResultCode], referrals...))
+			})
 		}
 	}
 
+	// abandon whatever is still running and let it wind down before closing
+	cancelOps()
+	conn.wait()
+	conn.releaseCursors(0, true)
+
 	for _, c := range server.CloseFns {
 		c.Close(ctx, boundDN, conn)
 	}
@@ -439,6 +597,24 @@ handler:
 	conn.Close()
 }
 
+// respond sends the final response of an operation running in its own
+// goroutine. A cancelled operation answers with canceled instead; otherwise
+// nothing is sent once the operation's context is done: it was either
+// abandoned or the connection is going away. A failed write closes the
+// connection, which stops the read loop.
+func respond(ctx context.Context, conn net.Conn, packet *ber.Packet) {
+	if op, ok := ctx.Value(operationKey{}).(*operation); ok && op.finish() {
+		// a cancelled operation still answers, with canceled as its result
+		packet = encodeLDAPResponse(op.messageID, uint8(packet.Children[1].Tag), LDAPResultCanceled, LDAPResultCodeMap[LDAPResultCanceled])
+	} else if ctx.Err() != nil {
+		return
+	}
+	if err := sendPacket(conn, packet); err != nil {
+		Log.Printf("sendPacket error %s", err.Error())
+		conn.Close()
+	}
+}
+
 func sendPacket(conn net.Conn, packet *ber.Packet) error {
 	_, err := conn.Write(packet.Bytes())
 	if err != nil {
@@ -448,35 +624,18 @@ func sendPacket(conn net.Conn, packet *ber.Packet) error {
 	return nil
 }
 
-func routeFunc(dn string, funcNames []string) string {
-	bestPick := ""
-	bestPickWeight := 0
-	dnMatch := "," + strings.ToLower(dn)
-	var weight int
-	for _, fn := range funcNames {
-		if strings.HasSuffix(dnMatch, ","+fn) {
-			//  empty string as 0, no-comma string 1 , etc
-			if fn == "" {
-				weight = 0
-			} else {
-				weight = strings.Count(fn, ",") + 1
-			}
-			if weight > bestPickWeight {
-				bestPick = fn
-				bestPickWeight = weight
-			}
-		}
-	}
-	return bestPick
-}
-
-func encodeLDAPResponse(messageID uint64, responseType uint8, ldapResultCode LDAPResultCode, message string) *ber.Packet {
+// encodeLDAPResponse encodes an LDAPResult response, with the referral URLs
+// when any are given for LDAPResultReferral.
+func encodeLDAPResponse(messageID uint64, responseType uint8, ldapResultCode LDAPResultCode, message string, referrals ...string) *ber.Packet {
 	responsePacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
 	responsePacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
 	reponse := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(responseType), nil, ApplicationMap[ber.Tag(responseType)])
 	reponse.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldapResultCode), "resultCode: "))
 	reponse.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN: "))
 	reponse.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "errorMessage: "))
+	if ldapResultCode == LDAPResultReferral && len(referrals) > 0 {
+		reponse.AppendChild(encodeReferral(referrals))
+	}
 	responsePacket.AppendChild(reponse)
 	return responsePacket
 }
@@ -511,12 +670,23 @@ func (h defaultHandler) Compare(ctx context.Context, boundDN string, req Compare
 	return LDAPResultInsufficientAccessRights, nil
 }
 
-func (h defaultHandler) Abandon(ctx context.Context, boundDN string, conn net.Conn) error {
+func (h defaultHandler) Abandon(ctx context.Context, boundDN string, messageID uint64, conn net.Conn) error {
 	return nil
 }
 
-func (h defaultHandler) Extended(ctx context.Context, boundDN string, req ExtendedRequest, conn net.Conn) (LDAPResultCode, error) {
-	return LDAPResultProtocolError, nil
+// Extended answers the extended operations the server implements natively.
+// Registering an Extender for a baseDN overrides them for the clients bound
+// under it.
+func (h defaultHandler) Extended(ctx context.Context, boundDN string, req ExtendedRequest, conn net.Conn) (ExtendedResponse, error) {
+	switch req.Name {
+	case ExtendedOperationWhoAmI:
+		return whoAmI(boundDN, req), nil
+	}
+	return ExtendedResponse{ResultCode: LDAPResultProtocolError}, nil
+}
+
+func (h defaultHandler) PasswordModify(ctx context.Context, boundDN string, req PasswordModifyRequest, conn net.Conn) (string, LDAPResultCode, error) {
+	return "", LDAPResultInsufficientAccessRights, nil
 }
 
 func (h defaultHandler) Unbind(ctx context.Context, boundDN string, conn net.Conn) (LDAPResultCode, error) {
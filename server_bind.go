@@ -7,7 +7,13 @@ import (
 	ber "github.com/go-asn1-ber/asn1-ber"
 )
 
+// HandleBindRequest runs a simple bind on the handler of fns routed by the
+// bind DN.
 func HandleBindRequest(ctx context.Context, req *ber.Packet, fns map[string]Binder, conn net.Conn) (resultCode LDAPResultCode) {
+	return handleBindRequest(ctx, req, &Server{BindFns: fns}, conn)
+}
+
+func handleBindRequest(ctx context.Context, req *ber.Packet, server *Server, conn net.Conn) (resultCode LDAPResultCode) {
 	defer func() {
 		if r := recover(); r != nil {
 			resultCode = LDAPResultOperationsError
@@ -36,12 +42,11 @@ func HandleBindRequest(ctx context.Context, req *ber.Packet, fns map[string]Bind
 		return LDAPResultInappropriateAuthentication
 	case LDAPBindAuthSimple:
 		if len(req.Children) == 3 {
-			fnNames := []string{}
-			for k := range fns {
-				fnNames = append(fnNames, k)
+			var handler Binder = defaultHandler{}
+			if fn, ok := route(server, "bind", server.BindFns, bindDN); ok {
+				handler = server.BindFns[fn]
 			}
-			fn := routeFunc(bindDN, fnNames)
-			resultCode, err := fns[fn].Bind(ctx, bindDN, bindAuth.Data.String(), conn)
+			resultCode, err := handler.Bind(ctx, bindDN, bindAuth.Data.String(), conn)
 			if err != nil {
 				Log.Printf("BindFn Error %s", err.Error())
 				return LDAPResultOperationsError
@@ -52,12 +57,13 @@ func HandleBindRequest(ctx context.Context, req *ber.Packet, fns map[string]Bind
 			return LDAPResultInappropriateAuthentication
 		}
 	case LDAPBindAuthSASL:
-		Log.Print("SASL authentication is not supported")
+		// SASL binds need the server's mechanisms, see HandleSASLBindRequest
+		Log.Print("SASL authentication is not supported here")
 		return LDAPResultInappropriateAuthentication
 	}
 }
 
-func encodeBindResponse(messageID uint64, ldapResultCode LDAPResultCode) *ber.Packet {
+func encodeBindResponse(messageID uint64, ldapResultCode LDAPResultCode, serverSaslCreds []byte) *ber.Packet {
 	responsePacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
 	responsePacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
 
@@ -65,6 +71,9 @@ func encodeBindResponse(messageID uint64, ldapResultCode LDAPResultCode) *ber.Pa
 	bindReponse.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldapResultCode), "resultCode: "))
 	bindReponse.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN: "))
 	bindReponse.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "errorMessage: "))
+	if serverSaslCreds != nil {
+		bindReponse.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 7, string(serverSaslCreds), "serverSaslCreds"))
+	}
 
 	responsePacket.AppendChild(bindReponse)
 
@@ -0,0 +1,324 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// serverConn wraps an accepted connection with the state needed to process its
+// operations concurrently. It is what handlers receive as their net.Conn: writes
+// are serialized so the responses of concurrent operations never interleave.
+type serverConn struct {
+	net.Conn
+	writeMu sync.Mutex
+
+	mu    sync.Mutex
+	ops   map[uint64]*operation
+	wg    sync.WaitGroup
+	slots chan struct{}
+
+	// cursors holds the state of paged searches between two pages, keyed by
+	// the cookie handed to the client, at most maxCursors of them.
+	cursors    map[string]*searchCursor
+	nextCursor uint64
+
+	// sasl is the SASL bind in progress. Binds are processed one at a time
+	// by the connection's reader, which alone touches it.
+	sasl *saslExchange
+}
+
+// operation is a request currently being processed on a connection.
+type operation struct {
+	messageID uint64
+	cancel    context.CancelFunc
+	// cancelable is false for operations the Cancel operation cannot stop
+	cancelable bool
+	// done is closed once the operation has returned
+	done chan struct{}
+
+	mu    sync.Mutex
+	state operationState
+}
+
+type operationState int
+
+const (
+	operationRunning operationState = iota
+	// operationResponded: the final response is being sent, too late to cancel
+	operationResponded
+	// operationCanceled: the operation must answer with canceled
+	operationCanceled
+)
+
+type operationKey struct{}
+
+// finish marks op as responding and reports whether it was cancelled first.
+func (op *operation) finish() bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.state == operationCanceled {
+		return true
+	}
+	op.state = operationResponded
+	return false
+}
+
+func newServerConn(conn net.Conn, maxOutstanding int) *serverConn {
+	c := &serverConn{Conn: conn, ops: make(map[uint64]*operation), cursors: make(map[string]*searchCursor)}
+	if maxOutstanding > 0 {
+		c.slots = make(chan struct{}, maxOutstanding)
+	}
+	return c
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// setConn swaps the underlying connection, e.g. after a StartTLS handshake.
+// It must only be called while no operation is in flight.
+func (c *serverConn) setConn(conn net.Conn) {
+	c.writeMu.Lock()
+	c.Conn = conn
+	c.writeMu.Unlock()
+}
+
+// TLSConnectionState returns the TLS state of a connection handed to a
+// handler, once it is secured by LDAPS or StartTLS.
+func TLSConnectionState(conn net.Conn) (tls.ConnectionState, bool) {
+	if c, ok := conn.(*serverConn); ok {
+		c.writeMu.Lock()
+		conn = c.Conn
+		c.writeMu.Unlock()
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		return c.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// dispatch runs fn in its own goroutine and tracks it in the in-flight table
+// under messageID until it returns. When the connection already has
+// MaxOutstanding operations in flight, dispatch blocks until one completes,
+// which stops the connection from reading further requests.
+func (c *serverConn) dispatch(ctx context.Context, messageID uint64, fn func(ctx context.Context)) bool {
+	return c.start(ctx, &operation{messageID: messageID, cancelable: true}, fn)
+}
+
+// dispatchUncancelable is dispatch for operations the Cancel operation must
+// not stop, such as Cancel itself.
+func (c *serverConn) dispatchUncancelable(ctx context.Context, messageID uint64, fn func(ctx context.Context)) bool {
+	return c.start(ctx, &operation{messageID: messageID}, fn)
+}
+
+// track registers the operation messageID, which the connection's reader
+// processes itself, such as Bind, StartTLS and Abandon, as in flight until the
+// returned function is called. The Cancel operation cannot stop it.
+func (c *serverConn) track(messageID uint64) func() {
+	op := &operation{messageID: messageID, cancel: func() {}, done: make(chan struct{})}
+	c.mu.Lock()
+	if _, ok := c.ops[messageID]; !ok {
+		c.ops[messageID] = op
+	}
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		if c.ops[messageID] == op {
+			delete(c.ops, messageID)
+		}
+		c.mu.Unlock()
+		close(op.done)
+	}
+}
+
+func (c *serverConn) start(ctx context.Context, op *operation, fn func(ctx context.Context)) bool {
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, operationKey{}, op))
+	op.cancel = cancel
+	op.done = make(chan struct{})
+	c.mu.Lock()
+	c.ops[op.messageID] = op
+	c.mu.Unlock()
+	c.wg.Add(1)
+	go func() {
+		defer func() {
+			cancel()
+			c.mu.Lock()
+			if c.ops[op.messageID] == op {
+				delete(c.ops, op.messageID)
+			}
+			c.mu.Unlock()
+			close(op.done)
+			if c.slots != nil {
+				<-c.slots
+			}
+			c.wg.Done()
+		}()
+		fn(ctx)
+	}()
+	return true
+}
+
+// inFlight reports whether the operation messageID is still being processed.
+// Operations sending their response are not: the client may reuse their
+// message ID as soon as it gets it.
+func (c *serverConn) inFlight(messageID uint64) bool {
+	c.mu.Lock()
+	op, ok := c.ops[messageID]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.state == operationRunning
+}
+
+// abandon cancels the context of the in-flight operation messageID, which also
+// suppresses any further response to it, and releases the paged search it
+// requested a page of. It reports whether such an operation was found: the
+// message IDs of completed operations may already be reused by the client, so
+// abandoning them releases nothing.
+func (c *serverConn) abandon(messageID uint64) bool {
+	c.mu.Lock()
+	op, ok := c.ops[messageID]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	op.cancel()
+	c.releaseCursors(messageID, false)
+	return true
+}
+
+// cancelOperation stops the in-flight operation messageID so that it answers
+// with canceled, and waits for it to return. The result code is the one of the
+// Cancel operation (RFC 3909).
+func (c *serverConn) cancelOperation(messageID uint64) LDAPResultCode {
+	c.mu.Lock()
+	op, ok := c.ops[messageID]
+	c.mu.Unlock()
+	if !ok {
+		return LDAPResultNoSuchOperation
+	}
+	if !op.cancelable {
+		return LDAPResultCannotCancel
+	}
+	op.mu.Lock()
+	if op.state == operationResponded {
+		op.mu.Unlock()
+		return LDAPResultTooLate
+	}
+	op.state = operationCanceled
+	op.mu.Unlock()
+	op.cancel()
+	<-op.done
+	return LDAPResultSuccess
+}
+
+// wait blocks until every in-flight operation has completed.
+func (c *serverConn) wait() {
+	c.wg.Wait()
+}
+
+// maxCursors is how many paged searches a connection keeps waiting for their
+// next page: saving one more releases the oldest. cursorTimeout is how long
+// they wait.
+const (
+	maxCursors    = 16
+	cursorTimeout = 10 * time.Minute
+)
+
+// saveCursor stores cursor until the next page of its search is requested and
+// returns the cookie identifying it. The cursor is released instead when the
+// operation of ctx, the page that saves it, was abandoned.
+func (c *serverConn) saveCursor(ctx context.Context, cursor *searchCursor) []byte {
+	if ctx.Err() != nil {
+		cursor.close()
+		return nil
+	}
+	cursor.saved = time.Now()
+	if op, ok := ctx.Value(operationKey{}).(*operation); ok {
+		cursor.messageID = op.messageID
+	}
+	c.mu.Lock()
+	released := c.expireCursors(cursor.saved)
+	if len(c.cursors) >= maxCursors {
+		oldest := ""
+		for cookie, cursor := range c.cursors {
+			if oldest == "" || cursor.saved.Before(c.cursors[oldest].saved) {
+				oldest = cookie
+			}
+		}
+		released = append(released, c.cursors[oldest])
+		delete(c.cursors, oldest)
+	}
+	c.nextCursor++
+	cookie := strconv.FormatUint(c.nextCursor, 10)
+	c.cursors[cookie] = cursor
+	c.mu.Unlock()
+	closeCursors(released)
+	return []byte(cookie)
+}
+
+// takeCursor removes and returns the cursor identified by cookie, or nil if
+// there is none for the given search. A cookie is only valid for a single page.
+func (c *serverConn) takeCursor(cookie []byte, search string) *searchCursor {
+	c.mu.Lock()
+	released := c.expireCursors(time.Now())
+	cursor, ok := c.cursors[string(cookie)]
+	if ok && cursor.search == search {
+		delete(c.cursors, string(cookie))
+	} else {
+		cursor = nil
+	}
+	c.mu.Unlock()
+	closeCursors(released)
+	return cursor
+}
+
+// releaseCursors releases the cursors saved by the page requested by
+// messageID, or every cursor when all is set.
+func (c *serverConn) releaseCursors(messageID uint64, all bool) {
+	var released []*searchCursor
+	c.mu.Lock()
+	for cookie, cursor := range c.cursors {
+		if all || cursor.messageID == messageID {
+			released = append(released, cursor)
+			delete(c.cursors, cookie)
+		}
+	}
+	c.mu.Unlock()
+	closeCursors(released)
+}
+
+// expireCursors removes the cursors that waited for longer than
+// cursorTimeout and returns them. c.mu must be held.
+func (c *serverConn) expireCursors(now time.Time) []*searchCursor {
+	var expired []*searchCursor
+	for cookie, cursor := range c.cursors {
+		if now.Sub(cursor.saved) > cursorTimeout {
+			expired = append(expired, cursor)
+			delete(c.cursors, cookie)
+		}
+	}
+	return expired
+}
+
+func closeCursors(cursors []*searchCursor) {
+	for _, cursor := range cursors {
+		cursor.close()
+	}
+}
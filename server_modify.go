@@ -2,108 +2,128 @@ package ldap
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
 )
 
+// HandleAddRequest runs an Add operation on the handler of fns routed by
+// the DN of the new entry.
 func HandleAddRequest(ctx context.Context, req *ber.Packet, boundDN string, fns map[string]Adder, conn net.Conn) (resultCode LDAPResultCode) {
+	resultCode, _ = handleAddRequest(ctx, req, boundDN, &Server{AddFns: fns}, conn)
+	return resultCode
+}
+
+func handleAddRequest(ctx context.Context, req *ber.Packet, boundDN string, server *Server, conn net.Conn) (resultCode LDAPResultCode, referrals []string) {
 	if len(req.Children) != 2 {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	var ok bool
 	addReq := AddRequest{}
 	addReq.DN, ok = req.Children[0].Value.(string)
 	if !ok {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	addReq.Attributes = []Attribute{}
 	for _, attr := range req.Children[1].Children {
 		if len(attr.Children) != 2 {
-			return LDAPResultProtocolError
+			return LDAPResultProtocolError, nil
 		}
 
 		a := Attribute{}
 		a.Type, ok = attr.Children[0].Value.(string)
 		if !ok {
-			return LDAPResultProtocolError
+			return LDAPResultProtocolError, nil
 		}
 		a.Vals = []string{}
 		for _, val := range attr.Children[1].Children {
 			v, ok := val.Value.(string)
 			if !ok {
-				return LDAPResultProtocolError
+				return LDAPResultProtocolError, nil
 			}
 			a.Vals = append(a.Vals, v)
 		}
 		addReq.Attributes = append(addReq.Attributes, a)
 	}
-	fnNames := []string{}
-	for k := range fns {
-		fnNames = append(fnNames, k)
+	fn, ok := route(server, "add", server.AddFns, addReq.DN)
+	if !ok {
+		return server.unrouted(addReq.DN)
 	}
-	fn := routeFunc(boundDN, fnNames)
-	resultCode, err := fns[fn].Add(ctx, boundDN, addReq, conn)
+	resultCode, err := server.AddFns[fn].Add(ctx, boundDN, addReq, conn)
 	if err != nil {
-		Log.Printf("AddFn Error %s", err.Error())
-		return LDAPResultOperationsError
+		return handlerError("AddFn", err)
 	}
-	return resultCode
+	return resultCode, nil
 }
 
+// HandleDeleteRequest runs a Delete operation on the handler of fns routed by
+// the deleted DN.
 func HandleDeleteRequest(ctx context.Context, req *ber.Packet, boundDN string, fns map[string]Deleter, conn net.Conn) (resultCode LDAPResultCode) {
+	resultCode, _ = handleDeleteRequest(ctx, req, boundDN, &Server{DeleteFns: fns}, conn)
+	return resultCode
+}
+
+func handleDeleteRequest(ctx context.Context, req *ber.Packet, boundDN string, server *Server, conn net.Conn) (resultCode LDAPResultCode, referrals []string) {
 	deleteDN := ber.DecodeString(req.Data.Bytes())
-	fnNames := []string{}
-	for k := range fns {
-		fnNames = append(fnNames, k)
+	fn, ok := route(server, "delete", server.DeleteFns, deleteDN)
+	if !ok {
+		return server.unrouted(deleteDN)
 	}
-	fn := routeFunc(boundDN, fnNames)
-	resultCode, err := fns[fn].Delete(ctx, boundDN, deleteDN, conn)
+	resultCode, err := server.DeleteFns[fn].Delete(ctx, boundDN, deleteDN, conn)
 	if err != nil {
-		Log.Printf("DeleteFn Error %s", err.Error())
-		return LDAPResultOperationsError
+		return handlerError("DeleteFn", err)
 	}
-	return resultCode
+	return resultCode, nil
 }
 
+// HandleModifyRequest runs a Modify operation on the handler of fns routed by
+// the modified DN.
 func HandleModifyRequest(ctx context.Context, req *ber.Packet, boundDN string, fns map[string]Modifier, conn net.Conn) (resultCode LDAPResultCode) {
+	resultCode, _ = handleModifyRequest(ctx, req, boundDN, &Server{ModifyFns: fns}, conn)
+	return resultCode
+}
+
+func handleModifyRequest(ctx context.Context, req *ber.Packet, boundDN string, server *Server, conn net.Conn) (resultCode LDAPResultCode, referrals []string) {
 	if len(req.Children) != 2 {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	var ok bool
 	modReq := ModifyRequest{}
 	modReq.DN, ok = req.Children[0].Value.(string)
 	if !ok {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	for _, change := range req.Children[1].Children {
 		if len(change.Children) != 2 {
-			return LDAPResultProtocolError
+			return LDAPResultProtocolError, nil
 		}
 		attr := PartialAttribute{}
 		attrs := change.Children[1].Children
 		if len(attrs) != 2 {
-			return LDAPResultProtocolError
+			return LDAPResultProtocolError, nil
 		}
 		attr.Type, ok = attrs[0].Value.(string)
 		if !ok {
-			return LDAPResultProtocolError
+			return LDAPResultProtocolError, nil
 		}
 		for _, val := range attrs[1].Children {
 			v, ok := val.Value.(string)
 			if !ok {
-				return LDAPResultProtocolError
+				return LDAPResultProtocolError, nil
 			}
 			attr.Vals = append(attr.Vals, v)
 		}
 		op, ok := change.Children[0].Value.(int64)
 		if !ok {
-			return LDAPResultProtocolError
+			return LDAPResultProtocolError, nil
 		}
 		switch op {
 		default:
 			Log.Printf("Unrecognized Modify attribute %d", op)
-			return LDAPResultProtocolError
+			return LDAPResultProtocolError, nil
 		case AddAttribute:
 			modReq.Add(attr.Type, attr.Vals)
 		case DeleteAttribute:
@@ -112,120 +132,303 @@ func HandleModifyRequest(ctx context.Context, req *ber.Packet, boundDN string, f
 			modReq.Replace(attr.Type, attr.Vals)
 		}
 	}
-	fnNames := []string{}
-	for k := range fns {
-		fnNames = append(fnNames, k)
+	fn, ok := route(server, "modify", server.ModifyFns, modReq.DN)
+	if !ok {
+		return server.unrouted(modReq.DN)
 	}
-	fn := routeFunc(boundDN, fnNames)
-	resultCode, err := fns[fn].Modify(ctx, boundDN, modReq, conn)
+	resultCode, err := server.ModifyFns[fn].Modify(ctx, boundDN, modReq, conn)
 	if err != nil {
-		Log.Printf("ModifyFn Error %s", err.Error())
-		return LDAPResultOperationsError
+		return handlerError("ModifyFn", err)
 	}
-	return resultCode
+	return resultCode, nil
 }
 
+// HandleCompareRequest runs a Compare operation on the handler of fns routed by
+// the compared DN.
 func HandleCompareRequest(ctx context.Context, req *ber.Packet, boundDN string, fns map[string]Comparer, conn net.Conn) (resultCode LDAPResultCode) {
+	resultCode, _ = handleCompareRequest(ctx, req, boundDN, &Server{CompareFns: fns}, conn)
+	return resultCode
+}
+
+func handleCompareRequest(ctx context.Context, req *ber.Packet, boundDN string, server *Server, conn net.Conn) (resultCode LDAPResultCode, referrals []string) {
 	if len(req.Children) != 2 {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	var ok bool
 	compReq := CompareRequest{}
 	compReq.DN, ok = req.Children[0].Value.(string)
 	if !ok {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	ava := req.Children[1]
 	if len(ava.Children) != 2 {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	compReq.Attribute, ok = ava.Children[0].Value.(string)
 	if !ok {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	compReq.Value, ok = ava.Children[1].Value.(string)
 	if !ok {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
-	fnNames := []string{}
-	for k := range fns {
-		fnNames = append(fnNames, k)
+	fn, ok := route(server, "compare", server.CompareFns, compReq.DN)
+	if !ok {
+		return server.unrouted(compReq.DN)
 	}
-	fn := routeFunc(boundDN, fnNames)
-	resultCode, err := fns[fn].Compare(ctx, boundDN, compReq, conn)
+	resultCode, err := server.CompareFns[fn].Compare(ctx, boundDN, compReq, conn)
 	if err != nil {
-		Log.Printf("CompareFn Error %s", err.Error())
-		return LDAPResultOperationsError
+		return handlerError("CompareFn", err)
 	}
-	return resultCode
+	return resultCode, nil
 }
 
+// HandleExtendedRequest runs an extended operation on the handler of fns
+// routed by boundDN and returns the result code of its response.
 func HandleExtendedRequest(ctx context.Context, req *ber.Packet, boundDN string, fns map[string]Extender, conn net.Conn) (resultCode LDAPResultCode) {
+	return handleExtendedRequest(ctx, req, &[]Control{}, boundDN, &Server{ExtendedFns: fns}, conn).ResultCode
+}
+
+// handleExtendedRequest runs an extended operation on the handler routed by
+// boundDN and returns the response to send.
+func handleExtendedRequest(ctx context.Context, req *ber.Packet, controls *[]Control, boundDN string, server *Server, conn net.Conn) (res ExtendedResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = ExtendedResponse{ResultCode: LDAPResultOperationsError, Diagnostic: fmt.Sprintf("Extended function panic: %s", r)}
+		}
+	}()
 	if len(req.Children) != 1 && len(req.Children) != 2 {
-		return LDAPResultProtocolError
+		return ExtendedResponse{ResultCode: LDAPResultProtocolError}
 	}
-	name := ber.DecodeString(req.Children[0].Data.Bytes())
-	var val string
+	extReq := ExtendedRequest{Name: ber.DecodeString(req.Children[0].Data.Bytes()), Controls: *controls}
 	if len(req.Children) == 2 {
-		val = ber.DecodeString(req.Children[1].Data.Bytes())
+		extReq.Value = append([]byte{}, req.Children[1].Data.Bytes()...)
 	}
-	extReq := ExtendedRequest{name, val}
-	fnNames := []string{}
-	for k := range fns {
-		fnNames = append(fnNames, k)
+	var handler Extender = defaultHandler{}
+	if fn, ok := route(server, "extended", server.ExtendedFns, boundDN); ok {
+		handler = server.ExtendedFns[fn]
 	}
-	fn := routeFunc(boundDN, fnNames)
-	resultCode, err := fns[fn].Extended(ctx, boundDN, extReq, conn)
+	res, err := handler.Extended(ctx, boundDN, extReq, conn)
 	if err != nil {
 		Log.Printf("ExtendedFn Error %s", err.Error())
-		return LDAPResultOperationsError
+		var e *Error
+		if errors.As(err, &e) {
+			return ExtendedResponse{ResultCode: e.ResultCode, Diagnostic: e.Err.Error()}
+		}
+		return ExtendedResponse{ResultCode: LDAPResultOperationsError}
 	}
-	return resultCode
+	return res
+}
+
+// HandlePasswordModifyRequest runs a Password Modify extended operation on the
+// handler routed by the DN whose password changes.
+func HandlePasswordModifyRequest(ctx context.Context, req *ber.Packet, boundDN string, server *Server, conn net.Conn) (res ExtendedResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = ExtendedResponse{ResultCode: LDAPResultOperationsError, Diagnostic: fmt.Sprintf("PasswordModify function panic: %s", r)}
+		}
+	}()
+	// PasswdModifyRequestValue ::= SEQUENCE {
+	//     userIdentity    [0]  OCTET STRING OPTIONAL
+	//     oldPasswd       [1]  OCTET STRING OPTIONAL
+	//     newPasswd       [2]  OCTET STRING OPTIONAL }
+	pwReq := PasswordModifyRequest{UserIdentity: boundDN}
+	if len(req.Children) == 2 {
+		value, err := ber.DecodePacketErr(req.Children[1].Data.Bytes())
+		if err != nil {
+			return ExtendedResponse{ResultCode: LDAPResultProtocolError, Diagnostic: err.Error()}
+		}
+		for _, child := range value.Children {
+			switch child.Tag {
+			case 0:
+				pwReq.UserIdentity = ber.DecodeString(child.Data.Bytes())
+			case 1:
+				pwReq.OldPassword = ber.DecodeString(child.Data.Bytes())
+			case 2:
+				pwReq.NewPassword = ber.DecodeString(child.Data.Bytes())
+			default:
+				return ExtendedResponse{ResultCode: LDAPResultProtocolError, Diagnostic: "malformed Password Modify request"}
+			}
+		}
+	}
+	if pwReq.UserIdentity == "" {
+		return ExtendedResponse{ResultCode: LDAPResultUnwillingToPerform, Diagnostic: "no user to change the password of"}
+	}
+
+	var handler PasswordModifier = defaultHandler{}
+	if fn, ok := route(server, "passwordModify", server.PasswordModifyFns, strings.TrimPrefix(pwReq.UserIdentity, "dn:")); ok {
+		handler = server.PasswordModifyFns[fn]
+	}
+	genPassword, resultCode, err := handler.PasswordModify(ctx, boundDN, pwReq, conn)
+	if err != nil {
+		Log.Printf("PasswordModifyFn Error %s", err.Error())
+		var e *Error
+		if errors.As(err, &e) {
+			return ExtendedResponse{ResultCode: e.ResultCode, Diagnostic: e.Err.Error()}
+		}
+		return ExtendedResponse{ResultCode: LDAPResultOperationsError}
+	}
+	res = ExtendedResponse{ResultCode: resultCode}
+	if resultCode == LDAPResultSuccess && genPassword != "" {
+		// PasswdModifyResponseValue ::= SEQUENCE {
+		//     genPasswd       [0]     OCTET STRING OPTIONAL }
+		value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "PasswdModifyResponseValue")
+		value.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, genPassword, "genPasswd"))
+		res.Value = value.Bytes()
+	}
+	return res
+}
+
+// HandleCancelRequest cancels the operation named by a Cancel extended
+// operation (RFC 3909): its context is canceled and it answers with canceled.
+// HandleCancelRequest returns once that operation has answered. The Cancel
+// fails with noSuchOperation, tooLate or cannotCancel when the operation is
+// unknown, has already answered or is a Cancel.
+func HandleCancelRequest(ctx context.Context, req *ber.Packet, conn net.Conn) ExtendedResponse {
+	// cancelRequestValue ::= SEQUENCE {
+	//     cancelID        MessageID }
+	if len(req.Children) != 2 {
+		return ExtendedResponse{ResultCode: LDAPResultProtocolError, Diagnostic: "missing cancelID"}
+	}
+	value, err := ber.DecodePacketErr(req.Children[1].Data.Bytes())
+	if err != nil {
+		return ExtendedResponse{ResultCode: LDAPResultProtocolError, Diagnostic: err.Error()}
+	}
+	if len(value.Children) != 1 {
+		return ExtendedResponse{ResultCode: LDAPResultProtocolError, Diagnostic: "malformed Cancel request"}
+	}
+	id, ok := value.Children[0].Value.(int64)
+	if !ok {
+		return ExtendedResponse{ResultCode: LDAPResultProtocolError, Diagnostic: "malformed cancelID"}
+	}
+	sc, ok := conn.(*serverConn)
+	if !ok {
+		return ExtendedResponse{ResultCode: LDAPResultNoSuchOperation}
+	}
+	return ExtendedResponse{ResultCode: sc.cancelOperation(uint64(id))}
+}
+
+// whoAmI answers the "Who am I?" operation (RFC 4532) with the authorization
+// identity of the connection: "dn:" and the bound DN, or empty when anonymous.
+func whoAmI(boundDN string, req ExtendedRequest) ExtendedResponse {
+	if req.Value != nil {
+		return ExtendedResponse{ResultCode: LDAPResultProtocolError, Diagnostic: "Who am I? takes no request value"}
+	}
+	res := ExtendedResponse{ResultCode: LDAPResultSuccess, Value: []byte{}}
+	if boundDN != "" {
+		res.Value = []byte("dn:" + boundDN)
+	}
+	return res
 }
 
+// encodeExtendedResponse encodes:
+//
+//	ExtendedResponse ::= [APPLICATION 24] SEQUENCE {
+//	     COMPONENTS OF LDAPResult,
+//	     responseName     [10] LDAPOID OPTIONAL,
+//	     responseValue    [11] OCTET STRING OPTIONAL }
+func encodeExtendedResponse(messageID uint64, res ExtendedResponse) *ber.Packet {
+	diagnostic := res.Diagnostic
+	if diagnostic == "" {
+		diagnostic = LDAPResultCodeMap[res.ResultCode]
+	}
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationExtendedResponse, nil, ApplicationMap[ApplicationExtendedResponse])
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(res.ResultCode), "resultCode: "))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN: "))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diagnostic, "errorMessage: "))
+	if res.Name != "" {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, res.Name, "responseName"))
+	}
+	if res.Value != nil {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 11, string(res.Value), "responseValue"))
+	}
+	packet.AppendChild(response)
+	if len(res.Controls) > 0 {
+		packet.AppendChild(encodeControls(res.Controls))
+	}
+	return packet
+}
+
+// HandleAbandonRequest abandons an operation of conn and notifies the handler
+// of fns routed by boundDN.
 func HandleAbandonRequest(ctx context.Context, req *ber.Packet, boundDN string, fns map[string]Abandoner, conn net.Conn) error {
-	fnNames := []string{}
-	for k := range fns {
-		fnNames = append(fnNames, k)
+	return handleAbandonRequest(ctx, req, boundDN, &Server{AbandonFns: fns}, conn)
+}
+
+func handleAbandonRequest(ctx context.Context, req *ber.Packet, boundDN string, server *Server, conn net.Conn) error {
+	// AbandonRequest ::= [APPLICATION 16] MessageID
+	mid, err := ber.ParseInt64(req.Data.Bytes())
+	if err != nil {
+		return NewError(LDAPResultProtocolError, err)
 	}
-	fn := routeFunc(boundDN, fnNames)
-	err := fns[fn].Abandon(ctx, boundDN, conn)
-	return err
+	messageID := uint64(mid)
+	// stop the operation first so the handler can release its resources
+	if sc, ok := conn.(*serverConn); ok {
+		sc.abandon(messageID)
+	}
+	var handler Abandoner = defaultHandler{}
+	if fn, ok := route(server, "abandon", server.AbandonFns, boundDN); ok {
+		handler = server.AbandonFns[fn]
+	}
+	return handler.Abandon(ctx, boundDN, messageID, conn)
 }
 
+// HandleModifyDNRequest runs a ModifyDN operation on the handler of fns routed by
+// the renamed DN.
 func HandleModifyDNRequest(ctx context.Context, req *ber.Packet, boundDN string, fns map[string]ModifyDNr, conn net.Conn) (resultCode LDAPResultCode) {
+	resultCode, _ = handleModifyDNRequest(ctx, req, boundDN, &Server{ModifyDNFns: fns}, conn)
+	return resultCode
+}
+
+func handleModifyDNRequest(ctx context.Context, req *ber.Packet, boundDN string, server *Server, conn net.Conn) (resultCode LDAPResultCode, referrals []string) {
 	if len(req.Children) != 3 && len(req.Children) != 4 {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	var ok bool
 	mdnReq := ModifyDNRequest{}
 	mdnReq.DN, ok = req.Children[0].Value.(string)
 	if !ok {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	mdnReq.NewRDN, ok = req.Children[1].Value.(string)
 	if !ok {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	mdnReq.DeleteOldRDN, ok = req.Children[2].Value.(bool)
 	if !ok {
-		return LDAPResultProtocolError
+		return LDAPResultProtocolError, nil
 	}
 	if len(req.Children) == 4 {
-		mdnReq.NewSuperior, ok = req.Children[3].Value.(string)
-		if !ok {
-			return LDAPResultProtocolError
-		}
+		// newSuperior is a context-specific [0] LDAPDN, so it isn't decoded as a string
+		mdnReq.NewSuperior = ber.DecodeString(req.Children[3].Data.Bytes())
 	}
-	fnNames := []string{}
-	for k := range fns {
-		fnNames = append(fnNames, k)
+	fn, ok := route(server, "modifyDN", server.ModifyDNFns, mdnReq.DN)
+	if !ok {
+		return server.unrouted(mdnReq.DN)
+	}
+	// moving an entry to a DN served by another handler can't be done by
+	// either handler alone
+	if mdnReq.NewSuperior != "" {
+		if moved, ok := route(server, "modifyDN", server.ModifyDNFns, mdnReq.NewRDN+","+mdnReq.NewSuperior); !ok || moved != fn {
+			return LDAPResultAffectsMultipleDSAs, nil
+		}
 	}
-	fn := routeFunc(boundDN, fnNames)
-	resultCode, err := fns[fn].ModifyDN(ctx, boundDN, mdnReq, conn)
+	resultCode, err := server.ModifyDNFns[fn].ModifyDN(ctx, boundDN, mdnReq, conn)
 	if err != nil {
-		Log.Printf("ModifyDN Error %s", err.Error())
-		return LDAPResultOperationsError
+		return handlerError("ModifyDNFn", err)
 	}
-	return resultCode
+	return resultCode, nil
+}
+
+// handlerError is the result of operations whose handler failed with err: a
+// referral to the URLs of a *ReferralError, or operationsError.
+func handlerError(fn string, err error) (LDAPResultCode, []string) {
+	var referral *ReferralError
+	if errors.As(err, &referral) {
+		return LDAPResultReferral, referral.URLs
+	}
+	Log.Printf("%s Error %s", fn, err.Error())
+	return LDAPResultOperationsError, nil
 }
@@ -2,10 +2,15 @@ package ldap
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"os/exec"
 	"strings"
 	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
 )
 
 func TestAdd(t *testing.T) {
@@ -67,6 +72,302 @@ func TestModify(t *testing.T) {
 	})
 }
 
+func TestRouteByTargetDN(t *testing.T) {
+	s := NewServer()
+	s.BindFunc("", bindRouteTest{})
+	s.AddFunc("ou=groups,dc=a", routeTestHandler{})
+	s.DeleteFunc("ou=groups,dc=a", routeTestHandler{})
+	s.ModifyFunc("ou=groups,dc=a", routeTestHandler{})
+	s.CompareFunc("ou=groups,dc=a", routeTestHandler{})
+	s.ModifyDNFunc("ou=groups,dc=a", routeTestHandler{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+		// bound under ou=people, which only has the default handlers
+		if err := l.Bind("uid=bob,ou=people,dc=a", "secret"); err != nil {
+			t.Fatalf("bind failed: %s", err.Error())
+		}
+
+		add := ldap.NewAddRequest("cn=x,ou=groups,dc=a", nil)
+		add.Attribute("cn", []string{"x"})
+		if err := l.Add(add); err != nil {
+			t.Errorf("add was not routed by target DN: %s", err.Error())
+		}
+		if err := l.Add(ldap.NewAddRequest("cn=x,ou=people,dc=a", nil)); !ldap.IsErrorWithCode(err, LDAPResultNoSuchObject) {
+			t.Errorf("add outside groups should fail with noSuchObject: %v", err)
+		}
+
+		mod := ldap.NewModifyRequest("cn=x,ou=groups,dc=a", nil)
+		mod.Replace("description", []string{"routed"})
+		if err := l.Modify(mod); err != nil {
+			t.Errorf("modify was not routed by target DN: %s", err.Error())
+		}
+
+		if ok, err := l.Compare("cn=x,ou=groups,dc=a", "cn", "x"); err != nil || !ok {
+			t.Errorf("compare was not routed by target DN: %v %v", ok, err)
+		}
+
+		if err := l.ModifyDN(ldap.NewModifyDNRequest("cn=x,ou=groups,dc=a", "cn=y", true, "")); err != nil {
+			t.Errorf("modifydn was not routed by target DN: %s", err.Error())
+		}
+		if err := l.ModifyDN(ldap.NewModifyDNRequest("cn=y,ou=groups,dc=a", "cn=y", true, "ou=admins,ou=groups,dc=a")); err != nil {
+			t.Errorf("modifydn within the same handler failed: %s", err.Error())
+		}
+		err := l.ModifyDN(ldap.NewModifyDNRequest("cn=y,ou=groups,dc=a", "cn=y", true, "ou=people,dc=a"))
+		if !ldap.IsErrorWithCode(err, LDAPResultAffectsMultipleDSAs) {
+			t.Errorf("modifydn across handlers should affect multiple DSAs: %v", err)
+		}
+
+		if err := l.Del(ldap.NewDelRequest("cn=y,ou=groups,dc=a", nil)); err != nil {
+			t.Errorf("delete was not routed by target DN: %s", err.Error())
+		}
+	})
+}
+
+func TestRouteFallbacks(t *testing.T) {
+	s := NewServer()
+	s.BindFunc("dc=a", bindRouteTest{})
+	s.SearchFunc("=dc=a", searchSimple{})
+	s.DeleteFunc("ou=*,dc=a", routeTestHandler{})
+	s.CompareFunc("", routeTestHandler{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		// binds outside dc=a keep failing like the default handler
+		if err := l.Bind("uid=bob,dc=b", "secret"); !ldap.IsErrorWithCode(err, LDAPResultInvalidCredentials) {
+			t.Errorf("bind outside dc=a should fail with invalidCredentials: %v", err)
+		}
+		if err := l.Bind("uid=bob,dc=a", "secret"); err != nil {
+			t.Fatalf("bind failed: %s", err.Error())
+		}
+
+		if err := l.Del(ldap.NewDelRequest("cn=x,ou=people,dc=a", nil)); err != nil {
+			t.Errorf("delete was not routed by the wildcard: %s", err.Error())
+		}
+		if err := l.Del(ldap.NewDelRequest("cn=x,dc=a", nil)); !ldap.IsErrorWithCode(err, LDAPResultNoSuchObject) {
+			t.Errorf("delete outside the wildcard should fail with noSuchObject: %v", err)
+		}
+		if err := l.Del(ldap.NewDelRequest("cn=x,", nil)); !ldap.IsErrorWithCode(err, LDAPResultInvalidDNSyntax) {
+			t.Errorf("delete of an invalid DN should fail with invalidDNSyntax: %v", err)
+		}
+		// a handler registered for "" still covers everything
+		if ok, err := l.Compare("cn=x,dc=b", "cn", "x"); err != nil || !ok {
+			t.Errorf("compare was not routed to the handler for \"\": %v %v", ok, err)
+		}
+		// the default handlers answer operations nothing was registered for
+		if err := l.Add(ldap.NewAddRequest("cn=x,dc=a", nil)); !ldap.IsErrorWithCode(err, LDAPResultInsufficientAccessRights) {
+			t.Errorf("add should use the default handler: %v", err)
+		}
+
+		search := func(baseDN string, scope int) error {
+			_, err := l.Search(ldap.NewSearchRequest(baseDN, scope, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+			return err
+		}
+		if err := search("dc=a", ScopeBaseObject); err != nil {
+			t.Errorf("search of the exact mount failed: %s", err.Error())
+		}
+		if err := search("ou=people,dc=a", ScopeWholeSubtree); !ldap.IsErrorWithCode(err, LDAPResultNoSuchObject) {
+			t.Errorf("search below the exact mount should fail with noSuchObject: %v", err)
+		}
+	})
+
+	s.Referrals = []string{"ldap://other.example/"}
+	LaunchServerForTest(t, s, func() {
+		conn := rawConnForTest(t)
+		defer conn.Close()
+
+		sendRequestForTest(t, conn, 1, ber.NewString(ber.ClassApplication, ber.TypePrimitive, ApplicationDelRequest, "cn=x,dc=b", "Del Request"))
+		_, res := readResponseForTest(t, conn)
+		if code := res.Children[0].Value.(int64); code != LDAPResultReferral {
+			t.Fatalf("expected a referral, got %s", LDAPResultCodeMap[LDAPResultCode(code)])
+		}
+		if len(res.Children) != 4 || res.Children[3].Tag != 3 || res.Children[3].Children[0].Value != "ldap://other.example/" {
+			t.Errorf("the referral URLs are missing")
+		}
+
+		sendRequestForTest(t, conn, 2, encodeSearchRequestForTest("dc=b", "(objectClass=*)"))
+		_, res = readResponseForTest(t, conn)
+		if code := res.Children[0].Value.(int64); code != LDAPResultReferral || len(res.Children) != 4 {
+			t.Errorf("expected a search referral, got %s", LDAPResultCodeMap[LDAPResultCode(code)])
+		}
+	})
+}
+
+func TestHandlerReferrals(t *testing.T) {
+	s := NewServer()
+	s.Referrals = []string{"ldap://other.example/"}
+	s.DeleteFunc("dc=a", referralTestHandler{})
+	s.AddFunc("dc=a", referralTestHandler{})
+
+	LaunchServerForTest(t, s, func() {
+		conn := rawConnForTest(t)
+		defer conn.Close()
+
+		// handlers refer to their own URLs, not the server's
+		sendRequestForTest(t, conn, 1, ber.NewString(ber.ClassApplication, ber.TypePrimitive, ApplicationDelRequest, "cn=x,dc=a", "Del Request"))
+		_, res := readResponseForTest(t, conn)
+		if code := res.Children[0].Value.(int64); code != LDAPResultReferral {
+			t.Fatalf("expected a referral, got %s", LDAPResultCodeMap[LDAPResultCode(code)])
+		}
+		if len(res.Children) != 4 || len(res.Children[3].Children) != 1 || res.Children[3].Children[0].Value != "ldap://a.example/" {
+			t.Errorf("expected the handler's referral URLs")
+		}
+
+		// other results of routed operations carry no referral
+		add := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationAddRequest, nil, "Add Request")
+		add.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "cn=x,dc=a", "DN"))
+		add.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes"))
+		sendRequestForTest(t, conn, 2, add)
+		_, res = readResponseForTest(t, conn)
+		if code := res.Children[0].Value.(int64); code != LDAPResultInsufficientAccessRights || len(res.Children) != 3 {
+			t.Errorf("expected insufficientAccessRights without referral, got %s", LDAPResultCodeMap[LDAPResultCode(code)])
+		}
+	})
+}
+
+func TestHandleRequestFns(t *testing.T) {
+	ctx := context.Background()
+	fns := map[string]Deleter{"ou=*,dc=a": routeTestHandler{}}
+	del := func(dn string) *ber.Packet {
+		return ber.NewString(ber.ClassApplication, ber.TypePrimitive, ApplicationDelRequest, dn, "Del Request")
+	}
+	if code := HandleDeleteRequest(ctx, del("cn=x,ou=people,dc=a"), "", fns, nil); code != LDAPResultSuccess {
+		t.Errorf("delete was not routed to the handler: %s", LDAPResultCodeMap[code])
+	}
+	if code := HandleDeleteRequest(ctx, del("cn=x,dc=a"), "", fns, nil); code != LDAPResultNoSuchObject {
+		t.Errorf("delete outside the handler should fail with noSuchObject: %s", LDAPResultCodeMap[code])
+	}
+}
+
+func TestExtended(t *testing.T) {
+	s := NewServer()
+	s.ExtendedFunc("", extendedEcho{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		value := ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, "\x00\x01raw", "requestValue")
+		req := ldap.NewExtendedRequest("1.2.3.4.5", value)
+		req.Controls = []Control{ldap.NewControlString("1.2.3.4.6", false, "ping")}
+		res, err := l.Extended(req)
+		if err != nil {
+			t.Fatalf("extended operation failed: %s", err.Error())
+		}
+		if res.Name != "1.2.3.4.5.1" {
+			t.Errorf("unexpected responseName %q", res.Name)
+		}
+		if res.Value == nil || res.Value.Data.String() != "war\x01\x00" {
+			t.Errorf("unexpected responseValue %v", res.Value)
+		}
+		if c := ldap.FindControl(res.Controls, "1.2.3.4.6"); c == nil || c.(*ldap.ControlString).ControlValue != "pong" {
+			t.Errorf("response control missing: %v", res.Controls)
+		}
+
+		_, err = l.Extended(ldap.NewExtendedRequest("1.2.3.4.7", nil))
+		if !ldap.IsErrorWithCode(err, LDAPResultUnwillingToPerform) || !strings.Contains(err.Error(), "not today") {
+			t.Errorf("handler error not sent: %v", err)
+		}
+
+		// StartTLS is refused when the server has no TLS configuration
+		if err := l.StartTLS(&tls.Config{InsecureSkipVerify: true}); !ldap.IsErrorWithCode(err, LDAPResultProtocolError) {
+			t.Errorf("StartTLS without configuration should fail: %v", err)
+		}
+	})
+}
+
+func TestWhoAmI(t *testing.T) {
+	s := NewServer()
+	s.BindFunc("", bindRouteTest{})
+	s.ExtendedFunc("ou=admins,dc=a", extendedEcho{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		res, err := l.WhoAmI(nil)
+		if err != nil {
+			t.Fatalf("anonymous whoami failed: %s", err.Error())
+		}
+		if res.AuthzID != "" {
+			t.Errorf("anonymous whoami returned %q", res.AuthzID)
+		}
+
+		if err := l.Bind("uid=bob,ou=people,dc=a", "secret"); err != nil {
+			t.Fatalf("bind failed: %s", err.Error())
+		}
+		res, err = l.WhoAmI(nil)
+		if err != nil {
+			t.Fatalf("whoami failed: %s", err.Error())
+		}
+		if res.AuthzID != "dn:uid=bob,ou=people,dc=a" {
+			t.Errorf("whoami returned %q", res.AuthzID)
+		}
+
+		// a handler registered for the bound DN's subtree overrides it
+		if err := l.Bind("uid=root,ou=admins,dc=a", "secret"); err != nil {
+			t.Fatalf("bind failed: %s", err.Error())
+		}
+		if _, err := l.WhoAmI(nil); !ldap.IsErrorWithCode(err, LDAPResultUnwillingToPerform) {
+			t.Errorf("whoami was not routed to the registered handler: %v", err)
+		}
+	})
+}
+
+func TestPasswordModify(t *testing.T) {
+	s := NewServer()
+	s.BindFunc("", bindRouteTest{})
+	p := &passwordStore{}
+	s.PasswordModifyFunc("ou=people,dc=a", p)
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		// anonymous clients must name the user
+		if _, err := l.PasswordModify(ldap.NewPasswordModifyRequest("", "", "new")); !ldap.IsErrorWithCode(err, LDAPResultUnwillingToPerform) {
+			t.Errorf("anonymous password modify without identity should fail: %v", err)
+		}
+
+		if err := l.Bind("uid=bob,ou=people,dc=a", "secret"); err != nil {
+			t.Fatalf("bind failed: %s", err.Error())
+		}
+		res, err := l.PasswordModify(ldap.NewPasswordModifyRequest("", "secret", "new"))
+		if err != nil {
+			t.Fatalf("password modify failed: %s", err.Error())
+		}
+		if res.GeneratedPassword != "" {
+			t.Errorf("unexpected generated password %q", res.GeneratedPassword)
+		}
+		if want := (PasswordModifyRequest{UserIdentity: "uid=bob,ou=people,dc=a", OldPassword: "secret", NewPassword: "new"}); p.last != want {
+			t.Errorf("handler got %+v, want %+v", p.last, want)
+		}
+
+		if _, err := l.PasswordModify(ldap.NewPasswordModifyRequest("dn:uid=alice,ou=people,dc=a", "", "other")); err != nil {
+			t.Fatalf("password modify failed: %s", err.Error())
+		}
+		if p.last.UserIdentity != "dn:uid=alice,ou=people,dc=a" || p.last.OldPassword != "" || p.last.NewPassword != "other" {
+			t.Errorf("handler got %+v", p.last)
+		}
+
+		res, err = l.PasswordModify(ldap.NewPasswordModifyRequest("uid=alice,ou=people,dc=a", "", ""))
+		if err != nil {
+			t.Fatalf("password modify failed: %s", err.Error())
+		}
+		if res.GeneratedPassword != "generated" {
+			t.Errorf("generated password is %q", res.GeneratedPassword)
+		}
+
+		// users outside ou=people reach the default handler
+		if _, err := l.PasswordModify(ldap.NewPasswordModifyRequest("uid=root,ou=admins,dc=a", "", "new")); !ldap.IsErrorWithCode(err, LDAPResultInsufficientAccessRights) {
+			t.Errorf("password modify was not routed to the default handler: %v", err)
+		}
+	})
+}
+
 /*
 func TestModifyDN(t *testing.T) {
 	s := NewServer()
@@ -133,3 +434,81 @@ func (h modifyTestHandler) Modify(ctx context.Context, boundDN string, req Modif
 func (h modifyTestHandler) ModifyDN(ctx context.Context, boundDN string, req ModifyDNRequest, conn net.Conn) (LDAPResultCode, error) {
 	return LDAPResultInsufficientAccessRights, nil
 }
+
+type bindRouteTest struct{}
+
+func (b bindRouteTest) Bind(ctx context.Context, bindDN, bindSimplePw string, conn net.Conn) (LDAPResultCode, error) {
+	return LDAPResultSuccess, nil
+}
+
+// routeTestHandler accepts every write, so any operation reaching it proves the
+// request was routed to the ou=groups,dc=a subtree.
+type routeTestHandler struct{}
+
+func (h routeTestHandler) Add(ctx context.Context, boundDN string, req AddRequest, conn net.Conn) (LDAPResultCode, error) {
+	return LDAPResultSuccess, nil
+}
+
+func (h routeTestHandler) Delete(ctx context.Context, boundDN, deleteDN string, conn net.Conn) (LDAPResultCode, error) {
+	return LDAPResultSuccess, nil
+}
+
+func (h routeTestHandler) Modify(ctx context.Context, boundDN string, req ModifyRequest, conn net.Conn) (LDAPResultCode, error) {
+	return LDAPResultSuccess, nil
+}
+
+func (h routeTestHandler) Compare(ctx context.Context, boundDN string, req CompareRequest, conn net.Conn) (LDAPResultCode, error) {
+	return LDAPResultCompareTrue, nil
+}
+
+func (h routeTestHandler) ModifyDN(ctx context.Context, boundDN string, req ModifyDNRequest, conn net.Conn) (LDAPResultCode, error) {
+	return LDAPResultSuccess, nil
+}
+
+// passwordStore records the last Password Modify request and generates a
+// password when none is given.
+type passwordStore struct {
+	last PasswordModifyRequest
+}
+
+func (p *passwordStore) PasswordModify(ctx context.Context, boundDN string, req PasswordModifyRequest, conn net.Conn) (string, LDAPResultCode, error) {
+	p.last = req
+	if req.NewPassword == "" {
+		return "generated", LDAPResultSuccess, nil
+	}
+	return "", LDAPResultSuccess, nil
+}
+
+// extendedEcho answers 1.2.3.4.5 with its request value reversed and echoes
+// the 1.2.3.4.6 control.
+type extendedEcho struct{}
+
+func (e extendedEcho) Extended(ctx context.Context, boundDN string, req ExtendedRequest, conn net.Conn) (ExtendedResponse, error) {
+	if req.Name != "1.2.3.4.5" {
+		return ExtendedResponse{}, NewError(LDAPResultUnwillingToPerform, errors.New("not today"))
+	}
+	value := make([]byte, len(req.Value))
+	for i, b := range req.Value {
+		value[len(value)-1-i] = b
+	}
+	res := ExtendedResponse{ResultCode: LDAPResultSuccess, Name: "1.2.3.4.5.1", Value: value}
+	if c := FindControl(req.Controls, "1.2.3.4.6"); c != nil {
+		res.Controls = []Control{ldap.NewControlString("1.2.3.4.6", false, "pong")}
+	}
+	return res, nil
+}
+
+func (e extendedEcho) SupportedExtensions() []string {
+	return []string{"1.2.3.4.5"}
+}
+
+// referralTestHandler refers deletes to ldap://a.example/ and refuses adds.
+type referralTestHandler struct{}
+
+func (h referralTestHandler) Add(ctx context.Context, boundDN string, req AddRequest, conn net.Conn) (LDAPResultCode, error) {
+	return LDAPResultInsufficientAccessRights, nil
+}
+
+func (h referralTestHandler) Delete(ctx context.Context, boundDN, deleteDN string, conn net.Conn) (LDAPResultCode, error) {
+	return 0, &ReferralError{URLs: []string{"ldap://a.example/"}}
+}
@@ -0,0 +1,158 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// PagedSearcher is implemented by search handlers whose backend pages results
+// natively. When a search carries the Simple Paged Results control (RFC 2696),
+// SearchPage is called instead of Search with the requested page size and the
+// backend cookie returned for the previous page, nil for the first one. It
+// returns the entries of the page and the cookie of the next page, empty once
+// the results are exhausted. A size of 0 asks the backend to release the
+// cursor identified by cookie.
+//
+// Backend cookies never reach the client: the server hands out its own cookies
+// and keeps them per connection. It releases the cursors of paged searches
+// whose page was abandoned while in progress, that the client didn't continue
+// within ten minutes, or on closing the connection, and of the oldest ones beyond 16
+// paged searches on a connection.
+type PagedSearcher interface {
+	SearchPage(ctx context.Context, boundDN string, req SearchRequest, size uint32, cookie []byte, conn net.Conn) (res ServerSearchResult, next []byte, err error)
+}
+
+// searchCursor is the state of a paged search between two pages.
+type searchCursor struct {
+	// search identifies the request the cursor belongs to, see pagedSearchKey
+	search string
+	// entries left to send and total number of entries of a server-side paged
+	// search
+	entries []*Entry
+	total   int
+	// cookie of the next page of a natively paged search, and release
+	// releasing it at the backend
+	cookie  []byte
+	release func()
+
+	// messageID is the request of the page that saved the cursor, at saved
+	messageID uint64
+	saved     time.Time
+}
+
+// close releases the backend cursor of a natively paged search that won't be
+// continued. The entries of a server-side paged search are simply dropped.
+func (cursor *searchCursor) close() {
+	if cursor.release != nil {
+		go cursor.release()
+	}
+}
+
+// errPagingCookie is returned for a cookie that was not issued for the search
+// on this connection, or was already used.
+var errPagingCookie = NewError(LDAPResultUnwillingToPerform, errors.New("invalid paged results cookie"))
+
+// pagedSearchKey identifies a search across its pages: RFC 2696 requires every
+// page to be requested with the same parameters.
+func pagedSearchKey(req SearchRequest) string {
+	return fmt.Sprintf("%s\x00%d\x00%s\x00%s", strings.ToLower(req.BaseDN), req.Scope, req.Filter, strings.Join(req.Attributes, ","))
+}
+
+// searchServerPage pages a search on behalf of a handler that does not page
+// itself: the first request runs the search and keeps the entries that do not
+// fit in the first page on the connection, later requests only send them.
+func searchServerPage(ctx context.Context, sc *serverConn, handler Searcher, boundDN string, req SearchRequest, paging *ControlPaging, w *searchWriter) (ServerSearchResult, error) {
+	key := pagedSearchKey(req)
+	var searchResp ServerSearchResult
+	var entries []*Entry
+	var total int
+	if len(paging.Cookie) == 0 {
+		// a size of 0 on a new search asks for no results at all
+		if paging.PagingSize == 0 {
+			searchResp.ResultCode = LDAPResultSuccess
+			searchResp.Controls = append(searchResp.Controls, &ControlPaging{})
+			return searchResp, nil
+		}
+		w.buffer = true
+		var err error
+		searchResp, err = runSearch(ctx, handler, boundDN, req, w, sc)
+		if err != nil {
+			return searchResp, err
+		}
+		if w.sorting != nil {
+			if _, err := w.sortPending(&searchResp); err != nil {
+				return searchResp, err
+			}
+			w.limitPending()
+		}
+		entries, total = w.pending, len(w.pending)
+	} else {
+		cursor := sc.takeCursor(paging.Cookie, key)
+		if cursor == nil {
+			return searchResp, errPagingCookie
+		}
+		searchResp.ResultCode = LDAPResultSuccess
+		// a size of 0 abandons the search: the cursor is already released
+		if paging.PagingSize == 0 {
+			searchResp.Controls = append(searchResp.Controls, &ControlPaging{})
+			return searchResp, nil
+		}
+		entries, total = cursor.entries, cursor.total
+		if w.sorting != nil {
+			// the entries were sorted with the first page
+			searchResp.Controls = append(searchResp.Controls, &ControlServerSideSortingResult{Result: LDAPResultSuccess})
+		}
+	}
+
+	page := entries
+	if len(page) > int(paging.PagingSize) {
+		page = page[:paging.PagingSize]
+	}
+	for _, entry := range page {
+		if err := w.send(entry); err != nil {
+			return searchResp, err
+		}
+	}
+	response := &ControlPaging{PagingSize: uint32(total)}
+	if rest := entries[len(page):]; len(rest) > 0 {
+		response.Cookie = sc.saveCursor(ctx, &searchCursor{search: key, entries: rest, total: total})
+	}
+	searchResp.Controls = append(searchResp.Controls, response)
+	return searchResp, nil
+}
+
+// searchNativePage runs a page of a search on a PagedSearcher, translating
+// between the server cookies known to the client and the backend cookies.
+func searchNativePage(ctx context.Context, sc *serverConn, pager PagedSearcher, boundDN string, req SearchRequest, paging *ControlPaging, w *searchWriter) (ServerSearchResult, error) {
+	key := pagedSearchKey(req)
+	var cookie []byte
+	if len(paging.Cookie) > 0 {
+		cursor := sc.takeCursor(paging.Cookie, key)
+		if cursor == nil {
+			return ServerSearchResult{}, errPagingCookie
+		}
+		cookie = cursor.cookie
+	}
+	searchResp, next, err := pager.SearchPage(ctx, boundDN, req, paging.PagingSize, cookie, sc)
+	if err := searchError(searchResp, err); err != nil {
+		return searchResp, err
+	}
+	if err := w.writeResult(searchResp); err != nil {
+		return searchResp, err
+	}
+	response := &ControlPaging{}
+	if len(next) > 0 && paging.PagingSize > 0 {
+		release := func() {
+			if _, _, err := pager.SearchPage(context.Background(), boundDN, req, 0, next, sc); err != nil {
+				Log.Printf("Releasing paged search error %s", err.Error())
+			}
+		}
+		response.Cookie = sc.saveCursor(ctx, &searchCursor{search: key, cookie: next, release: release})
+	}
+	searchResp.Controls = append(searchResp.Controls, response)
+	return searchResp, nil
+}
@@ -0,0 +1,131 @@
+package ldap
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sort"
+)
+
+// ExtensionAdvertiser is implemented by Extenders that advertise the names of
+// the extended operations they handle as supportedExtension in the Root DSE.
+type ExtensionAdvertiser interface {
+	SupportedExtensions() []string
+}
+
+// isRootDSESearch reports whether req reads the Root DSE (RFC 4512 5.1): a
+// base-scope search of the empty DN.
+func isRootDSESearch(req SearchRequest) bool {
+	if req.Scope != ScopeBaseObject {
+		return false
+	}
+	dn, err := ParseDN(req.BaseDN)
+	return err == nil && len(dn) == 0
+}
+
+// synthesisesRootDSE reports whether the server answers Root DSE searches with
+// the entry it synthesises: unless a Searcher is registered for the empty DN
+// alone, with "=". Catch-all Searchers registered for "" don't replace it.
+func (server *Server) synthesisesRootDSE() bool {
+	_, ok := server.SearchFns["="]
+	return !ok
+}
+
+// rootDSESearcher answers Root DSE searches with the entry synthesised from
+// the server's configuration.
+type rootDSESearcher struct {
+	server *Server
+}
+
+func (s rootDSESearcher) Search(ctx context.Context, boundDN string, req SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	dse := s.server.rootDSE()
+	if s.server.RootDSEHook != nil {
+		s.server.RootDSEHook(ctx, boundDN, dse, conn)
+	}
+	return ServerSearchResult{Entries: []*Entry{dse}, ResultCode: LDAPResultSuccess}, nil
+}
+
+// rootDSE builds the Root DSE advertising what is registered on the server.
+// Its attributes are operational, only returned when requested by name or
+// with "+".
+func (server *Server) rootDSE() *Entry {
+	dse := &Entry{Attributes: []*EntryAttribute{
+		{Name: "objectClass", Values: []string{"top"}},
+	}}
+	add := func(name string, values []string) {
+		if len(values) > 0 {
+			sort.Strings(values)
+			dse.Attributes = append(dse.Attributes, &EntryAttribute{Name: "+" + name, Values: values})
+		}
+	}
+
+	contexts := []string{}
+	for baseDN := range server.SearchFns {
+		// exact and wildcard mounts name no context
+		segments, exact, err := parseMount(baseDN)
+		if err != nil || exact || len(segments) == 0 || slices.ContainsFunc(segments, func(s mountRDN) bool { return s.wildcard }) {
+			continue
+		}
+		contexts = append(contexts, baseDN)
+	}
+	add("namingContexts", contexts)
+	add("supportedLDAPVersion", []string{"3"})
+
+	controls := map[string]bool{}
+	if server.EnforceLDAP {
+		controls[ControlTypePaging] = true
+		controls[ControlTypeServerSideSorting] = true
+		controls[ControlTypeVLVRequest] = true
+	}
+	for _, h := range server.SearchFns {
+		if _, ok := h.(PagedSearcher); ok {
+			controls[ControlTypePaging] = true
+		}
+		if _, ok := h.(NativeSorter); ok {
+			controls[ControlTypeServerSideSorting] = true
+		}
+		if _, ok := h.(VLVSearcher); ok {
+			controls[ControlTypeVLVRequest] = true
+		}
+	}
+	add("supportedControl", setKeys(controls))
+
+	extensions := map[string]bool{
+		ExtendedOperationWhoAmI: true,
+		ExtendedOperationCancel: true,
+	}
+	if server.StartTLS != nil {
+		extensions[ExtendedOperationStartTLS] = true
+	}
+	for _, h := range server.PasswordModifyFns {
+		if _, ok := h.(defaultHandler); !ok {
+			extensions[ExtendedOperationPasswordModify] = true
+		}
+	}
+	for _, h := range server.ExtendedFns {
+		if a, ok := h.(ExtensionAdvertiser); ok {
+			for _, name := range a.SupportedExtensions() {
+				extensions[name] = true
+			}
+		}
+	}
+	add("supportedExtension", setKeys(extensions))
+
+	mechanisms := []string{}
+	for name := range server.SASLMechanisms {
+		mechanisms = append(mechanisms, name)
+	}
+	add("supportedSASLMechanisms", mechanisms)
+	if server.Schema != nil {
+		add("subschemaSubentry", []string{SubschemaDN})
+	}
+	return dse
+}
+
+func setKeys(m map[string]bool) []string {
+	k := make([]string, 0, len(m))
+	for key := range m {
+		k = append(k, key)
+	}
+	return k
+}
@@ -0,0 +1,122 @@
+package ldap
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestRootDSE(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("o=testers,c=test", searchSimple{})
+	s.SearchFunc("dc=example,dc=com", &searchPager{})
+	s.PasswordModifyFunc("", &passwordStore{})
+	s.ExtendedFunc("", extendedEcho{})
+	s.RegisterSASLMechanism(NewSASLPlain(func(ctx context.Context, authzID, authcID, password string, conn net.Conn) (string, error) {
+		return "", nil
+	}))
+	s.RootDSEHook = func(ctx context.Context, boundDN string, dse *Entry, conn net.Conn) {
+		dse.Attributes = append(dse.Attributes, &EntryAttribute{Name: "+vendorName", Values: []string{"linka"}})
+	}
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		res, err := l.Search(ldap.NewSearchRequest("", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"+"}, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || res.Entries[0].DN != "" {
+			t.Fatalf("expected the Root DSE, got %v", res.Entries)
+		}
+		dse := res.Entries[0]
+		for name, want := range map[string][]string{
+			"namingContexts":          {"dc=example,dc=com", "o=testers,c=test"},
+			"supportedLDAPVersion":    {"3"},
+			"supportedControl":        {ControlTypePaging},
+			"supportedExtension":      {"1.2.3.4.5", ExtendedOperationCancel, ExtendedOperationPasswordModify, ExtendedOperationWhoAmI},
+			"supportedSASLMechanisms": {"PLAIN"},
+			"vendorName":              {"linka"},
+		} {
+			if got := dse.GetAttributeValues(name); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: expected %v, got %v", name, want, got)
+			}
+		}
+
+		// operational attributes are only returned when asked for
+		res, err = l.Search(ldap.NewSearchRequest("", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || len(res.Entries[0].Attributes) != 1 || res.Entries[0].GetAttributeValue("objectClass") != "top" {
+			t.Errorf("expected only objectClass, got %v", res.Entries)
+		}
+		res, err = l.Search(ldap.NewSearchRequest("", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"supportedLDAPVersion"}, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || len(res.Entries[0].Attributes) != 1 || res.Entries[0].GetAttributeValue("supportedLDAPVersion") != "3" {
+			t.Errorf("expected only supportedLDAPVersion, got %v", res.Entries)
+		}
+	})
+}
+
+func TestRootDSEOverride(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("", searchSimple{})
+	s.RootDSE = searchBoundDN{}
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		res, err := l.Search(ldap.NewSearchRequest("", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || len(res.Entries[0].Attributes) != 0 {
+			t.Errorf("the Root DSE was not answered by the registered handler: %v", res.Entries)
+		}
+	})
+}
+
+func TestRootDSEHandler(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("", searchBoundDN{})
+	s.SearchFunc("o=testers,c=test", searchSimple{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		// a catch-all handler registered for "" leaves the Root DSE to the
+		// server
+		res, err := l.Search(ldap.NewSearchRequest("", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"+"}, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || res.Entries[0].GetAttributeValue("supportedLDAPVersion") != "3" {
+			t.Errorf("the catch-all handler answered the Root DSE: %v", res.Entries)
+		}
+
+	})
+
+	// one registered for the empty DN alone answers instead
+	s.SearchFunc("=", searchBoundDN{})
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		res, err := l.Search(ldap.NewSearchRequest("", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"+"}, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || len(res.Entries[0].Attributes) != 0 {
+			t.Errorf("the Root DSE was not answered by the registered handler: %v", res.Entries)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package ldap
+
+import (
+	"strings"
+)
+
+// router routes DNs to the baseDNs handlers are registered for, walking a
+// tree of their RDNs from the root. A baseDN mounts its handler on the whole
+// subtree of the entry it names, or only on the entry itself when prefixed
+// with "=", and "ou=*,dc=example" mounts the subtrees of all the
+// organizational units right below dc=example. The most specific mount
+// covering a DN handles it: the deepest one, literal RDNs winning over
+// wildcards, and exact mounts over subtree mounts of the same entry.
+type router struct {
+	root routeNode
+	// gen is the server's routersGen, handlers the number of handlers and
+	// builtin whether the default handler was left out when the router was
+	// built, to tell when it is stale.
+	gen      uint64
+	handlers int
+	builtin  bool
+}
+
+type routeNode struct {
+	// rdns are the children of literal RDNs, by normal form.
+	rdns map[string]*routeNode
+	// types are the children of type=* RDNs, by lower-cased type.
+	types map[string]*routeNode
+	// any is the child of * RDNs.
+	any *routeNode
+
+	subtree, exact       string
+	hasSubtree, hasExact bool
+}
+
+// newRouter builds the router of baseDNs. Invalid baseDNs are ignored.
+func newRouter(baseDNs []string) *router {
+	r := &router{}
+	for _, baseDN := range baseDNs {
+		if err := r.mount(baseDN); err != nil {
+			Log.Printf("Ignoring handlers for baseDN %q: %s", baseDN, err.Error())
+		}
+	}
+	return r
+}
+
+// mount adds the mount of baseDN.
+func (r *router) mount(baseDN string) error {
+	segments, exact, err := parseMount(baseDN)
+	if err != nil {
+		return err
+	}
+	n := &r.root
+	// the tree is walked from the root, so from the last RDN
+	for i := len(segments) - 1; i >= 0; i-- {
+		n = n.child(segments[i])
+	}
+	if exact {
+		n.exact, n.hasExact = baseDN, true
+	} else {
+		n.subtree, n.hasSubtree = baseDN, true
+	}
+	return nil
+}
+
+// child returns the child of n for segment, adding it when missing.
+func (n *routeNode) child(segment mountRDN) *routeNode {
+	children := &n.rdns
+	switch {
+	case segment.wildcard && segment.rdn == "":
+		if n.any == nil {
+			n.any = &routeNode{}
+		}
+		return n.any
+	case segment.wildcard:
+		children = &n.types
+	}
+	if *children == nil {
+		*children = map[string]*routeNode{}
+	}
+	c, ok := (*children)[segment.rdn]
+	if !ok {
+		c = &routeNode{}
+		(*children)[segment.rdn] = c
+	}
+	return c
+}
+
+// mountRDN is an RDN of a baseDN: a literal RDN in its normal form, or a
+// wildcard for the lower-cased attribute type rdn, or any RDN when empty.
+type mountRDN struct {
+	rdn      string
+	wildcard bool
+}
+
+// parseMount returns the RDNs of baseDN and whether it mounts its entry only.
+func parseMount(baseDN string) (segments []mountRDN, exact bool, err error) {
+	if strings.HasPrefix(baseDN, "=") {
+		baseDN, exact = baseDN[1:], true
+	}
+	if strings.TrimSpace(baseDN) == "" {
+		return nil, exact, nil
+	}
+	for _, s := range splitRDNs(baseDN) {
+		s = strings.TrimSpace(s)
+		if s == "*" {
+			segments = append(segments, mountRDN{wildcard: true})
+			continue
+		}
+		if i := strings.IndexByte(s, '='); i > 0 && !strings.ContainsRune(s, '+') && strings.TrimSpace(s[i+1:]) == "*" {
+			segments = append(segments, mountRDN{rdn: strings.ToLower(strings.TrimSpace(s[:i])), wildcard: true})
+			continue
+		}
+		dn, err := ParseDN(s)
+		if err != nil {
+			return nil, false, err
+		}
+		segments = append(segments, mountRDN{rdn: dn.Normalize().String()})
+	}
+	return segments, exact, nil
+}
+
+// splitRDNs splits dn on the commas separating its RDNs.
+func splitRDNs(dn string) []string {
+	var rdns []string
+	start := 0
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',':
+			rdns = append(rdns, dn[start:i])
+			start = i + 1
+		}
+	}
+	return append(rdns, dn[start:])
+}
+
+// route returns the baseDN of the most specific mount covering dn, reporting
+// false when none does.
+func (r *router) route(dn DN) (string, bool) {
+	best, weight := "", -1
+	var walk func(n *routeNode, depth int)
+	walk = func(n *routeNode, depth int) {
+		// deeper mounts are more specific, and exact ones more than subtrees
+		if n.hasSubtree && 2*depth > weight {
+			best, weight = n.subtree, 2*depth
+		}
+		if depth == len(dn) {
+			if n.hasExact && 2*depth+1 > weight {
+				best, weight = n.exact, 2*depth+1
+			}
+			return
+		}
+		rdn := dn[len(dn)-1-depth]
+		if c, ok := n.rdns[rdn.Normalize().String()]; ok {
+			walk(c, depth+1)
+		}
+		for _, ava := range rdn {
+			if c, ok := n.types[strings.ToLower(ava.Type)]; ok {
+				walk(c, depth+1)
+			}
+		}
+		if n.any != nil {
+			walk(n.any, depth+1)
+		}
+	}
+	walk(&r.root, 0)
+	return best, weight >= 0
+}
+
+// route returns the baseDN of the handler of fns covering dn, reporting false
+// when none does. The handler NewServer registers for "" only covers DNs
+// until other handlers are registered. Invalid DNs are only covered by a
+// handler for "". The routers are cached on the server by operation, op, and
+// rebuilt once handlers are registered, or the number of handlers of fns
+// changes.
+func route[T any](server *Server, op string, fns map[string]T, dn string) (string, bool) {
+	_, builtin := any(fns[""]).(defaultHandler)
+	builtin = builtin && len(fns) > 1
+
+	gen := server.routersGen.Load()
+	r, _ := server.routers.Load(op)
+	rt, _ := r.(*router)
+	if rt == nil || rt.gen != gen || rt.handlers != len(fns) || rt.builtin != builtin {
+		baseDNs := make([]string, 0, len(fns))
+		for baseDN := range fns {
+			if baseDN != "" || !builtin {
+				baseDNs = append(baseDNs, baseDN)
+			}
+		}
+		rt = newRouter(baseDNs)
+		rt.gen, rt.handlers, rt.builtin = gen, len(fns), builtin
+		server.routers.Store(op, rt)
+	}
+
+	target, err := ParseDN(dn)
+	if err != nil {
+		_, ok := fns[""]
+		return "", ok && !builtin
+	}
+	return rt.route(target)
+}
+
+// unrouted is the result of operations on dn when no handler covers it:
+// invalidDNSyntax for invalid DNs, otherwise a referral to the server's
+// Referrals when it has any, or noSuchObject.
+func (server *Server) unrouted(dn string) (LDAPResultCode, []string) {
+	if _, err := ParseDN(dn); err != nil {
+		return LDAPResultInvalidDNSyntax, nil
+	}
+	if len(server.Referrals) > 0 {
+		return LDAPResultReferral, server.Referrals
+	}
+	return LDAPResultNoSuchObject, nil
+}
@@ -0,0 +1,184 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// SASLMechanism is a SASL mechanism offered in SASL binds (RFC 4513 5.2).
+// Mechanisms are registered with Server.RegisterSASLMechanism.
+type SASLMechanism interface {
+	// Name returns the registered name of the mechanism, e.g. "PLAIN".
+	Name() string
+	// Start begins a new authentication exchange on conn.
+	Start(ctx context.Context, conn net.Conn) (SASLSession, error)
+}
+
+// SASLSession is a single authentication exchange of a SASL mechanism. It
+// lives on the connection across the bind requests of the exchange.
+type SASLSession interface {
+	// Next processes the credentials sent by the client, nil when the request
+	// carried none, and returns the challenge to send back. done reports that
+	// the client is authenticated; the challenge then holds the mechanism's
+	// final data, if any. Returning an *Error sets the bind result code,
+	// other errors fail the bind with invalidCredentials.
+	Next(ctx context.Context, credentials []byte) (challenge []byte, done bool, err error)
+	// Identity returns the identity established by a completed exchange.
+	Identity() SASLIdentity
+}
+
+// SASLIdentity is the outcome of a successful SASL exchange.
+type SASLIdentity struct {
+	// AuthcID is the authentication identity, as known to the mechanism.
+	AuthcID string
+	// AuthzID is the authorization identity requested by the client, if any.
+	AuthzID string
+	// DN is the entry the identity maps to, if the mechanism knows it.
+	DN string
+}
+
+// SASLBinder is implemented by bind handlers that take part in SASL binds.
+// Once a mechanism has authenticated the client, BindSASL authorizes the
+// identity and returns the DN the connection is bound as. Bind handlers that
+// don't implement it bind the connection as the DN of the identity.
+type SASLBinder interface {
+	BindSASL(ctx context.Context, mechanism string, id SASLIdentity, conn net.Conn) (boundDN string, resultCode LDAPResultCode, err error)
+}
+
+// RegisterSASLMechanism offers m in SASL binds, replacing any mechanism of the
+// same name.
+func (server *Server) RegisterSASLMechanism(m SASLMechanism) {
+	server.SASLMechanisms[strings.ToUpper(m.Name())] = m
+}
+
+// saslMechanismsKey is the context key of the mechanisms the server offers,
+// set for the mechanisms' Start and Next.
+type saslMechanismsKey struct{}
+
+// offersSASLMechanism reports whether the server running the SASL bind of ctx
+// offers the mechanism name.
+func offersSASLMechanism(ctx context.Context, name string) bool {
+	mechanisms, _ := ctx.Value(saslMechanismsKey{}).(map[string]SASLMechanism)
+	_, ok := mechanisms[strings.ToUpper(name)]
+	return ok
+}
+
+// saslExchange is the SASL bind in progress on a connection.
+type saslExchange struct {
+	mechanism string
+	session   SASLSession
+}
+
+// HandleSASLBindRequest runs a step of a SASL bind. It returns the bind result
+// code, the serverSaslCreds to send back and, once the exchange succeeded, the
+// DN the connection is bound as. Exchanges that take several steps need conn
+// to be the connection handed out by the server, where their state is kept.
+func HandleSASLBindRequest(ctx context.Context, req *ber.Packet, server *Server, conn net.Conn) (resultCode LDAPResultCode, serverCreds []byte, boundDN string) {
+	sc, _ := conn.(*serverConn)
+	var exchange *saslExchange
+	if sc != nil {
+		exchange, sc.sasl = sc.sasl, nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			Log.Printf("SASL bind panic: %s", r)
+			resultCode, serverCreds, boundDN = LDAPResultOperationsError, nil, ""
+		}
+	}()
+
+	if len(req.Children) != 3 || len(req.Children[2].Children) == 0 {
+		return LDAPResultProtocolError, nil, ""
+	}
+	ldapVersion, ok := req.Children[0].Value.(int64)
+	if !ok {
+		return LDAPResultProtocolError, nil, ""
+	}
+	if ldapVersion != 3 {
+		Log.Printf("Unsupported LDAP version: %d", ldapVersion)
+		return LDAPResultInappropriateAuthentication, nil, ""
+	}
+	bindDN := ber.DecodeString(req.Children[1].Data.Bytes())
+	creds := req.Children[2]
+	name := strings.ToUpper(ber.DecodeString(creds.Children[0].Data.Bytes()))
+	var credentials []byte
+	if len(creds.Children) > 1 {
+		// present but empty credentials are not the same as none
+		credentials = append([]byte{}, creds.Children[1].Data.Bytes()...)
+	}
+	ctx = context.WithValue(ctx, saslMechanismsKey{}, server.SASLMechanisms)
+
+	// a bind with another mechanism aborts the exchange in progress
+	if exchange == nil || exchange.mechanism != name {
+		mechanism, ok := server.SASLMechanisms[name]
+		if !ok {
+			Log.Printf("Unsupported SASL mechanism %q", name)
+			return LDAPResultAuthMethodNotSupported, nil, ""
+		}
+		session, err := mechanism.Start(ctx, conn)
+		if err != nil {
+			Log.Printf("SASL %s error %s", name, err.Error())
+			return saslResultCode(err), nil, ""
+		}
+		exchange = &saslExchange{mechanism: name, session: session}
+	}
+
+	challenge, done, err := exchange.session.Next(ctx, credentials)
+	if err != nil {
+		Log.Printf("SASL %s error %s", name, err.Error())
+		return saslResultCode(err), nil, ""
+	}
+	if !done {
+		if sc == nil {
+			Log.Printf("SASL %s: multi-step exchanges need a server connection", name)
+			return LDAPResultOperationsError, nil, ""
+		}
+		sc.sasl = exchange
+		return LDAPResultSaslBindInProgress, challenge, ""
+	}
+
+	id := exchange.session.Identity()
+	target := id.DN
+	if target == "" {
+		target = bindDN
+	}
+	var binder SASLBinder
+	if fn, ok := route(server, "bind", server.BindFns, target); ok {
+		binder, _ = server.BindFns[fn].(SASLBinder)
+	}
+	if binder == nil {
+		if id.DN == "" {
+			Log.Printf("SASL %s: no DN for %q", name, id.AuthcID)
+			return LDAPResultInvalidCredentials, nil, ""
+		}
+		return LDAPResultSuccess, challenge, id.DN
+	}
+	boundDN, resultCode, err = binder.BindSASL(ctx, name, id, conn)
+	if err != nil {
+		Log.Printf("BindSASL error %s", err.Error())
+		return LDAPResultOperationsError, nil, ""
+	}
+	if resultCode != LDAPResultSuccess {
+		return resultCode, nil, ""
+	}
+	return resultCode, challenge, boundDN
+}
+
+// saslResultCode is the bind result code for an error returned by a SASL
+// mechanism.
+func saslResultCode(err error) LDAPResultCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.ResultCode
+	}
+	return LDAPResultInvalidCredentials
+}
+
+// errSASLCredentials is returned by mechanisms for malformed client messages.
+func errSASLCredentials(mechanism string, reason string) error {
+	return NewError(LDAPResultInvalidCredentials, fmt.Errorf("%s: %s", mechanism, reason))
+}
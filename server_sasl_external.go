@@ -0,0 +1,101 @@
+package ldap
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CertificateMapper maps the verified certificate chain of a TLS client,
+// leaf first, to the DN it authenticates as. authzID is the authorization
+// identity requested by the client, empty when it asked for none; mappers
+// return an error to refuse it.
+type CertificateMapper func(ctx context.Context, chain []*x509.Certificate, authzID string, conn net.Conn) (dn string, err error)
+
+// MapCertificateSubject is a CertificateMapper that authenticates clients as
+// the subject DN of their certificate.
+func MapCertificateSubject(ctx context.Context, chain []*x509.Certificate, authzID string, conn net.Conn) (string, error) {
+	dn := chain[0].Subject.String()
+	if authzID != "" && !strings.EqualFold(authzID, "dn:"+dn) {
+		return "", fmt.Errorf("%s may not act as %s", dn, authzID)
+	}
+	return dn, nil
+}
+
+// MapCertificateSAN returns a CertificateMapper that authenticates clients as
+// the DN lookup returns for the subject alternative names of their
+// certificate: email addresses, then DNS names, then URIs.
+func MapCertificateSAN(lookup func(ctx context.Context, san string) (dn string, err error)) CertificateMapper {
+	return func(ctx context.Context, chain []*x509.Certificate, authzID string, conn net.Conn) (string, error) {
+		leaf := chain[0]
+		sans := append(append([]string{}, leaf.EmailAddresses...), leaf.DNSNames...)
+		for _, uri := range leaf.URIs {
+			sans = append(sans, uri.String())
+		}
+		for _, san := range sans {
+			dn, err := lookup(ctx, san)
+			if err != nil {
+				return "", err
+			}
+			if dn == "" {
+				continue
+			}
+			if authzID != "" && !strings.EqualFold(authzID, "dn:"+dn) {
+				return "", fmt.Errorf("%s may not act as %s", dn, authzID)
+			}
+			return dn, nil
+		}
+		return "", errors.New("no subject alternative name maps to an entry")
+	}
+}
+
+// NewSASLExternal returns the EXTERNAL mechanism (RFC 4422 appendix A), which
+// authenticates clients with the certificate they presented in the TLS
+// handshake, either on an LDAPS connection or after StartTLS. Only verified
+// chains are considered: the server's tls.Config must set ClientAuth to verify
+// client certificates and ClientCAs to trust their issuers.
+func NewSASLExternal(mapper CertificateMapper) SASLMechanism {
+	return saslExternal{mapper: mapper}
+}
+
+type saslExternal struct {
+	mapper CertificateMapper
+}
+
+func (saslExternal) Name() string {
+	return "EXTERNAL"
+}
+
+func (m saslExternal) Start(ctx context.Context, conn net.Conn) (SASLSession, error) {
+	state, ok := TLSConnectionState(conn)
+	if !ok || len(state.VerifiedChains) == 0 {
+		return nil, NewError(LDAPResultInappropriateAuthentication, errors.New("EXTERNAL: no verified client certificate"))
+	}
+	return &saslExternalSession{mapper: m.mapper, conn: conn, chain: state.VerifiedChains[0]}, nil
+}
+
+type saslExternalSession struct {
+	mapper CertificateMapper
+	conn   net.Conn
+	chain  []*x509.Certificate
+	id     SASLIdentity
+}
+
+// Next handles the single message of the exchange, the optional
+// authorization identity.
+func (s *saslExternalSession) Next(ctx context.Context, credentials []byte) ([]byte, bool, error) {
+	authzID := string(credentials)
+	dn, err := s.mapper(ctx, s.chain, authzID, s.conn)
+	if err != nil {
+		return nil, false, err
+	}
+	s.id = SASLIdentity{AuthcID: s.chain[0].Subject.String(), AuthzID: authzID, DN: dn}
+	return nil, true, nil
+}
+
+func (s *saslExternalSession) Identity() SASLIdentity {
+	return s.id
+}
@@ -0,0 +1,60 @@
+package ldap
+
+import (
+	"bytes"
+	"context"
+	"net"
+)
+
+// PlainAuthenticator checks the credentials of a SASL PLAIN bind and returns
+// the DN of the authenticated user, or an error when they are wrong.
+type PlainAuthenticator func(ctx context.Context, authzID, authcID, password string, conn net.Conn) (dn string, err error)
+
+// NewSASLPlain returns the PLAIN mechanism (RFC 4616), which checks passwords
+// with auth. As with simple binds, the password travels in the clear: only
+// offer it on TLS connections.
+func NewSASLPlain(auth PlainAuthenticator) SASLMechanism {
+	return saslPlain{auth: auth}
+}
+
+type saslPlain struct {
+	auth PlainAuthenticator
+}
+
+func (saslPlain) Name() string {
+	return "PLAIN"
+}
+
+func (m saslPlain) Start(ctx context.Context, conn net.Conn) (SASLSession, error) {
+	return &saslPlainSession{auth: m.auth, conn: conn}, nil
+}
+
+type saslPlainSession struct {
+	auth PlainAuthenticator
+	conn net.Conn
+	id   SASLIdentity
+}
+
+// Next handles the single message of the exchange:
+// message = [authzid] UTF8NUL authcid UTF8NUL passwd
+func (s *saslPlainSession) Next(ctx context.Context, credentials []byte) ([]byte, bool, error) {
+	// ask for the initial response the client did not send
+	if credentials == nil {
+		return []byte{}, false, nil
+	}
+	parts := bytes.Split(credentials, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return nil, false, errSASLCredentials("PLAIN", "malformed message")
+	}
+	authzID, authcID, password := string(parts[0]), string(parts[1]), string(parts[2])
+	dn, err := s.auth(ctx, authzID, authcID, password, s.conn)
+	if err != nil {
+		return nil, false, err
+	}
+	s.id = SASLIdentity{AuthcID: authcID, AuthzID: authzID, DN: dn}
+	return nil, true, nil
+}
+
+func (s *saslPlainSession) Identity() SASLIdentity {
+	return s.id
+}
@@ -0,0 +1,292 @@
+package ldap
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SCRAMCredentials are the salted keys stored for a SCRAM user (RFC 5802 3):
+// the server never needs the password itself. DN is the entry the user binds
+// as.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+	DN         string
+}
+
+// SCRAMCredentialStore looks up the SCRAM credentials of a user. mechanism is
+// the name of the mechanism without the -PLUS suffix, e.g. "SCRAM-SHA-256",
+// as the keys depend on its hash function. An *Error fails the bind with its
+// result code. Other errors mean the user is unknown: so as not to tell, the
+// exchange goes on with a made-up salt, the same on every attempt, and 4096
+// iterations, and fails at the proof with invalidCredentials as for a wrong
+// password.
+type SCRAMCredentialStore interface {
+	SCRAMCredentials(ctx context.Context, mechanism, username string) (SCRAMCredentials, error)
+}
+
+// NewSCRAMCredentials derives the credentials to store for password, with the
+// hash function of the mechanism they are meant for, e.g. sha256.New for
+// SCRAM-SHA-256.
+func NewSCRAMCredentials(h func() hash.Hash, password string, salt []byte, iterations int) (SCRAMCredentials, error) {
+	salted, err := pbkdf2.Key(h, password, salt, iterations, h().Size())
+	if err != nil {
+		return SCRAMCredentials{}, err
+	}
+	clientKey := scramHMAC(h, salted, "Client Key")
+	serverKey := scramHMAC(h, salted, "Server Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return SCRAMCredentials{Salt: salt, Iterations: iterations, StoredKey: storedKey.Sum(nil), ServerKey: serverKey}, nil
+}
+
+// NewSASLSCRAMSHA256 returns the SCRAM-SHA-256 mechanism (RFC 7677).
+//
+// Clients that support channel binding but don't see a -PLUS mechanism say so
+// in their first message; the server rejects them on TLS connections when it
+// offers SCRAM-SHA-256-PLUS too, as this hints at a downgrade.
+func NewSASLSCRAMSHA256(store SCRAMCredentialStore) SASLMechanism {
+	return saslSCRAM{name: "SCRAM-SHA-256", hash: sha256.New, store: store}
+}
+
+// NewSASLSCRAMSHA256Plus returns the SCRAM-SHA-256-PLUS mechanism, which binds
+// the exchange to the TLS channel it runs on with the tls-exporter (RFC 9266)
+// or, before TLS 1.3, tls-unique (RFC 5929) channel binding.
+func NewSASLSCRAMSHA256Plus(store SCRAMCredentialStore) SASLMechanism {
+	return saslSCRAM{name: "SCRAM-SHA-256", hash: sha256.New, store: store, plus: true}
+}
+
+// NewSASLSCRAMSHA512 returns the SCRAM-SHA-512 mechanism, see
+// NewSASLSCRAMSHA256.
+func NewSASLSCRAMSHA512(store SCRAMCredentialStore) SASLMechanism {
+	return saslSCRAM{name: "SCRAM-SHA-512", hash: sha512.New, store: store}
+}
+
+// NewSASLSCRAMSHA512Plus returns the SCRAM-SHA-512-PLUS mechanism, see
+// NewSASLSCRAMSHA256Plus.
+func NewSASLSCRAMSHA512Plus(store SCRAMCredentialStore) SASLMechanism {
+	return saslSCRAM{name: "SCRAM-SHA-512", hash: sha512.New, store: store, plus: true}
+}
+
+type saslSCRAM struct {
+	name  string
+	hash  func() hash.Hash
+	store SCRAMCredentialStore
+	plus  bool
+}
+
+func (m saslSCRAM) Name() string {
+	if m.plus {
+		return m.name + "-PLUS"
+	}
+	return m.name
+}
+
+func (m saslSCRAM) Start(ctx context.Context, conn net.Conn) (SASLSession, error) {
+	if _, ok := TLSConnectionState(conn); m.plus && !ok {
+		return nil, NewError(LDAPResultInappropriateAuthentication, errors.New(m.Name()+": channel binding needs TLS"))
+	}
+	return &saslSCRAMSession{mechanism: m, conn: conn}, nil
+}
+
+type saslSCRAMSession struct {
+	mechanism saslSCRAM
+	conn      net.Conn
+
+	// state of the exchange after the client-first-message
+	gs2Header   string
+	cbData      []byte
+	nonce       string
+	authMessage string
+	credentials SCRAMCredentials
+	id          SASLIdentity
+}
+
+func (s *saslSCRAMSession) Next(ctx context.Context, credentials []byte) ([]byte, bool, error) {
+	if credentials == nil {
+		return []byte{}, false, nil
+	}
+	if s.nonce == "" {
+		serverFirst, err := s.clientFirst(ctx, string(credentials))
+		return []byte(serverFirst), false, err
+	}
+	serverFinal, err := s.clientFinal(string(credentials))
+	return []byte(serverFinal), err == nil, err
+}
+
+// clientFirst handles:
+// client-first-message = gs2-header client-first-message-bare
+// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+// client-first-message-bare = [reserved-mext ","] username "," nonce ["," extensions]
+func (s *saslSCRAMSession) clientFirst(ctx context.Context, msg string) (string, error) {
+	name := s.mechanism.Name()
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return "", errSASLCredentials(name, "malformed client-first-message")
+	}
+	cbind, authzID, bare := parts[0], parts[1], parts[2]
+	switch {
+	case strings.HasPrefix(cbind, "p="):
+		if !s.mechanism.plus {
+			return "", errSASLCredentials(name, "channel binding requested with a non -PLUS mechanism")
+		}
+		data, err := channelBinding(s.conn, cbind[2:])
+		if err != nil {
+			return "", errSASLCredentials(name, err.Error())
+		}
+		s.cbData = data
+	case cbind == "y":
+		// the client supports channel binding but thinks the server doesn't:
+		// it does if it offers the -PLUS mechanism on this connection
+		if _, ok := TLSConnectionState(s.conn); s.mechanism.plus || ok && offersSASLMechanism(ctx, s.mechanism.name+"-PLUS") {
+			return "", errSASLCredentials(name, "server does support channel binding")
+		}
+	case cbind == "n":
+		if s.mechanism.plus {
+			return "", errSASLCredentials(name, "channel binding is required")
+		}
+	default:
+		return "", errSASLCredentials(name, "malformed gs2-cbind-flag")
+	}
+	if authzID != "" {
+		if !strings.HasPrefix(authzID, "a=") {
+			return "", errSASLCredentials(name, "malformed authzid")
+		}
+		authzID = decodeSASLName(authzID[2:])
+	}
+	s.gs2Header = cbind + "," + parts[1] + ","
+
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return "", errSASLCredentials(name, "malformed client-first-message-bare")
+	}
+	username := decodeSASLName(attrs[0][2:])
+	creds, err := s.mechanism.store.SCRAMCredentials(ctx, s.mechanism.name, username)
+	if err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			return "", err
+		}
+		Log.Printf("%s: unknown user %q: %s", name, username, err.Error())
+		creds = s.mechanism.unknownUser(username)
+	}
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", NewError(LDAPResultOperationsError, err)
+	}
+	s.credentials = creds
+	s.nonce = attrs[1][2:] + base64.StdEncoding.EncodeToString(nonce)
+	s.id = SASLIdentity{AuthcID: username, AuthzID: authzID, DN: creds.DN}
+
+	serverFirst := "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(creds.Salt) + ",i=" + strconv.Itoa(creds.Iterations)
+	s.authMessage = bare + "," + serverFirst
+	return serverFirst, nil
+}
+
+// clientFinal handles:
+// client-final-message = channel-binding "," nonce ["," extensions] "," proof
+func (s *saslSCRAMSession) clientFinal(msg string) (string, error) {
+	name := s.mechanism.Name()
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return "", errSASLCredentials(name, "missing proof")
+	}
+	withoutProof, proof := msg[:i], msg[i+3:]
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return "", errSASLCredentials(name, "malformed client-final-message")
+	}
+	binding, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil || !hmac.Equal(binding, append([]byte(s.gs2Header), s.cbData...)) {
+		return "", errSASLCredentials(name, "channel bindings don't match")
+	}
+	if attrs[1][2:] != s.nonce {
+		return "", errSASLCredentials(name, "nonce mismatch")
+	}
+	clientProof, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil || len(clientProof) != len(s.credentials.StoredKey) {
+		return "", errSASLCredentials(name, "malformed proof")
+	}
+
+	h := s.mechanism.hash
+	authMessage := s.authMessage + "," + withoutProof
+	clientSignature := scramHMAC(h, s.credentials.StoredKey, authMessage)
+	clientKey := make([]byte, len(clientProof))
+	for i := range clientProof {
+		clientKey[i] = clientProof[i] ^ clientSignature[i]
+	}
+	storedKey := h()
+	storedKey.Write(clientKey)
+	if !hmac.Equal(storedKey.Sum(nil), s.credentials.StoredKey) {
+		return "", errSASLCredentials(name, "invalid proof")
+	}
+	return "v=" + base64.StdEncoding.EncodeToString(scramHMAC(h, s.credentials.ServerKey, authMessage)), nil
+}
+
+// scramSecret keys the credentials made up for unknown users.
+var scramSecret = sync.OnceValue(func() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+})
+
+// unknownUser returns the credentials made up for a user the store doesn't
+// know. Their salt only depends on the user, and no proof matches their keys.
+func (m saslSCRAM) unknownUser(username string) SCRAMCredentials {
+	key := scramHMAC(m.hash, scramSecret(), m.name+","+username)
+	return SCRAMCredentials{
+		Salt:       key[:16],
+		Iterations: 4096,
+		StoredKey:  scramHMAC(m.hash, key, "Stored Key"),
+		ServerKey:  scramHMAC(m.hash, key, "Server Key"),
+	}
+}
+
+func (s *saslSCRAMSession) Identity() SASLIdentity {
+	return s.id
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// decodeSASLName reverses the escaping of "," and "=" in SCRAM names.
+func decodeSASLName(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+// channelBinding returns the channel binding data of conn for cbType.
+func channelBinding(conn net.Conn, cbType string) ([]byte, error) {
+	state, ok := TLSConnectionState(conn)
+	if !ok {
+		return nil, errors.New("channel binding needs TLS")
+	}
+	switch cbType {
+	case "tls-exporter":
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case "tls-unique":
+		if state.Version >= tls.VersionTLS13 || len(state.TLSUnique) == 0 {
+			return nil, errors.New("tls-unique is not defined for this connection")
+		}
+		return bytes.Clone(state.TLSUnique), nil
+	}
+	return nil, fmt.Errorf("unsupported channel binding type %q", cbType)
+}
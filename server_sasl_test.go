@@ -0,0 +1,456 @@
+package ldap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+func encodeSASLBindRequestForTest(mechanism string, credentials []byte) *ber.Packet {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationBindRequest, nil, "Bind Request")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "User Name"))
+	auth := ber.Encode(ber.ClassContext, ber.TypeConstructed, LDAPBindAuthSASL, nil, "SASL Credentials")
+	auth.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, mechanism, "Mechanism"))
+	if credentials != nil {
+		auth.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(credentials), "Credentials"))
+	}
+	req.AppendChild(auth)
+	return req
+}
+
+func encodeSimpleBindRequestForTest(dn, password string) *ber.Packet {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationBindRequest, nil, "Bind Request")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "User Name"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, LDAPBindAuthSimple, password, "Password"))
+	return req
+}
+
+// saslBindForTest sends a SASL bind request and returns the result code and
+// serverSaslCreds of the response, nil when absent.
+func saslBindForTest(t *testing.T, conn net.Conn, messageID int64, mechanism string, credentials []byte) (LDAPResultCode, []byte) {
+	sendRequestForTest(t, conn, messageID, encodeSASLBindRequestForTest(mechanism, credentials))
+	_, res := readResponseForTest(t, conn)
+	if res.Tag != ApplicationBindResponse {
+		t.Fatalf("expected a bind response, got %s", ApplicationMap[res.Tag])
+	}
+	var creds []byte
+	if len(res.Children) > 3 && res.Children[3].Tag == 7 {
+		creds = append([]byte{}, res.Children[3].Data.Bytes()...)
+	}
+	return LDAPResultCode(res.Children[0].Value.(int64)), creds
+}
+
+// boundDNForTest returns the DN the connection is bound as, as seen by
+// searchBoundDN.
+func boundDNForTest(t *testing.T, conn net.Conn, messageID int64) string {
+	sendRequestForTest(t, conn, messageID, encodeSearchRequestForTest("", "(objectClass=*)"))
+	_, res := readResponseForTest(t, conn)
+	if res.Tag != ApplicationSearchResultEntry {
+		t.Fatalf("expected a search entry, got %s", ApplicationMap[res.Tag])
+	}
+	readResponseForTest(t, conn)
+	return res.Children[0].Value.(string)
+}
+
+func TestSASLPlain(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("", searchBoundDN{})
+	s.RegisterSASLMechanism(NewSASLPlain(func(ctx context.Context, authzID, authcID, password string, conn net.Conn) (string, error) {
+		if authcID != "bob" || password != "secret" {
+			return "", errors.New("wrong password")
+		}
+		return "uid=bob,o=testers,c=test", nil
+	}))
+
+	LaunchServerForTest(t, s, func() {
+		conn := rawConnForTest(t)
+		defer conn.Close()
+
+		if code, _ := saslBindForTest(t, conn, 1, "PLAIN", []byte("\x00bob\x00wrong")); code != LDAPResultInvalidCredentials {
+			t.Errorf("expected invalidCredentials, got %s", LDAPResultCodeMap[code])
+		}
+		if code, _ := saslBindForTest(t, conn, 2, "UNKNOWN", nil); code != LDAPResultAuthMethodNotSupported {
+			t.Errorf("expected authMethodNotSupported, got %s", LDAPResultCodeMap[code])
+		}
+
+		// without an initial response the server asks for it
+		code, creds := saslBindForTest(t, conn, 3, "PLAIN", nil)
+		if code != LDAPResultSaslBindInProgress || creds == nil || len(creds) != 0 {
+			t.Fatalf("expected an empty challenge, got %s %q", LDAPResultCodeMap[code], creds)
+		}
+		if code, _ := saslBindForTest(t, conn, 4, "PLAIN", []byte("\x00bob\x00secret")); code != LDAPResultSuccess {
+			t.Fatalf("PLAIN bind failed: %s", LDAPResultCodeMap[code])
+		}
+		if dn := boundDNForTest(t, conn, 5); dn != "uid=bob,o=testers,c=test" {
+			t.Errorf("connection bound as %q", dn)
+		}
+	})
+}
+
+func TestSASLMultiStep(t *testing.T) {
+	s := NewServer()
+	s.BindFunc("", bindSASLMapper{})
+	s.SearchFunc("", searchBoundDN{})
+	s.RegisterSASLMechanism(saslPingPong{})
+
+	LaunchServerForTest(t, s, func() {
+		conn := rawConnForTest(t)
+		defer conn.Close()
+
+		code, creds := saslBindForTest(t, conn, 1, "ping-pong", []byte("alice"))
+		if code != LDAPResultSaslBindInProgress || string(creds) != "ping" {
+			t.Fatalf("expected a ping challenge, got %s %q", LDAPResultCodeMap[code], creds)
+		}
+		code, creds = saslBindForTest(t, conn, 2, "PING-PONG", []byte("pong"))
+		if code != LDAPResultSuccess || string(creds) != "done" {
+			t.Fatalf("expected success with final data, got %s %q", LDAPResultCodeMap[code], creds)
+		}
+		if dn := boundDNForTest(t, conn, 3); dn != "uid=alice,o=testers,c=test" {
+			t.Errorf("SASLBinder did not map the identity: bound as %q", dn)
+		}
+
+		// a simple bind aborts the exchange in progress
+		if code, _ := saslBindForTest(t, conn, 4, "PING-PONG", []byte("alice")); code != LDAPResultSaslBindInProgress {
+			t.Fatalf("expected saslBindInProgress, got %s", LDAPResultCodeMap[code])
+		}
+		sendRequestForTest(t, conn, 5, encodeSimpleBindRequestForTest("", ""))
+		readResponseForTest(t, conn)
+		if code, _ := saslBindForTest(t, conn, 6, "PING-PONG", []byte("pong")); code != LDAPResultInvalidCredentials {
+			t.Errorf("aborted exchange went on: %s", LDAPResultCodeMap[code])
+		}
+	})
+}
+
+// certificatesForTest returns a StartTLS configuration that verifies client
+// certificates and a client certificate it trusts, for cn=bob,o=testers,c=test.
+func certificatesForTest(t *testing.T) (*tls.Config, tls.Certificate) {
+	issue := func(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	ca, caKey := issue(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	client, clientKey := issue(&x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "bob", Organization: []string{"testers"}, Country: []string{"test"}},
+		EmailAddresses: []string{"bob@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	server, err := tls.LoadX509KeyPair("tests/cert_DONOTUSE.pem", "tests/key_DONOTUSE.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	config := &tls.Config{Certificates: []tls.Certificate{server}, ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	return config, tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey, Leaf: client}
+}
+
+func TestSASLExternal(t *testing.T) {
+	config, clientCert := certificatesForTest(t)
+	s := NewServer()
+	s.StartTLS = config
+	s.SearchFunc("", searchBoundDN{})
+	s.RegisterSASLMechanism(NewSASLExternal(MapCertificateSubject))
+
+	LaunchServerForTest(t, s, func() {
+		// without TLS there is nothing to authenticate with
+		l := dialForTest(t)
+		if err := l.ExternalBind(); !ldap.IsErrorWithCode(err, LDAPResultInappropriateAuthentication) {
+			t.Errorf("EXTERNAL without TLS should fail: %v", err)
+		}
+		l.Close()
+
+		l = dialForTest(t)
+		defer l.Close()
+		if err := l.StartTLS(&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}}); err != nil {
+			t.Fatalf("StartTLS failed: %s", err.Error())
+		}
+		if err := l.ExternalBind(); err != nil {
+			t.Fatalf("EXTERNAL bind failed: %s", err.Error())
+		}
+		res, err := l.Search(ldap.NewSearchRequest("o=testers,c=test", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || res.Entries[0].DN != "CN=bob,O=testers,C=test" {
+			t.Errorf("connection not bound as the certificate subject: %v", res.Entries)
+		}
+	})
+}
+
+func TestMapCertificateSAN(t *testing.T) {
+	_, clientCert := certificatesForTest(t)
+	chain := []*x509.Certificate{clientCert.Leaf}
+	mapper := MapCertificateSAN(func(ctx context.Context, san string) (string, error) {
+		if san == "bob@example.com" {
+			return "uid=bob,o=testers,c=test", nil
+		}
+		return "", nil
+	})
+	if dn, err := mapper(context.Background(), chain, "", nil); err != nil || dn != "uid=bob,o=testers,c=test" {
+		t.Errorf("unexpected mapping: %q %v", dn, err)
+	}
+	if _, err := mapper(context.Background(), chain, "dn:uid=alice,o=testers,c=test", nil); err == nil {
+		t.Errorf("authorization identity of another entry accepted")
+	}
+	if _, err := MapCertificateSubject(context.Background(), chain, "dn:cn=BOB,o=testers,c=test", nil); err != nil {
+		t.Errorf("authorization identity of the subject refused: %s", err.Error())
+	}
+}
+
+// scramBindForTest runs a SCRAM exchange as user and returns its result code.
+// cbind is the gs2-cbind-flag, cbData the channel binding data for "p=".
+func scramBindForTest(t *testing.T, conn net.Conn, mechanism string, h func() hash.Hash, user, password, cbind string, cbData []byte) LDAPResultCode {
+	gs2Header := cbind + ",,"
+	clientFirstBare := "n=" + user + ",r=clientnonce"
+	code, serverFirst := saslBindForTest(t, conn, 1, mechanism, []byte(gs2Header+clientFirstBare))
+	if code != LDAPResultSaslBindInProgress {
+		return code
+	}
+	attrs := strings.Split(string(serverFirst), ",")
+	if len(attrs) != 3 || !strings.HasPrefix(attrs[0], "r=clientnonce") {
+		t.Fatalf("malformed server-first-message %q", serverFirst)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs[1][2:])
+	iterations, _ := strconv.Atoi(attrs[2][2:])
+	salted, err := pbkdf2.Key(h, password, salt, iterations, h().Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, _ := NewSCRAMCredentials(h, password, salt, iterations)
+	clientKey := scramHMAC(h, salted, "Client Key")
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbData...)) + "," + attrs[0]
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	signature := scramHMAC(h, creds.StoredKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	code, serverFinal := saslBindForTest(t, conn, 2, mechanism, []byte(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)))
+	if code == LDAPResultSuccess {
+		expected := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(h, creds.ServerKey, authMessage))
+		if !hmac.Equal(serverFinal, []byte(expected)) {
+			t.Errorf("bad server signature %q", serverFinal)
+		}
+	}
+	return code
+}
+
+// scramStore holds the credentials of bob, whose password is "secret".
+type scramStore struct{}
+
+func (scramStore) SCRAMCredentials(ctx context.Context, mechanism, username string) (SCRAMCredentials, error) {
+	if username != "bob" {
+		return SCRAMCredentials{}, errors.New("no such user")
+	}
+	h := sha256.New
+	if mechanism == "SCRAM-SHA-512" {
+		h = sha512.New
+	}
+	creds, err := NewSCRAMCredentials(h, "secret", []byte("0123456789abcdef"), 4096)
+	creds.DN = "uid=bob,o=testers,c=test"
+	return creds, err
+}
+
+func TestSASLSCRAM(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("", searchBoundDN{})
+	s.RegisterSASLMechanism(NewSASLSCRAMSHA256(scramStore{}))
+	s.RegisterSASLMechanism(NewSASLSCRAMSHA512(scramStore{}))
+	s.RegisterSASLMechanism(NewSASLSCRAMSHA256Plus(scramStore{}))
+
+	LaunchServerForTest(t, s, func() {
+		conn := rawConnForTest(t)
+		defer conn.Close()
+
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-256", sha256.New, "bob", "wrong", "n", nil); code != LDAPResultInvalidCredentials {
+			t.Errorf("expected invalidCredentials, got %s", LDAPResultCodeMap[code])
+		}
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-256", sha256.New, "alice", "secret", "n", nil); code != LDAPResultInvalidCredentials {
+			t.Errorf("expected invalidCredentials, got %s", LDAPResultCodeMap[code])
+		}
+		// unknown users get a salt and iterations as stable as known ones
+		serverFirst := func(user string) string {
+			conn := rawConnForTest(t)
+			defer conn.Close()
+			code, msg := saslBindForTest(t, conn, 1, "SCRAM-SHA-256", []byte("n,,n="+user+",r=clientnonce"))
+			if code != LDAPResultSaslBindInProgress {
+				t.Fatalf("%s: expected saslBindInProgress, got %s", user, LDAPResultCodeMap[code])
+			}
+			// the server's part of the nonce changes on every exchange
+			return string(msg[strings.Index(string(msg), ",s="):])
+		}
+		if alice := serverFirst("alice"); alice != serverFirst("alice") || alice == serverFirst("carol") || !strings.HasSuffix(alice, ",i=4096") {
+			t.Errorf("unexpected salt and iterations for an unknown user: %q", alice)
+		}
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-256-PLUS", sha256.New, "bob", "secret", "p=tls-exporter", nil); code != LDAPResultInappropriateAuthentication {
+			t.Errorf("-PLUS without TLS should fail, got %s", LDAPResultCodeMap[code])
+		}
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-512", sha512.New, "bob", "secret", "n", nil); code != LDAPResultSuccess {
+			t.Fatalf("SCRAM-SHA-512 bind failed: %s", LDAPResultCodeMap[code])
+		}
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-256", sha256.New, "bob", "secret", "y", nil); code != LDAPResultSuccess {
+			t.Fatalf("SCRAM-SHA-256 bind failed: %s", LDAPResultCodeMap[code])
+		}
+		if dn := boundDNForTest(t, conn, 3); dn != "uid=bob,o=testers,c=test" {
+			t.Errorf("connection bound as %q", dn)
+		}
+	})
+}
+
+func TestSASLSCRAMPlus(t *testing.T) {
+	config, _ := certificatesForTest(t)
+	s := NewServer()
+	s.StartTLS = config
+	s.RegisterSASLMechanism(NewSASLSCRAMSHA256(scramStore{}))
+	s.RegisterSASLMechanism(NewSASLSCRAMSHA256Plus(scramStore{}))
+
+	LaunchServerForTest(t, s, func() {
+		raw := rawConnForTest(t)
+		defer raw.Close()
+		conn := startTLSForTest(t, raw)
+		state := conn.ConnectionState()
+		cbData, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-256", sha256.New, "bob", "secret", "y", nil); code != LDAPResultInvalidCredentials {
+			t.Errorf("downgrade from -PLUS should be detected, got %s", LDAPResultCodeMap[code])
+		}
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-256-PLUS", sha256.New, "bob", "secret", "p=tls-exporter", []byte("other channel")); code != LDAPResultInvalidCredentials {
+			t.Errorf("wrong channel binding should fail, got %s", LDAPResultCodeMap[code])
+		}
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-256-PLUS", sha256.New, "bob", "secret", "p=tls-exporter", cbData); code != LDAPResultSuccess {
+			t.Errorf("SCRAM-SHA-256-PLUS bind failed: %s", LDAPResultCodeMap[code])
+		}
+	})
+
+	// without -PLUS mechanism, the client is right not to bind the channel
+	delete(s.SASLMechanisms, "SCRAM-SHA-256-PLUS")
+	LaunchServerForTest(t, s, func() {
+		raw := rawConnForTest(t)
+		defer raw.Close()
+		conn := startTLSForTest(t, raw)
+
+		if code := scramBindForTest(t, conn, "SCRAM-SHA-256", sha256.New, "bob", "secret", "y", nil); code != LDAPResultSuccess {
+			t.Errorf("SCRAM-SHA-256 bind over TLS failed: %s", LDAPResultCodeMap[code])
+		}
+	})
+}
+
+// startTLSForTest runs StartTLS on raw and returns the secured connection.
+func startTLSForTest(t *testing.T, raw net.Conn) *tls.Conn {
+	t.Helper()
+	startTLS := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationExtendedRequest, nil, "Start TLS")
+	startTLS.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, "1.3.6.1.4.1.1466.20037", "TLS Extended Command"))
+	sendRequestForTest(t, raw, 1, startTLS)
+	if _, res := readResponseForTest(t, raw); res.Children[0].Value.(int64) != LDAPResultSuccess {
+		t.Fatalf("StartTLS failed")
+	}
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %s", err.Error())
+	}
+	return conn
+}
+
+// searchBoundDN returns a single entry named after the bound DN.
+type searchBoundDN struct{}
+
+func (s searchBoundDN) Search(ctx context.Context, boundDN string, searchReq SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	return ServerSearchResult{Entries: []*Entry{{DN: boundDN}}, ResultCode: LDAPResultSuccess}, nil
+}
+
+// bindSASLMapper allows anonymous simple binds and maps SASL identities to
+// entries under o=testers,c=test.
+type bindSASLMapper struct {
+	bindAnonOK
+}
+
+func (b bindSASLMapper) BindSASL(ctx context.Context, mechanism string, id SASLIdentity, conn net.Conn) (string, LDAPResultCode, error) {
+	return "uid=" + id.AuthcID + ",o=testers,c=test", LDAPResultSuccess, nil
+}
+
+// saslPingPong is a two step mechanism: the client sends its name, the server
+// answers "ping" and expects "pong".
+type saslPingPong struct{}
+
+func (saslPingPong) Name() string {
+	return "PING-PONG"
+}
+
+func (saslPingPong) Start(ctx context.Context, conn net.Conn) (SASLSession, error) {
+	return &saslPingPongSession{}, nil
+}
+
+type saslPingPongSession struct {
+	name string
+	done bool
+}
+
+func (s *saslPingPongSession) Next(ctx context.Context, credentials []byte) ([]byte, bool, error) {
+	if s.name == "" {
+		if string(credentials) == "pong" {
+			return nil, false, errors.New("unexpected pong")
+		}
+		s.name = string(credentials)
+		return []byte("ping"), false, nil
+	}
+	if string(credentials) != "pong" {
+		return nil, false, errors.New("expected pong")
+	}
+	return []byte("done"), true, nil
+}
+
+func (s *saslPingPongSession) Identity() SASLIdentity {
+	return SASLIdentity{AuthcID: s.name}
+}
@@ -0,0 +1,59 @@
+package ldap
+
+import (
+	"context"
+	"net"
+
+	"go.linka.cloud/ldap/schema"
+)
+
+// SubschemaDN is the DN the server publishes its schema at, advertised as the
+// subschemaSubentry of the Root DSE.
+const SubschemaDN = "cn=Subschema"
+
+// isSubschemaSearch reports whether req reads the subschema entry.
+func isSubschemaSearch(req SearchRequest) bool {
+	if req.Scope != ScopeBaseObject {
+		return false
+	}
+	dn, err := ParseDN(req.BaseDN)
+	subschema, _ := ParseDN(SubschemaDN)
+	return err == nil && dn.Equal(subschema)
+}
+
+// subschemaSearcher answers searches of the subschema entry with the
+// definitions of the server's schema.
+type subschemaSearcher struct {
+	schema *schema.Schema
+}
+
+func (s subschemaSearcher) Search(ctx context.Context, boundDN string, req SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	return ServerSearchResult{Entries: []*Entry{subschemaEntry(s.schema)}, ResultCode: LDAPResultSuccess}, nil
+}
+
+// subschemaEntry builds the subschema entry (RFC 4512 4.2) publishing sc. The
+// definitions are operational attributes, only returned when requested by
+// name or with "+".
+func subschemaEntry(sc *schema.Schema) *Entry {
+	var syntaxes, rules, types, classes []string
+	for _, syn := range sc.Syntaxes() {
+		syntaxes = append(syntaxes, syn.String())
+	}
+	for _, mr := range sc.MatchingRules() {
+		rules = append(rules, mr.String())
+	}
+	for _, at := range sc.AttributeTypes() {
+		types = append(types, at.String())
+	}
+	for _, oc := range sc.ObjectClasses() {
+		classes = append(classes, oc.String())
+	}
+	return &Entry{DN: SubschemaDN, Attributes: []*EntryAttribute{
+		{Name: "objectClass", Values: []string{"top", "subentry", "subschema"}},
+		{Name: "cn", Values: []string{"Subschema"}},
+		{Name: "+ldapSyntaxes", Values: syntaxes},
+		{Name: "+matchingRules", Values: rules},
+		{Name: "+attributeTypes", Values: types},
+		{Name: "+objectClasses", Values: classes},
+	}}
+}
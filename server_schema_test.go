@@ -0,0 +1,55 @@
+package ldap
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"go.linka.cloud/ldap/schema"
+)
+
+func TestSubschema(t *testing.T) {
+	s := NewServer()
+	s.Schema = schema.New()
+	if err := s.Schema.LoadFile("schema/testdata/core.schema"); err != nil {
+		t.Fatal(err)
+	}
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		res, err := l.Search(ldap.NewSearchRequest("", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"subschemaSubentry"}, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || res.Entries[0].GetAttributeValue("subschemaSubentry") != SubschemaDN {
+			t.Errorf("Root DSE does not advertise the subschema entry: %v", res.Entries)
+		}
+
+		res, err = l.Search(ldap.NewSearchRequest("CN=subschema", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=subschema)", []string{"attributeTypes", "objectClasses", "matchingRules", "ldapSyntaxes"}, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 {
+			t.Fatalf("expected the subschema entry, got %v", res.Entries)
+		}
+		sub := res.Entries[0]
+		if sub.DN != SubschemaDN || len(sub.Attributes) != 4 {
+			t.Errorf("unexpected subschema entry %s with %d attributes", sub.DN, len(sub.Attributes))
+		}
+		if !slices.Contains(sub.GetAttributeValues("objectClasses"), s.Schema.ObjectClass("person").String()) {
+			t.Errorf("person is not published: %v", sub.GetAttributeValues("objectClasses"))
+		}
+		if !slices.Contains(sub.GetAttributeValues("attributeTypes"), "( 2.5.4.3 NAME ( 'cn' 'commonName' ) DESC 'RFC4519: common name(s) for which the entity is known by' SUP name )") {
+			t.Errorf("cn is not published: %v", sub.GetAttributeValues("attributeTypes"))
+		}
+		if !slices.Contains(sub.GetAttributeValues("matchingRules"), "( 2.5.13.14 NAME 'integerMatch' SYNTAX 1.3.6.1.4.1.1466.115.121.1.27 )") {
+			t.Errorf("integerMatch is not published: %v", sub.GetAttributeValues("matchingRules"))
+		}
+		if len(sub.GetAttributeValues("ldapSyntaxes")) != len(s.Schema.Syntaxes()) {
+			t.Errorf("syntaxes are not published: %v", sub.GetAttributeValues("ldapSyntaxes"))
+		}
+	})
+}
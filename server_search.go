@@ -8,9 +8,26 @@ import (
 	"strings"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
+
+	"go.linka.cloud/ldap/schema"
 )
 
+// HandleSearchRequest runs a search and sends its entries and continuation
+// references to conn, leaving the SearchResultDone to the caller. Searches
+// ending with a result code other than success return an *Error holding it.
 func HandleSearchRequest(ctx context.Context, req *ber.Packet, controls *[]Control, messageID uint64, boundDN string, server *Server, conn net.Conn) (resultErr error) {
+	searchResp, err := handleSearchRequest(ctx, req, controls, messageID, boundDN, server, conn)
+	if err == nil && searchResp.ResultCode != LDAPResultSuccess {
+		err = NewError(searchResp.ResultCode, errors.New(LDAPResultCodeMap[searchResp.ResultCode]))
+	}
+	return err
+}
+
+// handleSearchRequest runs a search and sends its entries and continuation
+// references to conn. The returned result describes the SearchResultDone to
+// send: its result code, response controls and, for LDAPResultReferral, the
+// referral URLs.
+func handleSearchRequest(ctx context.Context, req *ber.Packet, controls *[]Control, messageID uint64, boundDN string, server *Server, conn net.Conn) (searchResp ServerSearchResult, resultErr error) {
 	defer func() {
 		if r := recover(); r != nil {
 			resultErr = NewError(LDAPResultOperationsError, fmt.Errorf("Search function panic: %s", r))
@@ -19,22 +36,16 @@ func HandleSearchRequest(ctx context.Context, req *ber.Packet, controls *[]Contr
 
 	searchReq, err := parseSearchRequest(boundDN, req, controls)
 	if err != nil {
-		return NewError(LDAPResultOperationsError, err)
+		return searchResp, NewError(LDAPResultOperationsError, err)
 	}
 
-	filterPacket, err := CompileFilter(searchReq.Filter)
+	filter, err := ParseFilter(searchReq.Filter)
 	if err != nil {
-		return NewError(LDAPResultOperationsError, err)
-	}
-
-	fnNames := []string{}
-	for k := range server.SearchFns {
-		fnNames = append(fnNames, k)
+		return searchResp, NewError(LDAPResultOperationsError, err)
 	}
-	fn := routeFunc(searchReq.BaseDN, fnNames)
-	searchResp, err := server.SearchFns[fn].Search(ctx, boundDN, searchReq, conn)
-	if err != nil {
-		return NewError(searchResp.ResultCode, err)
+	baseDN, err := ParseDN(searchReq.BaseDN)
+	if err != nil && server.EnforceLDAP {
+		return searchResp, NewError(LDAPResultInvalidDNSyntax, err)
 	}
 
 	if server.EnforceLDAP {
@@ -46,59 +57,304 @@ func HandleSearchRequest(ctx context.Context, req *ber.Packet, controls *[]Contr
 		}
 	}
 
-	i := 0
-	searchReqBaseDNLower := strings.ToLower(searchReq.BaseDN)
-	for _, entry := range searchResp.Entries {
+	w := &searchWriter{
+		ctx:       ctx,
+		conn:      conn,
+		messageID: messageID,
+		req:       searchReq,
+		filter:    filter,
+		enforce:   server.EnforceLDAP,
+		schema:    server.Schema,
+		baseDN:    baseDN,
+	}
+	defer func() {
+		// entries left out for the size limit make the result incomplete
+		if w.limited && resultErr == nil && searchResp.ResultCode == LDAPResultSuccess {
+			searchResp.ResultCode = LDAPResultSizeLimitExceeded
+		}
+	}()
+	var handler Searcher
+	switch {
+	case isRootDSESearch(searchReq) && (server.RootDSE != nil || server.synthesisesRootDSE()):
+		if server.RootDSE != nil {
+			handler = server.RootDSE
+		} else {
+			// the synthesised entry always honours the filter and the
+			// requested attributes
+			handler = rootDSESearcher{server}
+			w.enforce = true
+		}
+	case server.Schema != nil && isSubschemaSearch(searchReq):
+		handler = subschemaSearcher{server.Schema}
+		w.enforce = true
+	default:
+		fn, ok := route(server, "search", server.SearchFns, searchReq.BaseDN)
+		if !ok {
+			searchResp.ResultCode, searchResp.Referrals = server.unrouted(searchReq.BaseDN)
+			return searchResp, nil
+		}
+		handler = server.SearchFns[fn]
+	}
+
+	paging, _ := FindControl(searchReq.Controls, ControlTypePaging).(*ControlPaging)
+	vlv, _ := FindControl(searchReq.Controls, ControlTypeVLVRequest).(*ControlVLV)
+	if paging != nil && vlv != nil {
+		return searchResp, NewError(LDAPResultUnwillingToPerform, errors.New("virtual list view cannot be combined with paged results"))
+	}
+	// sorting is the sort the server has to apply itself
+	sorting, _ := FindControl(searchReq.Controls, ControlTypeServerSideSorting).(*ControlServerSideSorting)
+	if sorter, ok := handler.(NativeSorter); ok && sorting != nil && sorter.SortsNatively(sorting.SortKeys) {
+		sorting = nil
+	}
+	sc, _ := conn.(*serverConn)
+	if paging != nil && sc != nil {
+		if pager, ok := handler.(PagedSearcher); ok {
+			if sorting != nil && sorting.Criticality {
+				return searchResp, errSortUnavailable
+			}
+			return searchNativePage(ctx, sc, pager, boundDN, searchReq, paging, w)
+		}
+	}
+	if vlv != nil {
+		if searcher, ok := handler.(VLVSearcher); ok {
+			return searchNativeVLV(ctx, searcher, boundDN, searchReq, vlv, w)
+		}
+	}
+	if sorting != nil {
+		if !server.EnforceLDAP && sorting.Criticality {
+			return searchResp, errSortUnavailable
+		}
 		if server.EnforceLDAP {
-			// filter
-			keep, resultCode := ServerApplyFilter(filterPacket, entry)
-			if resultCode != LDAPResultSuccess {
-				return NewError(resultCode, errors.New("ServerApplyFilter error"))
+			w.sorting = sorting
+		}
+	}
+	if vlv != nil && server.EnforceLDAP {
+		return searchVLV(ctx, handler, boundDN, searchReq, vlv, w)
+	}
+	if vlv != nil && vlv.Criticality {
+		return searchResp, NewError(LDAPResultUnavailableCriticalExtension, errors.New("virtual list view is not available"))
+	}
+	if paging != nil && sc != nil && server.EnforceLDAP {
+		return searchServerPage(ctx, sc, handler, boundDN, searchReq, paging, w)
+	}
+	if paging != nil && isCriticalControl(ctx, ControlTypePaging) {
+		return searchResp, NewError(LDAPResultUnavailableCriticalExtension, errors.New("paged results are not supported"))
+	}
+	if w.sorting == nil {
+		return runSearch(ctx, handler, boundDN, searchReq, w, conn)
+	}
+
+	w.buffer = true
+	searchResp, err = runSearch(ctx, handler, boundDN, searchReq, w, conn)
+	if err != nil {
+		return searchResp, err
+	}
+	if _, err := w.sortPending(&searchResp); err != nil {
+		return searchResp, err
+	}
+	w.limitPending()
+	for _, entry := range w.pending {
+		if err := w.send(entry); err != nil {
+			return searchResp, err
+		}
+	}
+	return searchResp, nil
+}
+
+// runSearch calls the handler and writes the entries and continuation
+// references of its result through w.
+func runSearch(ctx context.Context, handler Searcher, boundDN string, req SearchRequest, w *searchWriter, conn net.Conn) (ServerSearchResult, error) {
+	var searchResp ServerSearchResult
+	var err error
+	if streamer, ok := handler.(SearchStreamer); ok {
+		searchResp, err = streamer.SearchStream(ctx, boundDN, req, w, conn)
+	} else {
+		searchResp, err = handler.Search(ctx, boundDN, req, conn)
+	}
+	if errors.Is(err, ErrSizeLimitExceeded) {
+		w.limited = true
+	}
+	if err := searchError(searchResp, err); err != nil {
+		return searchResp, err
+	}
+	return searchResp, w.writeResult(searchResp)
+}
+
+// searchError converts the error returned by a search handler into the error
+// reported to the client. Reaching the size limit is not an error: the
+// entries already sent make up the result, done with sizeLimitExceeded.
+func searchError(searchResp ServerSearchResult, err error) error {
+	if err == nil || errors.Is(err, ErrSizeLimitExceeded) {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return NewError(searchResp.ResultCode, err)
+}
+
+// ErrSizeLimitExceeded is returned by SearchResultWriter.WriteEntry once the
+// request's size limit has been reached.
+var ErrSizeLimitExceeded = NewError(LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+
+// searchWriter is the SearchResultWriter handed to handlers: it enforces the
+// search constraints when EnforceLDAP is set and encodes results onto conn.
+type searchWriter struct {
+	ctx       context.Context
+	conn      net.Conn
+	messageID uint64
+	req       SearchRequest
+	filter    Filter
+	enforce   bool
+	schema    *schema.Schema
+	baseDN    DN
+	matched   int
+	// limited records that matching entries were left out for the size limit
+	limited bool
+
+	// buffer holds matching entries back in pending instead of sending them
+	buffer  bool
+	pending []*Entry
+	// sorting is the sort control the buffered entries are sorted with
+	sorting *ControlServerSideSorting
+}
+
+func (w *searchWriter) WriteEntry(entry *Entry) error {
+	// stop streaming once the search has been abandoned
+	if err := w.ctx.Err(); err != nil {
+		return NewError(LDAPResultOperationsError, err)
+	}
+	if w.enforce {
+		// filter
+		if !MatchFilter(w.filter, entry, w.schema) {
+			return nil
+		}
+
+		// constrained search scope
+		switch w.req.Scope {
+		case ScopeWholeSubtree: // The scope is constrained to the entry named by baseObject and to all its subordinates.
+			if dn, err := ParseDN(entry.DN); err != nil || !dn.InSubtree(w.baseDN) {
+				return nil
 			}
-			if !keep {
-				continue
+		case ScopeBaseObject: // The scope is constrained to the entry named by baseObject.
+			if dn, err := ParseDN(entry.DN); err != nil || !dn.Equal(w.baseDN) {
+				return nil
 			}
-
-			// constrained search scope
-			switch searchReq.Scope {
-			case ScopeWholeSubtree: // The scope is constrained to the entry named by baseObject and to all its subordinates.
-			case ScopeBaseObject: // The scope is constrained to the entry named by baseObject.
-				if strings.ToLower(entry.DN) != searchReqBaseDNLower {
-					continue
-				}
-			case ScopeSingleLevel: // The scope is constrained to the immediate subordinates of the entry named by baseObject.
-				entryDNLower := strings.ToLower(entry.DN)
-				parts := strings.Split(entryDNLower, ",")
-				if len(parts) < 2 && entryDNLower != searchReqBaseDNLower {
-					continue
-				}
-				if dnSuffix := strings.Join(parts[1:], ","); dnSuffix != searchReqBaseDNLower {
-					continue
-				}
+		case ScopeSingleLevel: // The scope is constrained to the immediate subordinates of the entry named by baseObject.
+			if dn, err := ParseDN(entry.DN); err != nil || !dn.IsChildOf(w.baseDN) {
+				return nil
 			}
+		}
 
-			// filter attributes
-			entry, err = filterAttributes(entry, searchReq.Attributes)
-			if err != nil {
-				return NewError(LDAPResultOperationsError, err)
-			}
+		// size limit, applied once sorted when sorting
+		if w.req.SizeLimit > 0 && w.matched >= w.req.SizeLimit && w.sorting == nil {
+			w.limited = true
+			return ErrSizeLimitExceeded
+		}
+
+		w.matched++
+	}
 
-			// size limit
-			if searchReq.SizeLimit > 0 && i >= searchReq.SizeLimit {
+	// entries held back for server-side paging are sent page by page later
+	if w.buffer {
+		w.pending = append(w.pending, entry)
+		return nil
+	}
+	return w.send(entry)
+}
+
+// send encodes entry onto the connection, keeping only the requested
+// attributes when EnforceLDAP is set.
+func (w *searchWriter) send(entry *Entry) error {
+	if w.enforce {
+		var err error
+		entry, err = filterAttributes(entry, w.req.Attributes)
+		if err != nil {
+			return NewError(LDAPResultOperationsError, err)
+		}
+	}
+	if err := sendPacket(w.conn, encodeSearchResponse(w.messageID, w.req, entry)); err != nil {
+		return NewError(LDAPResultOperationsError, err)
+	}
+	return nil
+}
+
+func (w *searchWriter) writeResult(searchResp ServerSearchResult) error {
+	for _, entry := range searchResp.Entries {
+		if err := w.WriteEntry(entry); err != nil {
+			if errors.Is(err, ErrSizeLimitExceeded) {
 				break
 			}
-			i++
+			return err
 		}
-
-		// respond
-		responsePacket := encodeSearchResponse(messageID, searchReq, entry)
-		if err = sendPacket(conn, responsePacket); err != nil {
-			return NewError(LDAPResultOperationsError, err)
+	}
+	// a referral result sends its URLs in the SearchResultDone, otherwise
+	// they are continuation references to the rest of the search
+	if searchResp.ResultCode != LDAPResultReferral {
+		for _, referral := range searchResp.Referrals {
+			if err := w.WriteReference(referral); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+func (w *searchWriter) WriteReference(urls ...string) error {
+	if err := w.ctx.Err(); err != nil {
+		return NewError(LDAPResultOperationsError, err)
+	}
+	if err := sendPacket(w.conn, encodeSearchReference(w.messageID, urls)); err != nil {
+		return NewError(LDAPResultOperationsError, err)
+	}
+	return nil
+}
+
+func (w *searchWriter) WriteIntermediate(name string, value []byte) error {
+	if err := w.ctx.Err(); err != nil {
+		return NewError(LDAPResultOperationsError, err)
+	}
+	if err := sendPacket(w.conn, encodeIntermediateResponse(w.messageID, name, value)); err != nil {
+		return NewError(LDAPResultOperationsError, err)
+	}
+	return nil
+}
+
+// streamingSearcher lets a SearchStreamer be registered in SearchFns. Called
+// as a plain Searcher, it collects the stream into the result.
+type streamingSearcher struct {
+	SearchStreamer
+}
+
+func (s streamingSearcher) Search(ctx context.Context, boundDN string, req SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	w := &collectingWriter{}
+	res, err := s.SearchStream(ctx, boundDN, req, w, conn)
+	res.Entries = append(w.entries, res.Entries...)
+	res.Referrals = append(w.referrals, res.Referrals...)
+	return res, err
+}
+
+// collectingWriter is a SearchResultWriter that keeps everything written to it.
+type collectingWriter struct {
+	entries   []*Entry
+	referrals []string
+}
+
+func (w *collectingWriter) WriteEntry(entry *Entry) error {
+	w.entries = append(w.entries, entry)
+	return nil
+}
+
+func (w *collectingWriter) WriteReference(urls ...string) error {
+	w.referrals = append(w.referrals, urls...)
+	return nil
+}
+
+func (w *collectingWriter) WriteIntermediate(name string, value []byte) error {
+	return nil
+}
+
 // ///////////////////////
 func parseSearchRequest(boundDN string, req *ber.Packet, controls *[]Control) (SearchRequest, error) {
 	if len(req.Children) != 8 {
@@ -229,14 +485,55 @@ func encodeSearchAttribute(name string, values []string) *ber.Packet {
 	return packet
 }
 
-func encodeSearchDone(messageID uint64, ldapResultCode LDAPResultCode) *ber.Packet {
+func encodeSearchReference(messageID uint64, urls []string) *ber.Packet {
+	responsePacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	responsePacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	reference := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationSearchResultReference, nil, "Search Result Reference")
+	for _, url := range urls {
+		reference.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, url, "URI"))
+	}
+	responsePacket.AppendChild(reference)
+	return responsePacket
+}
+
+func encodeIntermediateResponse(messageID uint64, name string, value []byte) *ber.Packet {
+	responsePacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	responsePacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationIntermediateResponse, nil, "Intermediate Response")
+	if name != "" {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, name, "responseName"))
+	}
+	if value != nil {
+		response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, string(value), "responseValue"))
+	}
+	responsePacket.AppendChild(response)
+	return responsePacket
+}
+
+func encodeSearchDone(messageID uint64, res ServerSearchResult) *ber.Packet {
 	responsePacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
 	responsePacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
 	donePacket := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationSearchResultDone, nil, "Search result done")
-	donePacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldapResultCode), "resultCode: "))
+	donePacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(res.ResultCode), "resultCode: "))
 	donePacket.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN: "))
 	donePacket.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "errorMessage: "))
+	if res.ResultCode == LDAPResultReferral && len(res.Referrals) > 0 {
+		donePacket.AppendChild(encodeReferral(res.Referrals))
+	}
 	responsePacket.AppendChild(donePacket)
+	if len(res.Controls) > 0 {
+		responsePacket.AppendChild(encodeControls(res.Controls))
+	}
 
 	return responsePacket
 }
+
+// encodeReferral encodes the referral field of an LDAPResult:
+// Referral ::= [3] SEQUENCE SIZE (1..MAX) OF uri URI
+func encodeReferral(urls []string) *ber.Packet {
+	referral := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "Referral")
+	for _, url := range urls {
+		referral.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, url, "URI"))
+	}
+	return referral
+}
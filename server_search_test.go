@@ -1,10 +1,20 @@
 package ldap
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+
+	"go.linka.cloud/ldap/schema"
 )
 
 func TestSearchSimpleOK(t *testing.T) {
@@ -63,7 +73,7 @@ func TestSearchSizelimit(t *testing.T) {
 		cmd = exec.Command("ldapsearch", "-H", ldapURL, "-x",
 			"-b", serverBaseDN, "-D", "cn=testy,"+serverBaseDN, "-w", "iLike2test", "-z", "2")
 		out, _ = cmd.CombinedOutput()
-		if !strings.Contains(string(out), "result: 0 Success") {
+		if !strings.Contains(string(out), "result: 4 Size limit exceeded") {
 			t.Errorf("ldapsearch failed: %v", string(out))
 		}
 		if !strings.Contains(string(out), "numEntries: 2") {
@@ -73,7 +83,7 @@ func TestSearchSizelimit(t *testing.T) {
 		cmd = exec.Command("ldapsearch", "-H", ldapURL, "-x",
 			"-b", serverBaseDN, "-D", "cn=testy,"+serverBaseDN, "-w", "iLike2test", "-z", "1")
 		out, _ = cmd.CombinedOutput()
-		if !strings.Contains(string(out), "result: 0 Success") {
+		if !strings.Contains(string(out), "result: 4 Size limit exceeded") {
 			t.Errorf("ldapsearch failed: %v", string(out))
 		}
 		if !strings.Contains(string(out), "numEntries: 1") {
@@ -182,6 +192,17 @@ var searchFilterTestFilters = []compileSearchFilterTest{
 	{name: "notOk", filterStr: "(!(uid=ned))", numResponses: "3"},
 	{name: "notOk", filterStr: "(!(uid=foo))", numResponses: "4"},
 	{name: "notAndOrOk", filterStr: "(&(|(uid=ned)(uid=trent))(!(objectclass=posixgroup)))", numResponses: "3"},
+	{name: "greaterOrEqualOk", filterStr: "(uidNumber>=5005)", numResponses: "3"},
+	{name: "lessOrEqualOk", filterStr: "(uidNumber<=5005)", numResponses: "3"},
+	{name: "lessOrEqualNo", filterStr: "(uidNumber<=4000)", numResponses: "1"},
+	{name: "approxOk", filterStr: "(uid~=nedd)", numResponses: "2"},
+	{name: "approxNo", filterStr: "(uid~=bob)", numResponses: "1"},
+	{name: "substringsOk", filterStr: "(cn=r*n*y)", numResponses: "2"},
+	{name: "substringsNo", filterStr: "(cn=r*y*n)", numResponses: "1"},
+	{name: "escapedNo", filterStr: "(description=ned via sa\\2a)", numResponses: "1"},
+	{name: "extensibleOk", filterStr: "(uid:caseExactMatch:=ned)", numResponses: "2"},
+	{name: "extensibleNo", filterStr: "(uid:caseExactMatch:=Ned)", numResponses: "1"},
+	{name: "extensibleDNOk", filterStr: "(o:dn:=testers)", numResponses: "4"},
 	/*
 		compileSearchFilterTest{filterStr: "(sn=Mill*)", filterType: FilterSubstrings},
 		compileSearchFilterTest{filterStr: "(sn=*Mill)", filterType: FilterSubstrings},
@@ -226,6 +247,80 @@ func TestSearchFiltering(t *testing.T) {
 		})
 }
 
+func TestSearchOrderingFilters(t *testing.T) {
+	uidNumber, err := schema.ParseAttributeType("( 1.3.6.1.1.1.1.0 NAME 'uidNumber' EQUALITY integerMatch ORDERING integerOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.27 SINGLE-VALUE )")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := schema.New()
+	if err := sc.AddAttributeType(uidNumber); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		schema *schema.Schema
+		filter string
+		cns    []string
+	}{
+		{nil, "(uidNumber>=5005)", []string{"trent", "randy"}},
+		{nil, "(uidNumber<=05005)", nil},
+		{sc, "(uidNumber<=05005)", []string{"ned", "trent"}},
+		{sc, "(uidNumber>=600)", []string{"ned", "trent", "randy"}},
+		{nil, "(uidNumber>=600)", nil},
+		{nil, "(&(uid>=n)(uid<=rz))", []string{"ned", "randy"}},
+		{nil, "(cn~=Rendy)", []string{"randy"}},
+		{nil, "(description~=trend via)", []string{"trent"}},
+		{sc, "(uidNumber~=05555)", []string{"randy"}},
+	} {
+		s := NewServer()
+		s.EnforceLDAP = true
+		s.Schema = tt.schema
+		s.SearchFunc("", searchSimple{})
+		s.BindFunc("", bindAnonOK{})
+
+		LaunchServerForTest(t, s, func() {
+			l := dialForTest(t)
+			defer l.Close()
+
+			res, err := l.Search(ldap.NewSearchRequest(serverBaseDN, ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, tt.filter, []string{"cn"}, nil))
+			if err != nil {
+				t.Fatalf("%s: search failed: %s", tt.filter, err.Error())
+			}
+			var cns []string
+			for _, e := range res.Entries {
+				cns = append(cns, e.GetAttributeValue("cn"))
+			}
+			if strings.Join(cns, ",") != strings.Join(tt.cns, ",") {
+				t.Errorf("%s with schema %v: expected %v, got %v", tt.filter, tt.schema != nil, tt.cns, cns)
+			}
+		})
+	}
+}
+
+func TestSearchSizeLimitExceeded(t *testing.T) {
+	s := NewServer()
+	s.EnforceLDAP = true
+	s.SearchFunc("", searchSimple{})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		res, err := l.Search(ldap.NewSearchRequest(serverBaseDN, ScopeWholeSubtree, NeverDerefAliases, 2, 0, false, "(objectClass=*)", nil, nil))
+		if !ldap.IsErrorWithCode(err, LDAPResultSizeLimitExceeded) {
+			t.Errorf("expected sizeLimitExceeded, got %v", err)
+		}
+		if res == nil || len(res.Entries) != 2 {
+			t.Errorf("expected the first 2 entries, got %v", res)
+		}
+		// a limit the entries fit in is not exceeded
+		res, err = l.Search(ldap.NewSearchRequest(serverBaseDN, ScopeWholeSubtree, NeverDerefAliases, 3, 0, false, "(objectClass=*)", nil, nil))
+		if err != nil || len(res.Entries) != 3 {
+			t.Errorf("search within the size limit failed: %v", err)
+		}
+	})
+}
+
 // ///////////////////////
 func TestSearchAttributes(t *testing.T) {
 	s := NewServer()
@@ -351,6 +446,67 @@ func TestSearchScopeCaseInsensitive(t *testing.T) {
 	})
 }
 
+func TestSearchScopeDN(t *testing.T) {
+	s := NewServer()
+	s.EnforceLDAP = true
+	s.SearchFunc("", searchDNs{})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		for _, tt := range []struct {
+			baseDN string
+			scope  int
+			cns    string
+		}{
+			{"ou=People, dc=Example", ScopeSingleLevel, "Smith, John,a,x"},
+			{"cn=Smith\\, John,ou=people,dc=example", ScopeBaseObject, "Smith, John"},
+			{"cn=Smith\\2C John,ou=people,dc=example", ScopeSingleLevel, "Smith, John child"},
+			{"CN=A+UID=B,ou=people,dc=example", ScopeBaseObject, "a"},
+			{"cn=#040178,ou=people,dc=example", ScopeBaseObject, "x"},
+			{"dc=example", ScopeSingleLevel, "People"},
+			{"ou=People\\,dc=example", ScopeSingleLevel, ""},
+		} {
+			res, err := l.Search(ldap.NewSearchRequest(tt.baseDN, tt.scope, NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"cn"}, nil))
+			if err != nil {
+				t.Fatalf("%s: search failed: %s", tt.baseDN, err.Error())
+			}
+			var cns []string
+			for _, e := range res.Entries {
+				cns = append(cns, e.GetAttributeValue("cn"))
+			}
+			if strings.Join(cns, ",") != tt.cns {
+				t.Errorf("%s (scope %d): expected %s, got %v", tt.baseDN, tt.scope, tt.cns, cns)
+			}
+		}
+
+		_, err := l.Search(ldap.NewSearchRequest("cn=a,", ScopeBaseObject, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+		if !ldap.IsErrorWithCode(err, LDAPResultInvalidDNSyntax) {
+			t.Errorf("an invalid base DN should fail with invalidDNSyntax: %v", err)
+		}
+	})
+}
+
+type searchDNs struct{}
+
+func (s searchDNs) Search(ctx context.Context, boundDN string, searchReq SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	entry := func(dn, cn string) *Entry {
+		return &Entry{DN: dn, Attributes: []*EntryAttribute{
+			{Name: "cn", Values: []string{cn}},
+			{Name: "objectClass", Values: []string{"person"}},
+		}}
+	}
+	return ServerSearchResult{Entries: []*Entry{
+		entry("ou=People,dc=example", "People"),
+		entry("cn=Smith\\, John,ou=People,dc=example", "Smith, John"),
+		entry("cn=child,cn=Smith\\, John,ou=People,dc=example", "Smith, John child"),
+		entry("cn=a+uid=b,ou=People,dc=example", "a"),
+		entry("cn=x,ou=People,dc=example", "x"),
+	}, ResultCode: LDAPResultSuccess}, nil
+}
+
 func TestSearchControls(t *testing.T) {
 	s := NewServer()
 	s.SearchFunc("", searchControls{})
@@ -387,3 +543,649 @@ func TestSearchControls(t *testing.T) {
 
 	})
 }
+
+func TestSearchStream(t *testing.T) {
+	s := NewServer()
+	s.EnforceLDAP = true
+	h := &searchStream{written: make(chan int, 1)}
+	s.SearchStreamFunc("", h)
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		res, err := l.Search(ldap.NewSearchRequest(serverBaseDN, ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(uidNumber=5001)", []string{"cn"}, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 || res.Entries[0].DN != "cn=user1,"+serverBaseDN {
+			t.Errorf("streamed entries were not filtered: %v", res.Entries)
+		} else if len(res.Entries[0].Attributes) != 1 {
+			t.Errorf("streamed attributes were not filtered: %v", res.Entries[0].Attributes)
+		}
+		if len(res.Referrals) != 1 || res.Referrals[0] != "ldap://other.example.com/"+serverBaseDN {
+			t.Errorf("streamed reference missing: %v", res.Referrals)
+		}
+		if n := <-h.written; n != 1000 {
+			t.Errorf("handler should have streamed every entry, wrote %d", n)
+		}
+
+		res, err = l.Search(ldap.NewSearchRequest(serverBaseDN, ScopeWholeSubtree, NeverDerefAliases, 5, 0, false, "(objectClass=*)", nil, nil))
+		if !ldap.IsErrorWithCode(err, LDAPResultSizeLimitExceeded) {
+			t.Fatalf("expected sizeLimitExceeded, got %v", err)
+		}
+		if len(res.Entries) != 5 {
+			t.Errorf("expected 5 entries with a size limit, got %d", len(res.Entries))
+		}
+		if n := <-h.written; n != 5 {
+			t.Errorf("handler should have stopped at the size limit, wrote %d", n)
+		}
+	})
+}
+
+// searchStream streams a thousand entries and reports how many it wrote before
+// the writer asked it to stop.
+type searchStream struct {
+	written chan int
+}
+
+func (s *searchStream) SearchStream(ctx context.Context, boundDN string, searchReq SearchRequest, w SearchResultWriter, conn net.Conn) (ServerSearchResult, error) {
+	if err := w.WriteReference("ldap://other.example.com/" + serverBaseDN); err != nil {
+		return ServerSearchResult{}, err
+	}
+	n := 0
+	for ; n < 1000; n++ {
+		err := w.WriteEntry(&Entry{DN: fmt.Sprintf("cn=user%d,%s", n, serverBaseDN), Attributes: []*EntryAttribute{
+			{Name: "cn", Values: []string{fmt.Sprintf("user%d", n)}},
+			{Name: "uidNumber", Values: []string{fmt.Sprintf("%d", 5000+n)}},
+			{Name: "objectclass", Values: []string{"posixaccount"}},
+		}})
+		if errors.Is(err, ErrSizeLimitExceeded) {
+			break
+		}
+		if err != nil {
+			return ServerSearchResult{}, err
+		}
+	}
+	s.written <- n
+	return ServerSearchResult{ResultCode: LDAPResultSuccess}, nil
+}
+
+func TestSearchResultReferencesAndControls(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("", searchResults{})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		res, err := l.Search(ldap.NewSearchRequest("ou=success", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 1 {
+			t.Errorf("expected 1 entry, got %d", len(res.Entries))
+		}
+		if len(res.Referrals) != 2 || res.Referrals[0] != "ldap://a.example.com/ou=success" || res.Referrals[1] != "ldap://b.example.com/ou=success" {
+			t.Errorf("continuation references missing: %v", res.Referrals)
+		}
+		if c := ldap.FindControl(res.Controls, "1.2.3.4.5"); c == nil || c.(*ldap.ControlString).ControlValue != "done" {
+			t.Errorf("response control missing: %v", res.Controls)
+		}
+
+		_, err = l.Search(ldap.NewSearchRequest("ou=sizelimit", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+		if !ldap.IsErrorWithCode(err, LDAPResultSizeLimitExceeded) {
+			t.Errorf("handler result code was not sent: %v", err)
+		}
+
+		conn := rawConnForTest(t)
+		defer conn.Close()
+		sendRequestForTest(t, conn, 1, encodeSearchRequestForTest("ou=referral", "(objectClass=*)"))
+		_, done := readResponseForTest(t, conn)
+		if done.Tag != ApplicationSearchResultDone || done.Children[0].Value.(int64) != LDAPResultReferral {
+			t.Fatalf("expected a referral result, got %s", ApplicationMap[done.Tag])
+		}
+		if len(done.Children) != 4 || done.Children[3].Tag != 3 || len(done.Children[3].Children) != 1 ||
+			done.Children[3].Children[0].Value.(string) != "ldap://a.example.com/ou=referral" {
+			t.Errorf("referral URL missing from the search result done")
+		}
+	})
+}
+
+// searchResults returns a result whose code depends on the requested base DN.
+type searchResults struct{}
+
+func (s searchResults) Search(ctx context.Context, boundDN string, searchReq SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	switch searchReq.BaseDN {
+	case "ou=sizelimit":
+		return ServerSearchResult{ResultCode: LDAPResultSizeLimitExceeded}, nil
+	case "ou=referral":
+		return ServerSearchResult{
+			Referrals:  []string{"ldap://a.example.com/ou=referral"},
+			ResultCode: LDAPResultReferral,
+		}, nil
+	}
+	return ServerSearchResult{
+		Entries:    []*Entry{{DN: "cn=ned,ou=success", Attributes: []*EntryAttribute{{Name: "cn", Values: []string{"ned"}}}}},
+		Referrals:  []string{"ldap://a.example.com/ou=success", "ldap://b.example.com/ou=success"},
+		Controls:   []Control{ldap.NewControlString("1.2.3.4.5", false, "done")},
+		ResultCode: LDAPResultSuccess,
+	}, nil
+}
+
+func TestSearchPaging(t *testing.T) {
+	s := NewServer()
+	s.EnforceLDAP = true
+	s.SearchFunc("", searchMany{})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		req := ldap.NewSearchRequest("o=testers,c=test", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"cn"}, nil)
+		res, err := l.SearchWithPaging(req, 10)
+		if err != nil {
+			t.Fatalf("paged search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 25 {
+			t.Errorf("expected 25 entries, got %d", len(res.Entries))
+		}
+		if res.Entries[24].GetAttributeValue("cn") != "user24" || len(res.Entries[24].Attributes) != 1 {
+			t.Errorf("unexpected last entry: %v", res.Entries[24])
+		}
+
+		// the first page and its cookie
+		paging := ldap.NewControlPaging(10)
+		req = ldap.NewSearchRequest("o=testers,c=test", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(cn=user1*)", nil, []Control{paging})
+		res, err = l.Search(req)
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		response, ok := ldap.FindControl(res.Controls, ControlTypePaging).(*ControlPaging)
+		if len(res.Entries) != 10 || !ok || len(response.Cookie) == 0 || response.PagingSize != 11 {
+			t.Fatalf("unexpected first page: %d entries, control %v", len(res.Entries), response)
+		}
+
+		// a different search cannot continue it
+		paging.SetCookie(response.Cookie)
+		other := ldap.NewSearchRequest("o=testers,c=test", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(cn=user2*)", nil, []Control{paging})
+		if _, err := l.Search(other); !ldap.IsErrorWithCode(err, LDAPResultUnwillingToPerform) {
+			t.Errorf("cookie of another search accepted: %v", err)
+		}
+
+		// a size of 0 abandons the paged search and releases the cookie
+		paging.PagingSize = 0
+		res, err = l.Search(req)
+		if err != nil || len(res.Entries) != 0 {
+			t.Fatalf("abandoning the paged search failed: %v", err)
+		}
+		paging.PagingSize = 10
+		if _, err := l.Search(req); !ldap.IsErrorWithCode(err, LDAPResultUnwillingToPerform) {
+			t.Errorf("abandoned cookie still accepted: %v", err)
+		}
+	})
+}
+
+func TestSearchPagingCritical(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("", searchMany{})
+	s.SearchFunc("dc=example,dc=com", &searchPager{released: make(chan string, 1)})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		critical := &ldap.ControlString{ControlType: ControlTypePaging, Criticality: true, ControlValue: ldap.NewControlPaging(10).Encode().Children[1].Data.String()}
+		search := func(baseDN string, paging Control) (*ldap.SearchResult, error) {
+			return l.Search(ldap.NewSearchRequest(baseDN, ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, []Control{paging}))
+		}
+
+		// without EnforceLDAP, only handlers paging natively page
+		if _, err := search("o=testers,c=test", critical); !ldap.IsErrorWithCode(err, LDAPResultUnavailableCriticalExtension) {
+			t.Errorf("critical paging should fail: %v", err)
+		}
+		if res, err := search("o=testers,c=test", ldap.NewControlPaging(10)); err != nil || len(res.Entries) != 25 {
+			t.Errorf("non critical paging should be ignored: %v", err)
+		}
+		if res, err := search("dc=example,dc=com", critical); err != nil || len(res.Entries) != 10 {
+			t.Errorf("critical paging by the handler failed: %v", err)
+		}
+	})
+}
+
+func TestSearchNativePaging(t *testing.T) {
+	pager := &searchPager{released: make(chan string, 1)}
+	s := NewServer()
+	s.SearchFunc("", pager)
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		req := ldap.NewSearchRequest("o=testers,c=test", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil)
+		res, err := l.SearchWithPaging(req, 10)
+		if err != nil {
+			t.Fatalf("paged search failed: %s", err.Error())
+		}
+		if len(res.Entries) != 25 {
+			t.Errorf("expected 25 entries, got %d", len(res.Entries))
+		}
+
+		paging := ldap.NewControlPaging(10)
+		req = ldap.NewSearchRequest("o=testers,c=test", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, []Control{paging})
+		res, err = l.Search(req)
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		cookie := ldap.FindControl(res.Controls, ControlTypePaging).(*ControlPaging).Cookie
+		if string(cookie) == "10" {
+			t.Errorf("backend cookie sent to the client")
+		}
+		paging.PagingSize = 0
+		paging.SetCookie(cookie)
+		if _, err := l.Search(req); err != nil {
+			t.Fatalf("abandoning the paged search failed: %s", err.Error())
+		}
+		select {
+		case c := <-pager.released:
+			if c != "10" {
+				t.Errorf("released backend cookie %q, expected 10", c)
+			}
+		case <-time.After(timeout):
+			t.Errorf("backend cursor was not released")
+		}
+	})
+}
+
+func TestSearchSorting(t *testing.T) {
+	s := NewServer()
+	s.EnforceLDAP = true
+	s.SearchFunc("", searchMany{})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		search := func(sizeLimit int, controls ...Control) (*ldap.SearchResult, error) {
+			t.Helper()
+			res, err := l.Search(ldap.NewSearchRequest("o=testers,c=test", ScopeWholeSubtree, NeverDerefAliases, sizeLimit, 0, false, "(objectClass=*)", nil, controls))
+			// the 25 entries exceed any size limit
+			if sizeLimit > 0 && err == nil {
+				t.Errorf("the size limit of %d should be exceeded", sizeLimit)
+			}
+			if ldap.IsErrorWithCode(err, LDAPResultSizeLimitExceeded) {
+				err = nil
+			}
+			return res, err
+		}
+		cns := func(res *ldap.SearchResult) string {
+			var cns []string
+			for _, entry := range res.Entries {
+				cns = append(cns, entry.GetAttributeValue("cn"))
+			}
+			return strings.Join(cns, ",")
+		}
+
+		res, err := search(3, ldap.NewControlServerSideSortingWithSortKeys([]*SortKey{{AttributeType: "CN", Reverse: true}}))
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if got := cns(res); got != "user9,user8,user7" {
+			t.Errorf("unexpected reverse order: %s", got)
+		}
+
+		res, err = search(3, &ControlServerSideSorting{SortKeys: []*SortKey{{AttributeType: "uidNumber", MatchingRule: "2.5.13.15"}}})
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if got := cns(res); got != "user24,user23,user22" {
+			t.Errorf("unexpected integer order: %s", got)
+		}
+
+		// secondary keys break ties, entries without a value come last
+		res, err = search(0, &ControlServerSideSorting{SortKeys: []*SortKey{{AttributeType: "description"}, {AttributeType: "cn"}}})
+		if err != nil {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		if got := cns(res); !strings.HasPrefix(got, "user0,user1,user10,user11") {
+			t.Errorf("unexpected multi key order: %s", got)
+		}
+		if ldap.FindControl(res.Controls, ControlTypeServerSideSortingResult) == nil {
+			t.Errorf("sort response control missing")
+		}
+
+		// an unknown ordering rule is only fatal to a critical sort
+		unsortable := &ControlServerSideSorting{SortKeys: []*SortKey{{AttributeType: "cn", MatchingRule: "1.2.3.4"}}}
+		res, err = search(0, unsortable)
+		if err != nil || len(res.Entries) != 25 || res.Entries[0].GetAttributeValue("cn") != "user0" {
+			t.Errorf("non critical sort failure should return unsorted entries: %v", err)
+		}
+		unsortable.Criticality = true
+		if _, err := search(0, unsortable); !ldap.IsErrorWithCode(err, LDAPResultUnavailableCriticalExtension) {
+			t.Errorf("critical sort failure should fail the search: %v", err)
+		}
+
+		conn := rawConnForTest(t)
+		defer conn.Close()
+		sendRequestForTest(t, conn, 1, encodeSearchRequestForTest("o=testers,c=test", "(objectClass=*)"), unsortable)
+		done := readMessageForTest(t, conn)
+		for done.Children[1].Tag != ApplicationSearchResultDone {
+			done = readMessageForTest(t, conn)
+		}
+		if len(done.Children) != 3 || len(done.Children[2].Children) != 1 {
+			t.Fatalf("sort response control missing")
+		}
+		value, err := ber.DecodePacketErr(done.Children[2].Children[0].Children[1].Data.Bytes())
+		if err != nil {
+			t.Fatalf("bad sort response control: %s", err.Error())
+		}
+		if code := value.Children[0].Value.(int64); code != LDAPResultInappropriateMatching {
+			t.Errorf("expected inappropriateMatching sort result, got %d", code)
+		}
+		if len(value.Children) != 2 || ber.DecodeString(value.Children[1].Data.Bytes()) != "cn" {
+			t.Errorf("unsortable attribute missing from the sort response")
+		}
+	})
+}
+
+func TestSearchSortingSchema(t *testing.T) {
+	at, err := schema.ParseAttributeType("( 1.3.6.1.1.1.1.0 NAME 'uidNumber' EQUALITY integerMatch ORDERING integerOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.27 SINGLE-VALUE )")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := schema.New()
+	if err := sc.AddAttributeType(at); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.EnforceLDAP = true
+	s.Schema = sc
+	s.SearchFunc("", searchMany{})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		// uidNumber names no rule: its integer ORDERING rule applies
+		sorting := &ControlServerSideSorting{SortKeys: []*SortKey{{AttributeType: "uidNumber"}}}
+		res, err := l.Search(ldap.NewSearchRequest("o=testers,c=test", ScopeWholeSubtree, NeverDerefAliases, 3, 0, false, "(objectClass=*)", []string{"cn"}, []Control{sorting}))
+		if err != nil && !ldap.IsErrorWithCode(err, LDAPResultSizeLimitExceeded) {
+			t.Fatalf("search failed: %s", err.Error())
+		}
+		var cns []string
+		for _, entry := range res.Entries {
+			cns = append(cns, entry.GetAttributeValue("cn"))
+		}
+		if got := strings.Join(cns, ","); got != "user24,user23,user22" {
+			t.Errorf("unexpected schema order: %s", got)
+		}
+	})
+}
+
+func TestSearchSortingCritical(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("", searchMany{})
+	s.SearchFunc("dc=example,dc=com", &searchPager{released: make(chan string, 1)})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		search := func(baseDN string, controls ...Control) (*ldap.SearchResult, error) {
+			return l.Search(ldap.NewSearchRequest(baseDN, ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, controls))
+		}
+		sorting := &ControlServerSideSorting{SortKeys: []*SortKey{{AttributeType: "cn", Reverse: true}}}
+		// without EnforceLDAP, the server doesn't sort
+		if res, err := search("o=testers,c=test", sorting); err != nil || len(res.Entries) != 25 || res.Entries[0].GetAttributeValue("cn") != "user0" {
+			t.Errorf("non critical sort should return unsorted entries: %v", err)
+		}
+		sorting.Criticality = true
+		if _, err := search("o=testers,c=test", sorting); !ldap.IsErrorWithCode(err, LDAPResultUnavailableCriticalExtension) {
+			t.Errorf("critical sort should fail without EnforceLDAP: %v", err)
+		}
+		// nor the pages of a PagedSearcher
+		if _, err := search("dc=example,dc=com", sorting, ldap.NewControlPaging(10)); !ldap.IsErrorWithCode(err, LDAPResultUnavailableCriticalExtension) {
+			t.Errorf("critical sort of native pages should fail: %v", err)
+		}
+	})
+}
+
+func TestSearchVLV(t *testing.T) {
+	s := NewServer()
+	s.EnforceLDAP = true
+	s.SearchFunc("", searchMany{})
+	s.SearchFunc("ou=native,o=testers,c=test", searchVLVNative{})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		byCN := &ControlServerSideSorting{SortKeys: []*SortKey{{AttributeType: "cn"}}}
+		search := func(baseDN string, controls ...Control) (*ldap.SearchResult, error) {
+			return l.Search(ldap.NewSearchRequest(baseDN, ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, controls))
+		}
+		check := func(res *ldap.SearchResult, cns string, target, count int) {
+			t.Helper()
+			var got []string
+			for _, entry := range res.Entries {
+				got = append(got, entry.GetAttributeValue("cn"))
+			}
+			if strings.Join(got, ",") != cns {
+				t.Errorf("expected %s, got %v", cns, got)
+			}
+			c, ok := ldap.FindControl(res.Controls, ControlTypeVLVResponse).(*ldap.ControlString)
+			if !ok {
+				t.Fatalf("vlv response control missing")
+			}
+			value, err := ber.DecodePacketErr([]byte(c.ControlValue))
+			if err != nil {
+				t.Fatalf("bad vlv response control: %s", err.Error())
+			}
+			if value.Children[0].Value.(int64) != int64(target) || value.Children[1].Value.(int64) != int64(count) || value.Children[2].Value.(int64) != LDAPResultSuccess {
+				t.Errorf("expected target %d of %d, got %d of %d (%d)", target, count, value.Children[0].Value, value.Children[1].Value, value.Children[2].Value)
+			}
+		}
+
+		// sorted by cn, user2 is the 13th entry: user0, user1, user10 to user19, user2
+		res, err := search("o=testers,c=test", byCN, &ControlVLV{BeforeCount: 1, AfterCount: 1, Offset: 13})
+		if err != nil {
+			t.Fatalf("vlv search failed: %s", err.Error())
+		}
+		check(res, "user19,user2,user20", 13, 25)
+
+		// the client only knows an estimate of the list size
+		res, err = search("o=testers,c=test", byCN, &ControlVLV{AfterCount: 1, Offset: 50, ContentCount: 50})
+		if err != nil {
+			t.Fatalf("vlv search failed: %s", err.Error())
+		}
+		check(res, "user9", 25, 25)
+
+		res, err = search("o=testers,c=test", byCN, &ControlVLV{BeforeCount: 0, AfterCount: 2, ByValue: true, AssertionValue: "USER3"})
+		if err != nil {
+			t.Fatalf("vlv search failed: %s", err.Error())
+		}
+		check(res, "user3,user4,user5", 19, 25)
+
+		res, err = search("o=testers,c=test", byCN, &ControlVLV{BeforeCount: 2, ByValue: true, AssertionValue: "zzz"})
+		if err != nil {
+			t.Fatalf("vlv search failed: %s", err.Error())
+		}
+		// an assertion value after every entry targets the last one
+		check(res, "user7,user8,user9", 25, 25)
+
+		if _, err := search("o=testers,c=test", &ControlVLV{Offset: 1}); !ldap.IsErrorWithCode(err, LDAPResultSortControlMissing) {
+			t.Errorf("vlv without sorting should fail: %v", err)
+		}
+		if _, err := search("o=testers,c=test", byCN, &ControlVLV{}); !ldap.IsErrorWithCode(err, LDAPResultOffsetRangeError) {
+			t.Errorf("vlv with a zero offset should fail: %v", err)
+		}
+
+		res, err = search("ou=native,o=testers,c=test", byCN, &ControlVLV{AfterCount: 1, Offset: 7})
+		if err != nil {
+			t.Fatalf("native vlv search failed: %s", err.Error())
+		}
+		check(res, "user6,user7", 7, 100)
+	})
+}
+
+func TestSearchPagingCursors(t *testing.T) {
+	pager := &searchPager{released: make(chan string, 1)}
+	s := NewServer()
+	s.EnforceLDAP = true
+	s.SearchFunc("", searchMany{})
+	s.SearchFunc("dc=example,dc=com", pager)
+	s.BindFunc("", bindAnonOK{})
+
+	released := func() {
+		t.Helper()
+		select {
+		case c := <-pager.released:
+			if c != "10" {
+				t.Errorf("released backend cookie %q, expected 10", c)
+			}
+		case <-time.After(timeout):
+			t.Errorf("backend cursor was not released")
+		}
+	}
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		// beyond maxCursors, the oldest paged search is released
+		paging := ldap.NewControlPaging(10)
+		req := ldap.NewSearchRequest("o=testers,c=test", ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, []Control{paging})
+		var cookies [][]byte
+		for i := 0; i <= maxCursors; i++ {
+			res, err := l.Search(req)
+			if err != nil {
+				t.Fatalf("search failed: %s", err.Error())
+			}
+			cookies = append(cookies, ldap.FindControl(res.Controls, ControlTypePaging).(*ControlPaging).Cookie)
+		}
+		paging.SetCookie(cookies[0])
+		if _, err := l.Search(req); !ldap.IsErrorWithCode(err, LDAPResultUnwillingToPerform) {
+			t.Errorf("the oldest paged search should be released: %v", err)
+		}
+		paging.SetCookie(cookies[maxCursors])
+		if res, err := l.Search(req); err != nil || len(res.Entries) != 10 {
+			t.Errorf("the latest paged search should go on: %v", err)
+		}
+
+		// abandoning a completed page leaves its paged search alone, as the
+		// client may have reused its message ID
+		conn := rawConnForTest(t)
+		defer conn.Close()
+		sendRequestForTest(t, conn, 1, encodeSearchRequestForTest("dc=example,dc=com", "(objectClass=*)"), ldap.NewControlPaging(10))
+		for _, res := readResponseForTest(t, conn); res.Tag != ApplicationSearchResultDone; _, res = readResponseForTest(t, conn) {
+		}
+		sendRequestForTest(t, conn, 2, ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, ApplicationAbandonRequest, int64(1), "Abandon Request"))
+		select {
+		case c := <-pager.released:
+			t.Errorf("abandoning a completed page released backend cookie %q", c)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// closing the connection releases every paged search
+		sendRequestForTest(t, conn, 3, encodeSearchRequestForTest("dc=example,dc=com", "(objectClass=*)"), ldap.NewControlPaging(10))
+		for _, res := readResponseForTest(t, conn); res.Tag != ApplicationSearchResultDone; _, res = readResponseForTest(t, conn) {
+		}
+		conn.Close()
+		released()
+		released()
+	})
+}
+
+func TestSearchVLVCritical(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("", searchMany{})
+	s.SearchFunc("ou=native,o=testers,c=test", searchVLVNative{})
+	s.BindFunc("", bindAnonOK{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		search := func(baseDN string, vlv *ControlVLV) (*ldap.SearchResult, error) {
+			byCN := &ControlServerSideSorting{SortKeys: []*SortKey{{AttributeType: "cn"}}}
+			return l.Search(ldap.NewSearchRequest(baseDN, ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, []Control{byCN, vlv}))
+		}
+		// without EnforceLDAP, only VLVSearchers serve VLV requests
+		vlv := &ControlVLV{AfterCount: 1, Offset: 7}
+		if res, err := search("o=testers,c=test", vlv); err != nil || len(res.Entries) != 25 {
+			t.Errorf("non critical vlv should be ignored: %v", err)
+		}
+		vlv.Criticality = true
+		if _, err := search("o=testers,c=test", vlv); !ldap.IsErrorWithCode(err, LDAPResultUnavailableCriticalExtension) {
+			t.Errorf("critical vlv should fail without EnforceLDAP: %v", err)
+		}
+		if res, err := search("ou=native,o=testers,c=test", vlv); err != nil || len(res.Entries) != 2 {
+			t.Errorf("critical vlv served by the handler failed: %v", err)
+		}
+	})
+}
+
+// searchVLVNative serves VLV requests from a list of 100 entries below
+// ou=native,o=testers,c=test it does not actually hold.
+type searchVLVNative struct {
+	searchMany
+}
+
+func (s searchVLVNative) SearchVLV(ctx context.Context, boundDN string, searchReq SearchRequest, vlv *ControlVLV, conn net.Conn) (ServerSearchResult, int, int, error) {
+	res, _ := s.Search(ctx, boundDN, searchReq, conn)
+	res.Entries = res.Entries[vlv.Offset-1 : vlv.Offset+vlv.AfterCount]
+	for _, entry := range res.Entries {
+		entry.DN = "cn=" + entry.GetAttributeValue("cn") + ",ou=native,o=testers,c=test"
+	}
+	res.Controls = []Control{&ControlServerSideSortingResult{}}
+	return res, vlv.Offset, 100, nil
+}
+
+// searchMany returns 25 entries, user0 to user24, with decreasing uidNumbers.
+type searchMany struct{}
+
+func (s searchMany) Search(ctx context.Context, boundDN string, searchReq SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	entries := make([]*Entry, 0, 25)
+	for i := 0; i < 25; i++ {
+		entries = append(entries, &Entry{DN: fmt.Sprintf("cn=user%d,o=testers,c=test", i), Attributes: []*EntryAttribute{
+			{Name: "cn", Values: []string{fmt.Sprintf("user%d", i)}},
+			{Name: "uidNumber", Values: []string{strconv.Itoa(1024 - 2*i)}},
+			{Name: "objectClass", Values: []string{"person"}},
+		}})
+	}
+	return ServerSearchResult{Entries: entries, ResultCode: LDAPResultSuccess}, nil
+}
+
+// searchPager pages through the entries of searchMany, using the offset of the
+// next page as its cookie.
+type searchPager struct {
+	searchMany
+	released chan string
+}
+
+func (s *searchPager) SearchPage(ctx context.Context, boundDN string, searchReq SearchRequest, size uint32, cookie []byte, conn net.Conn) (ServerSearchResult, []byte, error) {
+	if size == 0 {
+		s.released <- string(cookie)
+		return ServerSearchResult{ResultCode: LDAPResultSuccess}, nil, nil
+	}
+	res, _ := s.Search(ctx, boundDN, searchReq, conn)
+	offset := 0
+	if len(cookie) > 0 {
+		offset, _ = strconv.Atoi(string(cookie))
+	}
+	end := min(offset+int(size), len(res.Entries))
+	res.Entries = res.Entries[offset:end]
+	if end == 25 {
+		return res, nil, nil
+	}
+	return res, []byte(strconv.Itoa(end)), nil
+}
@@ -0,0 +1,208 @@
+package ldap
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+
+	"go.linka.cloud/ldap/schema"
+)
+
+// NativeSorter is implemented by search handlers that can sort their results
+// themselves. When SortsNatively reports true for the sort keys of a request
+// carrying the Server Side Sorting control (RFC 2891), the server sends the
+// entries in the order the handler produced them, and the handler is expected
+// to return the ControlServerSideSortingResult in its result controls.
+//
+// The server only sorts with EnforceLDAP, and not the pages of a
+// PagedSearcher: searches it leaves unsorted fail with
+// unavailableCriticalExtension when their sort control is critical.
+type NativeSorter interface {
+	SortsNatively(keys []*SortKey) bool
+}
+
+// errSortUnavailable fails searches with a critical sort control that nothing
+// sorts.
+var errSortUnavailable = NewError(LDAPResultUnavailableCriticalExtension, errors.New("server side sorting is not available"))
+
+// orderingRule compares attribute values for sorting. valid, when set,
+// reports whether a value can be ordered by the rule at all.
+type orderingRule struct {
+	compare func(a, b string) int
+	valid   func(v string) bool
+}
+
+// orderingRules are the ordering matching rules the server sorts with, by
+// lower-cased name and OID.
+var orderingRules = func() map[string]orderingRule {
+	rules := map[string]orderingRule{}
+	for _, r := range []struct {
+		names []string
+		rule  orderingRule
+	}{
+		{[]string{"caseIgnoreOrderingMatch", "2.5.13.3"}, orderingRule{compare: func(a, b string) int {
+			return strings.Compare(normalizeSpace(strings.ToLower(a)), normalizeSpace(strings.ToLower(b)))
+		}}},
+		{[]string{"caseExactOrderingMatch", "2.5.13.6"}, orderingRule{compare: func(a, b string) int {
+			return strings.Compare(normalizeSpace(a), normalizeSpace(b))
+		}}},
+		{[]string{"numericStringOrderingMatch", "2.5.13.9"}, orderingRule{compare: func(a, b string) int {
+			return compareIntegers(strings.ReplaceAll(a, " ", ""), strings.ReplaceAll(b, " ", ""))
+		}, valid: func(v string) bool {
+			return isInteger(strings.ReplaceAll(v, " ", "")) && !strings.HasPrefix(strings.TrimSpace(v), "-")
+		}}},
+		{[]string{"integerOrderingMatch", "2.5.13.15"}, orderingRule{compare: compareIntegers, valid: isInteger}},
+		{[]string{"octetStringOrderingMatch", "2.5.13.18"}, orderingRule{compare: func(a, b string) int {
+			return bytes.Compare([]byte(a), []byte(b))
+		}}},
+		{[]string{"generalizedTimeOrderingMatch", "2.5.13.28"}, orderingRule{compare: func(a, b string) int {
+			ta, _ := ber.ParseGeneralizedTime([]byte(a))
+			tb, _ := ber.ParseGeneralizedTime([]byte(b))
+			return ta.Compare(tb)
+		}, valid: func(v string) bool {
+			_, err := ber.ParseGeneralizedTime([]byte(v))
+			return err == nil
+		}}},
+	} {
+		for _, name := range r.names {
+			rules[strings.ToLower(name)] = r.rule
+		}
+	}
+	return rules
+}()
+
+// defaultOrderingRule orders the values of attribute types without an ordering
+// rule.
+var defaultOrderingRule = orderingRules["caseignoreorderingmatch"]
+
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func isInteger(v string) bool {
+	_, ok := new(big.Int).SetString(v, 10)
+	return ok
+}
+
+func compareIntegers(a, b string) int {
+	ia, _ := new(big.Int).SetString(a, 10)
+	ib, _ := new(big.Int).SetString(b, 10)
+	if ia == nil || ib == nil {
+		return strings.Compare(a, b)
+	}
+	return ia.Cmp(ib)
+}
+
+// sortKeyValues is the value an entry is sorted on for each sort key, nil
+// when the entry has none.
+type sortKeyValues []*string
+
+// sortEntries sorts entries in place following keys, with the ordering rules
+// of sc for keys that name none. On failure it returns the RFC 2891 sortResult
+// code and the attribute that could not be sorted, and leaves entries
+// untouched.
+func sortEntries(entries []*Entry, keys []*SortKey, sc *schema.Schema) (LDAPResultCode, string) {
+	rules, code, attribute := sortRules(keys, sc)
+	if code != LDAPResultSuccess {
+		return code, attribute
+	}
+
+	values := make(map[*Entry]sortKeyValues, len(entries))
+	for _, entry := range entries {
+		v := make(sortKeyValues, len(keys))
+		for i, key := range keys {
+			value, ok := sortValue(entry, key, rules[i])
+			if !ok {
+				return LDAPResultInappropriateMatching, key.AttributeType
+			}
+			v[i] = value
+		}
+		values[entry] = v
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := values[entries[i]], values[entries[j]]
+		for k, key := range keys {
+			switch {
+			case a[k] == nil && b[k] == nil:
+				continue
+			// entries without a value sort after all others (RFC 2891 1.2)
+			case a[k] == nil:
+				return false
+			case b[k] == nil:
+				return true
+			}
+			if c := rules[k].compare(*a[k], *b[k]); c != 0 {
+				return (c < 0) != key.Reverse
+			}
+		}
+		return false
+	})
+	return LDAPResultSuccess, ""
+}
+
+// sortRules returns the ordering rule of each sort key, that of its attribute
+// type in sc when it names none, or the sortResult code and attribute of the
+// first key whose rule is unknown.
+func sortRules(keys []*SortKey, sc *schema.Schema) ([]orderingRule, LDAPResultCode, string) {
+	rules := make([]orderingRule, len(keys))
+	for i, key := range keys {
+		rules[i] = attributeOrderingRule(sc, key.AttributeType)
+		if key.MatchingRule != "" {
+			rule, ok := orderingRules[strings.ToLower(key.MatchingRule)]
+			if !ok {
+				return nil, LDAPResultInappropriateMatching, key.AttributeType
+			}
+			rules[i] = rule
+		}
+	}
+	return rules, LDAPResultSuccess, ""
+}
+
+// sortValue returns the value entry is sorted on for key, nil when it has
+// none. A multi-valued attribute sorts on the value that comes first in the
+// requested order. It reports false when a value cannot be ordered by rule.
+func sortValue(entry *Entry, key *SortKey, rule orderingRule) (*string, bool) {
+	var v *string
+	for _, value := range entry.GetEqualFoldAttributeValues(key.AttributeType) {
+		if rule.valid != nil && !rule.valid(value) {
+			return nil, false
+		}
+		if v == nil || sortsBefore(rule, key.Reverse, value, *v) {
+			v = &value
+		}
+	}
+	return v, true
+}
+
+func sortsBefore(rule orderingRule, reverse bool, a, b string) bool {
+	c := rule.compare(a, b)
+	return c != 0 && (c < 0) != reverse
+}
+
+// sortPending sorts the entries buffered by w, adds the sort response control
+// to searchResp and returns its sortResult. When the entries cannot be sorted
+// they are left in the handler's order, unless the sort control is critical,
+// in which case the search fails with unavailableCriticalExtension.
+func (w *searchWriter) sortPending(searchResp *ServerSearchResult) (LDAPResultCode, error) {
+	code, attribute := sortEntries(w.pending, w.sorting.SortKeys, w.schema)
+	searchResp.Controls = append(searchResp.Controls, &ControlServerSideSortingResult{Result: code, AttributeType: attribute})
+	if code != LDAPResultSuccess && w.sorting.Criticality {
+		w.pending = nil
+		return code, NewError(LDAPResultUnavailableCriticalExtension, errors.New("cannot sort on "+attribute))
+	}
+	return code, nil
+}
+
+// limitPending applies the size limit to the entries buffered by w once they
+// are sorted.
+func (w *searchWriter) limitPending() {
+	if w.req.SizeLimit > 0 && len(w.pending) > w.req.SizeLimit {
+		w.pending = w.pending[:w.req.SizeLimit]
+		w.limited = true
+	}
+}
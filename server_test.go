@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"os/exec"
 	"strings"
 	"testing"
 	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
 )
 
 var (
@@ -53,6 +57,100 @@ func LaunchServerForTest(t *testing.T, s *Server, test func()) {
 	}, test)
 }
 
+// dialForTest connects a go-ldap client to the test server, retrying while the
+// server is still starting up.
+func dialForTest(t *testing.T) *ldap.Conn {
+	var err error
+	for i := 0; i < 20; i++ {
+		var l *ldap.Conn
+		if l, err = ldap.DialURL(ldapURL); err == nil {
+			return l
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("ldap.DialURL failed: %s", err.Error())
+	return nil
+}
+
+// rawConnForTest opens a plain connection to the test server, for tests that
+// need to send packets the go-ldap client can't produce.
+func rawConnForTest(t *testing.T) net.Conn {
+	var err error
+	for i := 0; i < 20; i++ {
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", listenString); err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("net.Dial failed: %s", err.Error())
+	return nil
+}
+
+// sendRequestForTest wraps op and controls in an LDAPMessage and writes it to
+// conn.
+func sendRequestForTest(t *testing.T, conn net.Conn, messageID int64, op *ber.Packet, controls ...Control) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(op)
+	if len(controls) > 0 {
+		packet.AppendChild(encodeControls(controls))
+	}
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		t.Fatalf("write failed: %s", err.Error())
+	}
+}
+
+// readResponseForTest reads the next LDAPMessage from conn and returns its
+// message ID and protocol op.
+func readResponseForTest(t *testing.T, conn net.Conn) (int64, *ber.Packet) {
+	packet := readMessageForTest(t, conn)
+	return packet.Children[0].Value.(int64), packet.Children[1]
+}
+
+// readMessageForTest reads the next LDAPMessage from conn.
+func readMessageForTest(t *testing.T, conn net.Conn) *ber.Packet {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	packet, err := ber.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("read failed: %s", err.Error())
+	}
+	return packet
+}
+
+func encodeSearchRequestForTest(baseDN, filter string) *ber.Packet {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationSearchRequest, nil, "Search Request")
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, baseDN, "Base DN"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ScopeWholeSubtree), "Scope"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(NeverDerefAliases), "Deref Aliases"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Size Limit"))
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Time Limit"))
+	req.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	f, _ := CompileFilter(filter)
+	req.AppendChild(f)
+	req.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes"))
+	return req
+}
+
+func encodeCancelRequestForTest(messageID int64) *ber.Packet {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "cancelRequestValue")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "cancelID"))
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationExtendedRequest, nil, "Extended Request")
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, ExtendedOperationCancel, "requestName"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, string(value.Bytes()), "requestValue"))
+	return req
+}
+
+func encodeCompareRequestForTest(dn, attribute, value string) *ber.Packet {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ApplicationCompareRequest, nil, "Compare Request")
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+	ava := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "AttributeValueAssertion")
+	ava.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "AttributeDesc"))
+	ava.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "AssertionValue"))
+	req.AppendChild(ava)
+	return req
+}
+
 // ///////////////////////
 func TestBindAnonOK(t *testing.T) {
 	s := NewServer()
@@ -224,6 +322,214 @@ func TestSearchStats(t *testing.T) {
 	}
 }
 
+// ///////////////////////
+func TestConcurrentOperations(t *testing.T) {
+	s := NewServer()
+	release := make(chan struct{})
+	s.BindFunc("", bindAnonOK{})
+	s.SearchFunc("", searchBlocking{release: release})
+	s.CompareFunc("", compareTrue{})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		searched := make(chan error)
+		go func() {
+			_, err := l.Search(ldap.NewSearchRequest(serverBaseDN, ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+			searched <- err
+		}()
+
+		// the compare must complete while the search is still blocked
+		if ok, err := l.Compare("cn=ned,"+serverBaseDN, "cn", "ned"); err != nil || !ok {
+			t.Errorf("compare behind a running search failed: %v %v", ok, err)
+		}
+		select {
+		case <-searched:
+			t.Errorf("search completed before it was released")
+		default:
+		}
+		close(release)
+		if err := <-searched; err != nil {
+			t.Errorf("search failed: %s", err.Error())
+		}
+	})
+}
+
+func TestMaxOutstanding(t *testing.T) {
+	s := NewServer()
+	s.MaxOutstanding = 1
+	started, release := make(chan struct{}), make(chan struct{})
+	s.BindFunc("", bindAnonOK{})
+	s.SearchFunc("", searchBlocking{release: release, started: started})
+	s.CompareFunc("", compareAfter{release})
+
+	LaunchServerForTest(t, s, func() {
+		l := dialForTest(t)
+		defer l.Close()
+
+		searched := make(chan error)
+		go func() {
+			_, err := l.Search(ldap.NewSearchRequest(serverBaseDN, ScopeWholeSubtree, NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil))
+			searched <- err
+		}()
+		select {
+		case <-started:
+		case <-time.After(timeout / 2):
+			t.Fatalf("search did not start")
+		}
+
+		// the compare is only processed once the search returned
+		compared := make(chan error)
+		go func() {
+			_, err := l.Compare("cn=ned,"+serverBaseDN, "cn", "ned")
+			compared <- err
+		}()
+		// give the compare time to reach the server before the release
+		select {
+		case <-compared:
+			t.Errorf("compare ran while the connection was at its outstanding limit")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		if err := <-searched; err != nil {
+			t.Errorf("search failed: %s", err.Error())
+		}
+		if err := <-compared; err != nil {
+			t.Errorf("compare failed: %s", err.Error())
+		}
+	})
+}
+
+func TestAbandon(t *testing.T) {
+	s := NewServer()
+	h := &abandonRecorder{cancelled: make(chan error, 1), abandoned: make(chan uint64, 1)}
+	s.SearchFunc("", h)
+	s.AbandonFunc("", h)
+	s.CompareFunc("", compareTrue{})
+
+	LaunchServerForTest(t, s, func() {
+		conn := rawConnForTest(t)
+		defer conn.Close()
+
+		sendRequestForTest(t, conn, 1, encodeSearchRequestForTest(serverBaseDN, "(objectClass=*)"))
+		abandon := ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, ApplicationAbandonRequest, int64(1), "Abandon Request")
+		sendRequestForTest(t, conn, 2, abandon)
+
+		select {
+		case err := <-h.cancelled:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("search context should have been cancelled, got %v", err)
+			}
+		case <-time.After(timeout / 2):
+			t.Fatalf("search was not cancelled by abandon")
+		}
+		if id := <-h.abandoned; id != 1 {
+			t.Errorf("Abandoner got message ID %d, expected 1", id)
+		}
+
+		// the connection stays open and the abandoned search gets no response
+		sendRequestForTest(t, conn, 3, encodeCompareRequestForTest("cn=ned,"+serverBaseDN, "cn", "ned"))
+		id, res := readResponseForTest(t, conn)
+		if id != 3 || res.Tag != ApplicationCompareResponse {
+			t.Errorf("expected the compare response, got %s for message %d", ApplicationMap[res.Tag], id)
+		}
+	})
+}
+
+func TestDuplicateMessageID(t *testing.T) {
+	s := NewServer()
+	release := make(chan struct{})
+	s.SearchFunc("", searchBlocking{release: release})
+	s.CompareFunc("", compareTrue{})
+
+	LaunchServerForTest(t, s, func() {
+		conn := rawConnForTest(t)
+		defer conn.Close()
+
+		resultCode := func(res *ber.Packet) LDAPResultCode {
+			return LDAPResultCode(res.Children[0].Value.(int64))
+		}
+
+		// the message ID of the running search cannot be reused
+		sendRequestForTest(t, conn, 1, encodeSearchRequestForTest(serverBaseDN, "(objectClass=*)"))
+		sendRequestForTest(t, conn, 1, encodeCompareRequestForTest("cn=ned,"+serverBaseDN, "cn", "ned"))
+		id, res := readResponseForTest(t, conn)
+		if id != 1 || res.Tag != ApplicationCompareResponse || resultCode(res) != LDAPResultProtocolError {
+			t.Errorf("expected the compare to fail with protocolError, got %s for message %d", ApplicationMap[res.Tag], id)
+		}
+		close(release)
+		id, res = readResponseForTest(t, conn)
+		if id != 1 || res.Tag != ApplicationSearchResultDone || resultCode(res) != LDAPResultSuccess {
+			t.Errorf("expected the search to complete, got %s for message %d", ApplicationMap[res.Tag], id)
+		}
+
+		// once the search is done, it can
+		sendRequestForTest(t, conn, 1, encodeCompareRequestForTest("cn=ned,"+serverBaseDN, "cn", "ned"))
+		id, res = readResponseForTest(t, conn)
+		if id != 1 || res.Tag != ApplicationCompareResponse || resultCode(res) != LDAPResultCompareTrue {
+			t.Errorf("expected the compare to succeed, got %s for message %d", ApplicationMap[res.Tag], id)
+		}
+	})
+}
+
+func TestCancel(t *testing.T) {
+	s := NewServer()
+	h := &abandonRecorder{cancelled: make(chan error, 1), abandoned: make(chan uint64, 1)}
+	s.SearchFunc("", h)
+
+	LaunchServerForTest(t, s, func() {
+		conn := rawConnForTest(t)
+		defer conn.Close()
+
+		resultCode := func(res *ber.Packet) LDAPResultCode {
+			return LDAPResultCode(res.Children[0].Value.(int64))
+		}
+
+		// the cancelled search answers canceled, then the Cancel succeeds
+		sendRequestForTest(t, conn, 1, encodeSearchRequestForTest(serverBaseDN, "(objectClass=*)"))
+		sendRequestForTest(t, conn, 2, encodeCancelRequestForTest(1))
+		id, res := readResponseForTest(t, conn)
+		if id != 1 || res.Tag != ApplicationSearchResultDone || resultCode(res) != LDAPResultCanceled {
+			t.Errorf("expected the search to be canceled, got %s for message %d", ApplicationMap[res.Tag], id)
+		}
+		if err := <-h.cancelled; !errors.Is(err, context.Canceled) {
+			t.Errorf("search context should have been cancelled, got %v", err)
+		}
+		id, res = readResponseForTest(t, conn)
+		if id != 2 || res.Tag != ApplicationExtendedResponse || resultCode(res) != LDAPResultSuccess {
+			t.Errorf("expected the cancel to succeed, got %s for message %d", ApplicationMap[res.Tag], id)
+		}
+
+		for _, tt := range []struct {
+			messageID, cancelID int64
+			want                LDAPResultCode
+		}{
+			{3, 1, LDAPResultNoSuchOperation},
+			{4, 42, LDAPResultNoSuchOperation},
+			{5, 5, LDAPResultCannotCancel},
+		} {
+			sendRequestForTest(t, conn, tt.messageID, encodeCancelRequestForTest(tt.cancelID))
+			id, res = readResponseForTest(t, conn)
+			if id != tt.messageID || resultCode(res) != tt.want {
+				t.Errorf("cancel of %d: expected %s, got %s", tt.cancelID, LDAPResultCodeMap[tt.want], LDAPResultCodeMap[resultCode(res)])
+			}
+		}
+	})
+
+	// binds, StartTLS and abandons are processed by the connection's reader,
+	// which tracks them as operations that cannot be canceled
+	c := newServerConn(nil, 0)
+	untrack := c.track(1)
+	if code := c.cancelOperation(1); code != LDAPResultCannotCancel {
+		t.Errorf("cancel of a bind: expected %s, got %s", LDAPResultCodeMap[LDAPResultCannotCancel], LDAPResultCodeMap[code])
+	}
+	untrack()
+	if code := c.cancelOperation(1); code != LDAPResultNoSuchOperation {
+		t.Errorf("cancel of a completed bind: expected %s, got %s", LDAPResultCodeMap[LDAPResultNoSuchOperation], LDAPResultCodeMap[code])
+	}
+}
+
 // ///////////////////////
 type bindAnonOK struct{}
 
@@ -317,6 +623,40 @@ func (s searchSimple2) Search(ctx context.Context, boundDN string, searchReq Sea
 	return ServerSearchResult{entries, []string{}, []Control{}, LDAPResultSuccess}, nil
 }
 
+// searchBlocking returns no entries, but only once release is closed.
+// searchBlocking blocks searches until release is closed, telling started,
+// when set, once they are running.
+type searchBlocking struct {
+	release chan struct{}
+	started chan struct{}
+}
+
+func (s searchBlocking) Search(ctx context.Context, boundDN string, searchReq SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	if s.started != nil {
+		s.started <- struct{}{}
+	}
+	<-s.release
+	return ServerSearchResult{ResultCode: LDAPResultSuccess}, nil
+}
+
+// abandonRecorder blocks searches until they are cancelled and reports the
+// cancellation and the abandoned message ID.
+type abandonRecorder struct {
+	cancelled chan error
+	abandoned chan uint64
+}
+
+func (h *abandonRecorder) Search(ctx context.Context, boundDN string, searchReq SearchRequest, conn net.Conn) (ServerSearchResult, error) {
+	<-ctx.Done()
+	h.cancelled <- ctx.Err()
+	return ServerSearchResult{ResultCode: LDAPResultSuccess}, nil
+}
+
+func (h *abandonRecorder) Abandon(ctx context.Context, boundDN string, messageID uint64, conn net.Conn) error {
+	h.abandoned <- messageID
+	return nil
+}
+
 type searchPanic struct{}
 
 func (s searchPanic) Search(ctx context.Context, boundDN string, searchReq SearchRequest, conn net.Conn) (ServerSearchResult, error) {
@@ -358,7 +698,37 @@ func (s searchCaseInsensitive) Search(ctx context.Context, boundDN string, searc
 	return ServerSearchResult{entries, []string{}, []Control{}, LDAPResultSuccess}, nil
 }
 
-func TestRouteFunc(t *testing.T) {
+type compareTrue struct{}
+
+func (c compareTrue) Compare(ctx context.Context, boundDN string, req CompareRequest, conn net.Conn) (LDAPResultCode, error) {
+	return LDAPResultCompareTrue, nil
+}
+
+// compareAfter answers compares with compareTrue once released is closed, and
+// fails them before.
+type compareAfter struct {
+	released chan struct{}
+}
+
+func (c compareAfter) Compare(ctx context.Context, boundDN string, req CompareRequest, conn net.Conn) (LDAPResultCode, error) {
+	select {
+	case <-c.released:
+		return LDAPResultCompareTrue, nil
+	default:
+		return LDAPResultOperationsError, errors.New("compare processed before the search was released")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	// routeFunc returns the baseDN among names that routes dn, or "" when none does
+	routeFunc := func(dn string, names []string) string {
+		target, err := ParseDN(dn)
+		if err != nil {
+			return ""
+		}
+		fn, _ := newRouter(names).route(target)
+		return fn
+	}
 	if routeFunc("", []string{"a", "xyz", "tt"}) != "" {
 		t.Error("routeFunc failed")
 	}
@@ -374,4 +744,63 @@ func TestRouteFunc(t *testing.T) {
 	if routeFunc("nosuch", []string{"x=y,a=b", "a=b", "tt"}) != "" {
 		t.Error("routeFunc failed")
 	}
+	names := []string{"", "dc=example", "ou=People,dc=Example", "cn=Smith\\, John,ou=People,dc=example"}
+	for dn, fn := range map[string]string{
+		"CN=x, OU=people , DC=example":                "ou=People,dc=Example",
+		"cn=x,cn=Smith\\2c John,ou=People,dc=example": "cn=Smith\\, John,ou=People,dc=example",
+		"cn=John,dc=example":                          "dc=example",
+		"cn=a+uid=b,ou=People,dc=example":             "ou=People,dc=Example",
+		"dc=sub-example":                              "",
+		"ou=People\\,dc=example":                      "",
+		"cn=a,":                                       "",
+	} {
+		if got := routeFunc(dn, names); got != fn {
+			t.Errorf("%q: expected %q, got %q", dn, fn, got)
+		}
+	}
+	r := newRouter([]string{"dc=example", "ou=*,dc=example", "ou=Groups,dc=example", "=cn=admin,ou=People,dc=example", "*,ou=Hosts,dc=example"})
+	for dn, fn := range map[string]string{
+		"dc=example":                         "dc=example",
+		"cn=x,ou=people,dc=example":          "ou=*,dc=example",
+		"OU=Groups,dc=example":               "ou=Groups,dc=example",
+		"cn=admins,ou=groups,dc=example":     "ou=Groups,dc=example",
+		"cn=admin,ou=People,dc=example":      "=cn=admin,ou=People,dc=example",
+		"cn=x,cn=admin,ou=People,dc=example": "ou=*,dc=example",
+		"l=Paris,dc=example":                 "dc=example",
+		"cn=db1,ou=hosts,dc=example":         "*,ou=Hosts,dc=example",
+		"ou=hosts,dc=example":                "ou=*,dc=example",
+	} {
+		target, _ := ParseDN(dn)
+		if got, ok := r.route(target); !ok || got != fn {
+			t.Errorf("%q: expected %q, got %q", dn, fn, got)
+		}
+	}
+	for _, dn := range []string{"dc=sub-example", "", "dc=com"} {
+		target, _ := ParseDN(dn)
+		if fn, ok := r.route(target); ok {
+			t.Errorf("%q should not be routed, got %q", dn, fn)
+		}
+	}
+}
+
+func TestRouteRebuild(t *testing.T) {
+	s := NewServer()
+	s.SearchFunc("dc=a", searchSimple{})
+	if fn, ok := route(s, "search", s.SearchFns, "cn=x,dc=a"); !ok || fn != "dc=a" {
+		t.Fatalf("expected dc=a, got %q", fn)
+	}
+	built, _ := s.routers.Load("search")
+	route(s, "search", s.SearchFns, "cn=y,dc=a")
+	if r, _ := s.routers.Load("search"); r != built {
+		t.Error("the router was rebuilt although no handler was registered")
+	}
+	// swapping a baseDN for another keeps the number of handlers
+	delete(s.SearchFns, "dc=a")
+	s.SearchFunc("dc=b", searchSimple{})
+	if fn, ok := route(s, "search", s.SearchFns, "cn=x,dc=b"); !ok || fn != "dc=b" || s.SearchFns[fn] == nil {
+		t.Errorf("expected dc=b, got %q", fn)
+	}
+	if fn, ok := route(s, "search", s.SearchFns, "cn=x,dc=a"); ok {
+		t.Errorf("dc=a should not be routed anymore, got %q", fn)
+	}
 }
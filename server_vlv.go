@@ -0,0 +1,123 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"go.linka.cloud/ldap/schema"
+)
+
+// VLVSearcher is implemented by search handlers that serve Virtual List View
+// requests natively. When a search carries the VLV request control, SearchVLV
+// is called instead of Search: the handler sorts following the Server Side
+// Sorting control in req.Controls and returns the entries of the requested
+// window along with the 1-based position of the target entry and the number
+// of entries in the whole list.
+//
+// The server only serves VLV requests for other handlers with EnforceLDAP:
+// searches of those with a critical VLV control otherwise fail with
+// unavailableCriticalExtension.
+type VLVSearcher interface {
+	SearchVLV(ctx context.Context, boundDN string, req SearchRequest, vlv *ControlVLV, conn net.Conn) (res ServerSearchResult, targetPosition, contentCount int, err error)
+}
+
+// searchNativeVLV runs a VLV search on a VLVSearcher and adds the VLV response
+// control to its result.
+func searchNativeVLV(ctx context.Context, searcher VLVSearcher, boundDN string, req SearchRequest, vlv *ControlVLV, w *searchWriter) (ServerSearchResult, error) {
+	searchResp, target, count, err := searcher.SearchVLV(ctx, boundDN, req, vlv, w.conn)
+	if err := searchError(searchResp, err); err != nil {
+		return searchResp, err
+	}
+	if err := w.writeResult(searchResp); err != nil {
+		return searchResp, err
+	}
+	searchResp.Controls = append(searchResp.Controls, &ControlVLVResponse{TargetPosition: target, ContentCount: count, ContextID: vlv.ContextID})
+	return searchResp, nil
+}
+
+// searchVLV serves a VLV request on behalf of a handler: the whole sorted
+// result is built and only the window around the target entry is sent.
+func searchVLV(ctx context.Context, handler Searcher, boundDN string, req SearchRequest, vlv *ControlVLV, w *searchWriter) (ServerSearchResult, error) {
+	var searchResp ServerSearchResult
+	sorting, _ := FindControl(req.Controls, ControlTypeServerSideSorting).(*ControlServerSideSorting)
+	if sorting == nil {
+		searchResp.Controls = append(searchResp.Controls, &ControlVLVResponse{Result: LDAPResultSortControlMissing, ContextID: vlv.ContextID})
+		return searchResp, NewError(LDAPResultSortControlMissing, errors.New("virtual list view requires the server side sorting control"))
+	}
+
+	w.buffer = true
+	searchResp, err := runSearch(ctx, handler, boundDN, req, w, w.conn)
+	if err != nil {
+		return searchResp, err
+	}
+	// the handler may have sorted the entries itself
+	if w.sorting != nil {
+		code, err := w.sortPending(&searchResp)
+		if code != LDAPResultSuccess {
+			searchResp.Controls = append(searchResp.Controls, &ControlVLVResponse{Result: code, ContextID: vlv.ContextID})
+			if err == nil {
+				err = NewError(code, errors.New("virtual list view: cannot sort the list"))
+			}
+			return searchResp, err
+		}
+	}
+
+	count := len(w.pending)
+	target, code := vlvTarget(w.pending, vlv, sorting.SortKeys[0], w.schema)
+	if code != LDAPResultSuccess {
+		searchResp.Controls = append(searchResp.Controls, &ControlVLVResponse{ContentCount: count, Result: code, ContextID: vlv.ContextID})
+		return searchResp, NewError(code, errors.New("virtual list view: bad target"))
+	}
+	first, last := max(target-vlv.BeforeCount, 1), min(target+vlv.AfterCount, count)
+	if first > last {
+		w.pending = nil
+	} else {
+		w.pending = w.pending[first-1 : last]
+	}
+	w.limitPending()
+	for _, entry := range w.pending {
+		if err := w.send(entry); err != nil {
+			return searchResp, err
+		}
+	}
+	searchResp.Controls = append(searchResp.Controls, &ControlVLVResponse{TargetPosition: target, ContentCount: count, ContextID: vlv.ContextID})
+	return searchResp, nil
+}
+
+// vlvTarget returns the 1-based position of the target entry of vlv within the
+// entries sorted on key with the rules of sc, the last one when the assertion
+// value sorts after every entry, and 0 for an empty list.
+func vlvTarget(entries []*Entry, vlv *ControlVLV, key *SortKey, sc *schema.Schema) (int, LDAPResultCode) {
+	count := len(entries)
+	if vlv.ByValue {
+		rules, code, _ := sortRules([]*SortKey{key}, sc)
+		if code != LDAPResultSuccess {
+			return 0, code
+		}
+		for i, entry := range entries {
+			// entries without a value sort last, hence after the assertion
+			if v, _ := sortValue(entry, key, rules[0]); v == nil || !sortsBefore(rules[0], key.Reverse, *v, vlv.AssertionValue) {
+				return i + 1, LDAPResultSuccess
+			}
+		}
+		return count, LDAPResultSuccess
+	}
+
+	if vlv.Offset == 0 {
+		return 0, LDAPResultOffsetRangeError
+	}
+	if count == 0 {
+		return 0, LDAPResultSuccess
+	}
+	target := vlv.Offset
+	// scale the offset when the client's idea of the list size is off
+	if vlv.ContentCount > 0 && vlv.ContentCount != count {
+		if vlv.Offset >= vlv.ContentCount {
+			target = count
+		} else {
+			target = 1 + (vlv.Offset-1)*count/vlv.ContentCount
+		}
+	}
+	return min(target, count), LDAPResultSuccess
+}
@@ -0,0 +1,118 @@
+package sqlfilter
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect writes the parts of predicates that differ between databases.
+type Dialect interface {
+	// Placeholder returns the placeholder of the n-th parameter, from 1.
+	Placeholder(n int) string
+	// Quote quotes a table or column name.
+	Quote(identifier string) string
+	// Like returns the predicate matching expr against the LIKE pattern
+	// placeholder, in which ! escapes %, _ and itself.
+	Like(expr, placeholder string) string
+	// CaseExact returns expr collated to compare case sensitively with =, <=
+	// and >=.
+	CaseExact(expr string) string
+	// LikeCaseExact returns the predicate matching expr case sensitively
+	// against pattern, a LIKE pattern escaped as for Like. arg adds the
+	// parameters of the predicate and returns their placeholder.
+	LikeCaseExact(expr, pattern string, arg func(any) string) string
+}
+
+var (
+	// SQLite writes predicates for SQLite.
+	SQLite Dialect = sqlite{}
+	// Postgres writes predicates for PostgreSQL.
+	Postgres Dialect = postgres{}
+	// MySQL writes predicates for MySQL and MariaDB.
+	MySQL Dialect = mysql{}
+)
+
+type sqlite struct{}
+
+func (sqlite) Placeholder(int) string { return "?" }
+
+func (sqlite) Quote(identifier string) string { return quote(identifier, '"') }
+
+func (sqlite) Like(expr, placeholder string) string { return like(expr, placeholder) }
+
+func (sqlite) CaseExact(expr string) string { return expr + " COLLATE BINARY" }
+
+// LikeCaseExact matches with GLOB, as SQLite's LIKE ignores the case of ASCII
+// letters whatever the collation.
+func (sqlite) LikeCaseExact(expr, pattern string, arg func(any) string) string {
+	return expr + " GLOB " + arg(glob(pattern))
+}
+
+type postgres struct{}
+
+func (postgres) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func (postgres) Quote(identifier string) string { return quote(identifier, '"') }
+
+func (postgres) Like(expr, placeholder string) string { return like(expr, placeholder) }
+
+func (postgres) CaseExact(expr string) string { return expr }
+
+func (postgres) LikeCaseExact(expr, pattern string, arg func(any) string) string {
+	return like(expr, arg(pattern))
+}
+
+type mysql struct{}
+
+func (mysql) Placeholder(int) string { return "?" }
+
+func (mysql) Quote(identifier string) string { return quote(identifier, '`') }
+
+func (mysql) Like(expr, placeholder string) string { return like(expr, placeholder) }
+
+// CaseExact collates expr with utf8mb4_bin, as the default collations of
+// MySQL ignore case.
+func (mysql) CaseExact(expr string) string { return expr + " COLLATE utf8mb4_bin" }
+
+func (m mysql) LikeCaseExact(expr, pattern string, arg func(any) string) string {
+	return like(m.CaseExact(expr), arg(pattern))
+}
+
+// like writes a LIKE predicate escaped with !, which unlike backslash is read
+// the same in the string literals of every database and SQL mode, such as
+// MySQL's NO_BACKSLASH_ESCAPES.
+func like(expr, placeholder string) string {
+	return expr + " LIKE " + placeholder + " ESCAPE '!'"
+}
+
+// glob converts a LIKE pattern escaped with ! to a GLOB pattern, in which the
+// wildcards are written as a set to match them literally.
+func glob(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '%':
+			b.WriteByte('*')
+		case '_':
+			b.WriteByte('?')
+		case '!':
+			if i++; i < len(pattern) {
+				c = pattern[i]
+			}
+			fallthrough
+		default:
+			if c == '*' || c == '?' || c == '[' {
+				b.WriteString("[" + string(c) + "]")
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// quote quotes identifier with q, doubling the q it holds.
+func quote(identifier string, q byte) string {
+	s := string(q)
+	return s + strings.ReplaceAll(identifier, s, s+s) + s
+}
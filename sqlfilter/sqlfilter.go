@@ -0,0 +1,349 @@
+// Package sqlfilter translates LDAP search filters to parameterised SQL
+// predicates, for handlers storing their entries in relational databases. A
+// Mapping describes where the attributes of the entries are stored: in the
+// columns of the entries' table or, for multi-valued attributes, in join
+// tables holding a value per row.
+package sqlfilter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.linka.cloud/ldap"
+)
+
+// ErrUnsupported is returned for filters that have no SQL translation.
+var ErrUnsupported = errors.New("unsupported filter")
+
+// Mapping describes the table of the entries.
+type Mapping struct {
+	// Table is the table of the entries.
+	Table string
+	// Key is its primary key, referenced by the join tables.
+	Key string
+	// DN is the column of the entries' DN. DNs are compared ignoring case,
+	// and are expected to be stored as ldap.DN's String writes them: without
+	// spaces around their separators and with their special characters
+	// escaped with a backslash.
+	DN string
+	// Parent, when set, is the column of the DN of the entries' parent. One
+	// level searches otherwise compare DNs with LIKE patterns, which doesn't
+	// handle RDNs holding escaped commas.
+	Parent string
+	// ObjectClasses are the object classes of all the entries, that filters
+	// on objectClass are evaluated against unless Attributes maps it.
+	ObjectClasses []string
+	// Attributes are the columns of the attributes, by name. Filters on the
+	// other attributes match no entry.
+	Attributes map[string]Column
+}
+
+// Column is where the values of an attribute are stored.
+type Column struct {
+	// Name is the column holding the values.
+	Name string
+	// Table, when set, is the join table holding the values of a
+	// multi-valued attribute, one per row, and ForeignKey its column
+	// referencing the entry's key. Name is otherwise a column of the entries'
+	// table.
+	Table      string
+	ForeignKey string
+	// CaseExact compares values as they are stored, case sensitively
+	// whatever the collation of the column. They are otherwise compared
+	// lower-cased, as caseIgnoreMatch does.
+	CaseExact bool
+	// Integer compares values as integers, as integerMatch does.
+	Integer bool
+}
+
+// Where returns the predicate selecting the entries of m within scope of
+// baseDN that match f, and its parameters.
+func Where(d Dialect, m Mapping, baseDN string, scope int, f ldap.Filter) (string, []any, error) {
+	b := &builder{dialect: d, mapping: m}
+	if err := b.scope(baseDN, scope); err != nil {
+		return "", nil, err
+	}
+	if err := f.Accept(b); err != nil {
+		return "", nil, err
+	}
+	return b.sql.String(), b.args, nil
+}
+
+// Search is Where for the base DN, scope and filter of req.
+func Search(d Dialect, m Mapping, req ldap.SearchRequest) (string, []any, error) {
+	f, err := ldap.ParseFilter(req.Filter)
+	if err != nil {
+		return "", nil, err
+	}
+	return Where(d, m, req.BaseDN, req.Scope, f)
+}
+
+// builder writes predicates, visiting filters.
+type builder struct {
+	dialect Dialect
+	mapping Mapping
+	sql     strings.Builder
+	args    []any
+}
+
+// arg adds a parameter and returns its placeholder.
+func (b *builder) arg(v any) string {
+	b.args = append(b.args, v)
+	return b.dialect.Placeholder(len(b.args))
+}
+
+// column returns the quoted, qualified name of column of table.
+func (b *builder) column(table, column string) string {
+	return b.dialect.Quote(table) + "." + b.dialect.Quote(column)
+}
+
+func (b *builder) scope(baseDN string, scope int) error {
+	parsed, err := ldap.ParseDN(baseDN)
+	if err != nil {
+		return fmt.Errorf("invalid base DN %q: %w", baseDN, err)
+	}
+	dn := "LOWER(" + b.column(b.mapping.Table, b.mapping.DN) + ")"
+	base := parsed.Normalize().String()
+	switch scope {
+	case ldap.ScopeBaseObject:
+		b.sql.WriteString(dn + " = " + b.arg(base))
+	case ldap.ScopeSingleLevel:
+		switch {
+		case b.mapping.Parent != "":
+			b.sql.WriteString("LOWER(" + b.column(b.mapping.Table, b.mapping.Parent) + ") = " + b.arg(base))
+		case base == "":
+			b.sql.WriteString("NOT " + b.dialect.Like(dn, b.arg("%,%")))
+		default:
+			b.sql.WriteString(b.dialect.Like(dn, b.arg("%,"+escapeLike(base))) + " AND NOT " + b.dialect.Like(dn, b.arg("%,%,"+escapeLike(base))))
+		}
+	case ldap.ScopeWholeSubtree:
+		if base == "" {
+			return nil
+		}
+		b.sql.WriteString("(" + dn + " = " + b.arg(base) + " OR " + b.dialect.Like(dn, b.arg("%,"+escapeLike(base))) + ")")
+	default:
+		return fmt.Errorf("unknown scope %d", scope)
+	}
+	b.sql.WriteString(" AND ")
+	return nil
+}
+
+func (b *builder) VisitAnd(f ldap.AndFilter) error {
+	return b.set(f.Filters, " AND ", always)
+}
+
+func (b *builder) VisitOr(f ldap.OrFilter) error {
+	return b.set(f.Filters, " OR ", "1 = 0")
+}
+
+// set writes filters joined by op, or empty when there are none.
+func (b *builder) set(filters []ldap.Filter, op, empty string) error {
+	if len(filters) == 0 {
+		b.sql.WriteString(empty)
+		return nil
+	}
+	b.sql.WriteString("(")
+	for i, f := range filters {
+		if i > 0 {
+			b.sql.WriteString(op)
+		}
+		if err := f.Accept(b); err != nil {
+			return err
+		}
+	}
+	b.sql.WriteString(")")
+	return nil
+}
+
+func (b *builder) VisitNot(f ldap.NotFilter) error {
+	b.sql.WriteString("NOT (")
+	if err := f.Filter.Accept(b); err != nil {
+		return err
+	}
+	b.sql.WriteString(")")
+	return nil
+}
+
+func (b *builder) VisitEquality(f ldap.EqualityFilter) error {
+	return b.compare(f, f.Attribute, f.Value, "=")
+}
+
+// VisitApprox translates approximate matches to equality matches, as RFC
+// 4511 allows.
+func (b *builder) VisitApprox(f ldap.ApproxFilter) error {
+	return b.compare(f, f.Attribute, f.Value, "=")
+}
+
+func (b *builder) VisitOrdering(f ldap.OrderingFilter) error {
+	if f.LessOrEqual {
+		return b.compare(f, f.Attribute, f.Value, "<=")
+	}
+	return b.compare(f, f.Attribute, f.Value, ">=")
+}
+
+func (b *builder) compare(f ldap.Filter, attribute, value, op string) error {
+	return b.attribute(f, attribute, func(c Column, column string) (string, error) {
+		v, ok := normalize(c, value)
+		if !ok {
+			return "", nil
+		}
+		return b.expression(c, column) + " " + op + " " + b.arg(v), nil
+	})
+}
+
+func (b *builder) VisitSubstrings(f ldap.SubstringsFilter) error {
+	return b.attribute(f, f.Attribute, func(c Column, column string) (string, error) {
+		if c.Integer {
+			return "", fmt.Errorf("%w: substrings of integer attribute %s", ErrUnsupported, f.Attribute)
+		}
+		pattern := escapeLike(f.Initial) + "%"
+		for _, v := range f.Any {
+			pattern += escapeLike(v) + "%"
+		}
+		pattern += escapeLike(f.Final)
+		if c.CaseExact {
+			return b.dialect.LikeCaseExact(column, pattern, b.arg), nil
+		}
+		return b.dialect.Like(b.expression(c, column), b.arg(strings.ToLower(pattern))), nil
+	})
+}
+
+func (b *builder) VisitPresent(f ldap.PresentFilter) error {
+	return b.attribute(f, f.Attribute, func(c Column, column string) (string, error) {
+		return always, nil
+	})
+}
+
+func (b *builder) VisitExtensible(f ldap.ExtensibleFilter) error {
+	if f.DNAttributes || f.Attribute == "" {
+		return fmt.Errorf("%w: %s", ErrUnsupported, f)
+	}
+	return b.attribute(f, f.Attribute, func(c Column, column string) (string, error) {
+		switch strings.ToLower(f.MatchingRule) {
+		case "":
+		case "caseexactmatch", "2.5.13.5":
+			c.CaseExact, c.Integer = true, false
+		case "caseignorematch", "2.5.13.2":
+			c.CaseExact, c.Integer = false, false
+		case "integermatch", "2.5.13.14":
+			c.Integer = true
+		case ldap.MatchingRuleBitAnd, ldap.MatchingRuleBitOr:
+			mask, err := strconv.ParseInt(strings.TrimSpace(f.Value), 10, 64)
+			if err != nil || !c.Integer {
+				return "", nil
+			}
+			if f.MatchingRule == ldap.MatchingRuleBitAnd {
+				return "(" + column + " & " + b.arg(mask) + ") = " + b.arg(mask), nil
+			}
+			return "(" + column + " & " + b.arg(mask) + ") <> 0", nil
+		default:
+			return "", fmt.Errorf("%w: matching rule %s", ErrUnsupported, f.MatchingRule)
+		}
+		v, ok := normalize(c, f.Value)
+		if !ok {
+			return "", nil
+		}
+		return b.expression(c, column) + " = " + b.arg(v), nil
+	})
+}
+
+// always is the predicate matching every value.
+const always = "1 = 1"
+
+// attribute writes the predicate on the values of attribute that predicate
+// returns for their column: an empty one matches no entry, and always the
+// entries with a value. Entries without values don't match the predicate, so
+// they match its negation, as LDAP filters evaluate to false on attributes an
+// entry doesn't hold.
+func (b *builder) attribute(f ldap.Filter, attribute string, predicate func(c Column, column string) (string, error)) error {
+	c, ok := b.lookup(attribute)
+	if !ok {
+		if strings.EqualFold(attribute, "objectClass") && b.mapping.ObjectClasses != nil {
+			// the object classes are the same for all the entries
+			entry := &ldap.Entry{Attributes: []*ldap.EntryAttribute{{Name: "objectClass", Values: b.mapping.ObjectClasses}}}
+			if ldap.MatchFilter(f, entry, nil) {
+				b.sql.WriteString(always)
+				return nil
+			}
+		}
+		b.sql.WriteString("1 = 0")
+		return nil
+	}
+	if c.Table == "" {
+		column := b.column(b.mapping.Table, c.Name)
+		p, err := predicate(c, column)
+		if err != nil {
+			return err
+		}
+		switch p {
+		case "":
+			b.sql.WriteString("1 = 0")
+		case always:
+			b.sql.WriteString(column + " IS NOT NULL")
+		default:
+			b.sql.WriteString("(" + column + " IS NOT NULL AND " + p + ")")
+		}
+		return nil
+	}
+	p, err := predicate(c, b.column(c.Table, c.Name))
+	if err != nil {
+		return err
+	}
+	switch p {
+	case "":
+		b.sql.WriteString("1 = 0")
+		return nil
+	case always:
+		// the row holding a value is enough
+		p = ""
+	default:
+		p = " AND " + p
+	}
+	b.sql.WriteString("EXISTS (SELECT 1 FROM " + b.dialect.Quote(c.Table) +
+		" WHERE " + b.column(c.Table, c.ForeignKey) + " = " + b.column(b.mapping.Table, b.mapping.Key) + p + ")")
+	return nil
+}
+
+// lookup returns the column of attribute, whose name is case insensitive.
+func (b *builder) lookup(attribute string) (Column, bool) {
+	if c, ok := b.mapping.Attributes[attribute]; ok {
+		return c, true
+	}
+	for name, c := range b.mapping.Attributes {
+		if strings.EqualFold(name, attribute) {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+// expression returns the expression the values of column are compared with.
+func (b *builder) expression(c Column, column string) string {
+	switch {
+	case c.Integer:
+		return column
+	case c.CaseExact:
+		return b.dialect.CaseExact(column)
+	}
+	return "LOWER(" + column + ")"
+}
+
+// normalize returns the parameter value is compared with, reporting false
+// when it can never match.
+func normalize(c Column, value string) (any, bool) {
+	switch {
+	case c.Integer:
+		i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		return i, err == nil
+	case c.CaseExact:
+		return value, true
+	}
+	return strings.ToLower(value), true
+}
+
+// escapeLike escapes the LIKE wildcards of s with !, as Dialect.Like expects.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
@@ -0,0 +1,321 @@
+package sqlfilter
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.linka.cloud/ldap"
+)
+
+var users = Mapping{
+	Table:         "users",
+	Key:           "id",
+	DN:            "dn",
+	ObjectClasses: []string{"top", "person", "inetOrgPerson"},
+	Attributes: map[string]Column{
+		"uid":                {Name: "uid", CaseExact: true},
+		"cn":                 {Name: "name"},
+		"sn":                 {Name: "surname"},
+		"uidNumber":          {Name: "uid_number", Integer: true},
+		"userAccountControl": {Name: "flags", Integer: true},
+		"mail":               {Name: "address", Table: "user_mails", ForeignKey: "user_id"},
+		"memberOf":           {Name: "group_dn", Table: "memberships", ForeignKey: "user_id"},
+	},
+}
+
+func TestWhere(t *testing.T) {
+	for _, tt := range []struct {
+		filter string
+		sql    string
+		args   []any
+	}{
+		{
+			"(uid=Bob)",
+			`("users"."uid" IS NOT NULL AND "users"."uid" COLLATE BINARY = ?)`,
+			[]any{"Bob"},
+		},
+		{
+			"(cn=Bob Smith)",
+			`("users"."name" IS NOT NULL AND LOWER("users"."name") = ?)`,
+			[]any{"bob smith"},
+		},
+		{
+			"(&(objectClass=person)(uidNumber>=0500)(uidNumber<=1000))",
+			`(1 = 1 AND ("users"."uid_number" IS NOT NULL AND "users"."uid_number" >= ?) AND ("users"."uid_number" IS NOT NULL AND "users"."uid_number" <= ?))`,
+			[]any{int64(500), int64(1000)},
+		},
+		{
+			"(|(objectClass=groupOfNames)(objectClass=*)(objectClass=inet*))",
+			`(1 = 0 OR 1 = 1 OR 1 = 1)`,
+			nil,
+		},
+		{
+			"(!(mail=*))",
+			`NOT (EXISTS (SELECT 1 FROM "user_mails" WHERE "user_mails"."user_id" = "users"."id"))`,
+			nil,
+		},
+		{
+			"(mail=*@Example.com)",
+			`EXISTS (SELECT 1 FROM "user_mails" WHERE "user_mails"."user_id" = "users"."id" AND LOWER("user_mails"."address") LIKE ? ESCAPE '!')`,
+			[]any{"%@example.com"},
+		},
+		{
+			"(sn=s*m\\2a*t_h%)",
+			`("users"."surname" IS NOT NULL AND LOWER("users"."surname") LIKE ? ESCAPE '!')`,
+			[]any{`s%m*%t!_h!%`},
+		},
+		{
+			"(uid=B*[?_*%)",
+			`("users"."uid" IS NOT NULL AND "users"."uid" GLOB ?)`,
+			[]any{`B*[[][?]_*%`},
+		},
+		{
+			"(sn=Hey!*)",
+			`("users"."surname" IS NOT NULL AND LOWER("users"."surname") LIKE ? ESCAPE '!')`,
+			[]any{`hey!!%`},
+		},
+		{
+			"(&(memberOf=cn=Admins,ou=Groups,dc=example,dc=com)(!(sn~=Smith)))",
+			`(EXISTS (SELECT 1 FROM "memberships" WHERE "memberships"."user_id" = "users"."id" AND LOWER("memberships"."group_dn") = ?) AND NOT (("users"."surname" IS NOT NULL AND LOWER("users"."surname") = ?)))`,
+			[]any{"cn=admins,ou=groups,dc=example,dc=com", "smith"},
+		},
+		{
+			"(|(description=x)(uidNumber=abc)(uid=*))",
+			`(1 = 0 OR 1 = 0 OR "users"."uid" IS NOT NULL)`,
+			nil,
+		},
+		{
+			"(&)",
+			`1 = 1`,
+			nil,
+		},
+		{
+			"(|)",
+			`1 = 0`,
+			nil,
+		},
+		{
+			"(uid:caseIgnoreMatch:=bob)",
+			`("users"."uid" IS NOT NULL AND LOWER("users"."uid") = ?)`,
+			[]any{"bob"},
+		},
+		{
+			"(cn:2.5.13.5:=Bob)",
+			`("users"."name" IS NOT NULL AND "users"."name" COLLATE BINARY = ?)`,
+			[]any{"Bob"},
+		},
+		{
+			"(userAccountControl:1.2.840.113556.1.4.803:=2)",
+			`("users"."flags" IS NOT NULL AND ("users"."flags" & ?) = ?)`,
+			[]any{int64(2), int64(2)},
+		},
+		{
+			"(userAccountControl:1.2.840.113556.1.4.804:=6)",
+			`("users"."flags" IS NOT NULL AND ("users"."flags" & ?) <> 0)`,
+			[]any{int64(6)},
+		},
+	} {
+		f, err := ldap.ParseFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.filter, err)
+		}
+		sql, args, err := Where(SQLite, users, "", ldap.ScopeWholeSubtree, f)
+		if err != nil {
+			t.Errorf("%s: %s", tt.filter, err)
+			continue
+		}
+		if sql != tt.sql {
+			t.Errorf("%s:\nexpected %s\ngot      %s", tt.filter, tt.sql, sql)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: expected arguments %#v, got %#v", tt.filter, tt.args, args)
+		}
+	}
+}
+
+func TestWhereScope(t *testing.T) {
+	withParent := users
+	withParent.Parent = "parent_dn"
+	for _, tt := range []struct {
+		dialect Dialect
+		mapping Mapping
+		baseDN  string
+		scope   int
+		sql     string
+		args    []any
+	}{
+		{
+			SQLite, users, "uid=bob,ou=People,dc=example,dc=com", ldap.ScopeBaseObject,
+			`LOWER("users"."dn") = ? AND ("users"."uid" IS NOT NULL AND "users"."uid" COLLATE BINARY = ?)`,
+			[]any{"uid=bob,ou=people,dc=example,dc=com", "bob"},
+		},
+		{
+			SQLite, users, "ou=People,dc=example,dc=com", ldap.ScopeSingleLevel,
+			`LOWER("users"."dn") LIKE ? ESCAPE '!' AND NOT LOWER("users"."dn") LIKE ? ESCAPE '!' AND ("users"."uid" IS NOT NULL AND "users"."uid" COLLATE BINARY = ?)`,
+			[]any{"%,ou=people,dc=example,dc=com", "%,%,ou=people,dc=example,dc=com", "bob"},
+		},
+		{
+			SQLite, users, " CN=Smith\\2C  John , OU=People,DC=Example ,dc=com", ldap.ScopeBaseObject,
+			`LOWER("users"."dn") = ? AND ("users"."uid" IS NOT NULL AND "users"."uid" COLLATE BINARY = ?)`,
+			[]any{`cn=smith\, john,ou=people,dc=example,dc=com`, "bob"},
+		},
+		{
+			SQLite, withParent, "ou=People,dc=example,dc=com", ldap.ScopeSingleLevel,
+			`LOWER("users"."parent_dn") = ? AND ("users"."uid" IS NOT NULL AND "users"."uid" COLLATE BINARY = ?)`,
+			[]any{"ou=people,dc=example,dc=com", "bob"},
+		},
+		{
+			SQLite, users, "", ldap.ScopeSingleLevel,
+			`NOT LOWER("users"."dn") LIKE ? ESCAPE '!' AND ("users"."uid" IS NOT NULL AND "users"."uid" COLLATE BINARY = ?)`,
+			[]any{"%,%", "bob"},
+		},
+		{
+			Postgres, users, "ou=my_people,dc=example,dc=com", ldap.ScopeWholeSubtree,
+			`(LOWER("users"."dn") = $1 OR LOWER("users"."dn") LIKE $2 ESCAPE '!') AND ("users"."uid" IS NOT NULL AND "users"."uid" = $3)`,
+			[]any{"ou=my_people,dc=example,dc=com", `%,ou=my!_people,dc=example,dc=com`, "bob"},
+		},
+		{
+			MySQL, users, "dc=example,dc=com", ldap.ScopeWholeSubtree,
+			"(LOWER(`users`.`dn`) = ? OR LOWER(`users`.`dn`) LIKE ? ESCAPE '!') AND (`users`.`uid` IS NOT NULL AND `users`.`uid` COLLATE utf8mb4_bin = ?)",
+			[]any{"dc=example,dc=com", "%,dc=example,dc=com", "bob"},
+		},
+	} {
+		sql, args, err := Search(tt.dialect, tt.mapping, ldap.SearchRequest{BaseDN: tt.baseDN, Scope: tt.scope, Filter: "(uid=bob)"})
+		if err != nil {
+			t.Errorf("%s: %s", tt.baseDN, err)
+			continue
+		}
+		if sql != tt.sql {
+			t.Errorf("%s:\nexpected %s\ngot      %s", tt.baseDN, tt.sql, sql)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: expected arguments %#v, got %#v", tt.baseDN, tt.args, args)
+		}
+	}
+}
+
+func TestWhereErrors(t *testing.T) {
+	for _, filter := range []string{
+		"(uidNumber=5*)",
+		"(uid:dn:=bob)",
+		"(:caseExactMatch:=bob)",
+		"(&(uid=bob)(cn:2.5.13.15:=Bob))",
+	} {
+		f, err := ldap.ParseFilter(filter)
+		if err != nil {
+			t.Fatalf("%s: %s", filter, err)
+		}
+		if _, _, err := Where(SQLite, users, "", ldap.ScopeWholeSubtree, f); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: expected ErrUnsupported, got %v", filter, err)
+		}
+	}
+	if _, _, err := Search(SQLite, users, ldap.SearchRequest{Filter: "(uid=bob", Scope: ldap.ScopeWholeSubtree}); err == nil {
+		t.Errorf("invalid filters should fail")
+	}
+	if _, _, err := Search(SQLite, users, ldap.SearchRequest{Filter: "(uid=bob)", Scope: 3}); err == nil {
+		t.Errorf("invalid scopes should fail")
+	}
+	if _, _, err := Search(SQLite, users, ldap.SearchRequest{BaseDN: "ou=people,", Filter: "(uid=bob)", Scope: ldap.ScopeWholeSubtree}); err == nil {
+		t.Errorf("invalid base DNs should fail")
+	}
+	if q := Postgres.Quote(`a"b`); q != `"a""b"` {
+		t.Errorf("unexpected quoting %s", q)
+	}
+	arg := func(any) string { return "?" }
+	if p := MySQL.LikeCaseExact("`uid`", "bo%", arg); p != "`uid` COLLATE utf8mb4_bin LIKE ? ESCAPE '!'" {
+		t.Errorf("unexpected case exact LIKE %s", p)
+	}
+	if p := Postgres.LikeCaseExact(`"uid"`, "bo%", arg); p != `"uid" LIKE ? ESCAPE '!'` {
+		t.Errorf("unexpected case exact LIKE %s", p)
+	}
+}
+
+// usersSQLite are the entries of users, for SQLite.
+const usersSQLite = `
+CREATE TABLE users (id INTEGER PRIMARY KEY, dn TEXT, parent_dn TEXT, uid TEXT, name TEXT, surname TEXT, uid_number INTEGER, flags INTEGER);
+CREATE TABLE user_mails (user_id INTEGER, address TEXT);
+CREATE TABLE memberships (user_id INTEGER, group_dn TEXT);
+INSERT INTO users VALUES
+	(1, 'uid=alice,ou=People,dc=example,dc=com', 'ou=People,dc=example,dc=com', 'alice', 'Alice Smith', 'Smith', 500, 2),
+	(2, 'uid=Bob,ou=People,dc=example,dc=com', 'ou=People,dc=example,dc=com', 'Bob', 'Bob Jones', NULL, 1000, 0),
+	(3, 'cn=Smith\, John,ou=People,dc=example,dc=com', 'ou=People,dc=example,dc=com', NULL, 'John Smith', 's%m_th', NULL, 6),
+	(4, 'uid=carol,ou=my_people,dc=example,dc=com', 'ou=my_people,dc=example,dc=com', 'carol', 'Carol', 'Hey!x', 20, NULL),
+	(5, 'uid=dave,ou=myxpeople,dc=example,dc=com', 'ou=myxpeople,dc=example,dc=com', 'dave', 'Dave', 'smooth', 30, NULL),
+	(6, 'ou=People,dc=example,dc=com', 'dc=example,dc=com', NULL, NULL, NULL, NULL, NULL);
+INSERT INTO user_mails VALUES (1, 'alice@example.com'), (1, 'smith@Example.com'), (2, 'bob@example.org');
+INSERT INTO memberships VALUES (1, 'cn=Admins,ou=Groups,dc=example,dc=com'), (2, 'cn=users,ou=groups,dc=example,dc=com');
+`
+
+// TestSearchSQLite runs the predicates against an in-memory SQLite database,
+// with the sqlite3 shell.
+func TestSearchSQLite(t *testing.T) {
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	withParent := users
+	withParent.Parent = "parent_dn"
+	for _, tt := range []struct {
+		mapping Mapping
+		baseDN  string
+		scope   int
+		filter  string
+		ids     string
+	}{
+		{users, "", ldap.ScopeWholeSubtree, "(uid=*)", "1,2,4,5"},
+		{users, "", ldap.ScopeWholeSubtree, "(uid=bo*)", ""},
+		{users, "", ldap.ScopeWholeSubtree, "(uid=Bo*)", "2"},
+		{users, "", ldap.ScopeWholeSubtree, "(uid=bob)", ""},
+		{users, "", ldap.ScopeWholeSubtree, "(uid>=b)", "4,5"},
+		{users, "", ldap.ScopeWholeSubtree, "(!(sn=Smith))", "2,3,4,5,6"},
+		{users, "", ldap.ScopeWholeSubtree, "(sn=s%m_th)", "3"},
+		{users, "", ldap.ScopeWholeSubtree, "(sn=*%*)", "3"},
+		{users, "", ldap.ScopeWholeSubtree, "(sn=s*_*)", "3"},
+		{users, "", ldap.ScopeWholeSubtree, "(sn=hey!*)", "4"},
+		{users, "", ldap.ScopeWholeSubtree, "(mail=*@example.com)", "1"},
+		{users, "", ldap.ScopeWholeSubtree, "(!(mail=*))", "3,4,5,6"},
+		{users, "", ldap.ScopeWholeSubtree, "(memberOf=CN=admins,ou=groups,dc=example,dc=com)", "1"},
+		{users, "", ldap.ScopeWholeSubtree, "(&(uidNumber>=30)(uidNumber<=999))", "1,5"},
+		{users, "", ldap.ScopeWholeSubtree, "(userAccountControl:1.2.840.113556.1.4.803:=2)", "1,3"},
+		{users, "", ldap.ScopeWholeSubtree, "(userAccountControl:1.2.840.113556.1.4.804:=4)", "3"},
+		{users, "", ldap.ScopeWholeSubtree, "(|(objectClass=groupOfNames)(uid=bob))", ""},
+		{users, "uid=ALICE,ou=people,dc=example,dc=com", ldap.ScopeBaseObject, "(objectClass=*)", "1"},
+		{users, "cn=Smith\\2C John,ou=People,dc=example,dc=com", ldap.ScopeBaseObject, "(objectClass=*)", "3"},
+		// LIKE patterns miss the RDNs holding escaped commas, see Mapping.Parent
+		{users, "ou=People,dc=example,dc=com", ldap.ScopeSingleLevel, "(objectClass=*)", "1,2"},
+		{withParent, "ou=People,dc=example,dc=com", ldap.ScopeSingleLevel, "(objectClass=*)", "1,2,3"},
+		{users, "ou=People,dc=example,dc=com", ldap.ScopeWholeSubtree, "(objectClass=*)", "1,2,3,6"},
+		{users, "ou=my_people,dc=example,dc=com", ldap.ScopeWholeSubtree, "(objectClass=*)", "4"},
+		{users, "dc=example,dc=com", ldap.ScopeSingleLevel, "(objectClass=*)", "6"},
+	} {
+		sql, args, err := Search(SQLite, tt.mapping, ldap.SearchRequest{BaseDN: tt.baseDN, Scope: tt.scope, Filter: tt.filter})
+		if err != nil {
+			t.Errorf("%s %s: %s", tt.baseDN, tt.filter, err)
+			continue
+		}
+		// the shell takes no parameters, so they are written as literals
+		for _, arg := range args {
+			var literal string
+			switch v := arg.(type) {
+			case string:
+				literal = "'" + strings.ReplaceAll(v, "'", "''") + "'"
+			default:
+				literal = fmt.Sprint(v)
+			}
+			sql = strings.Replace(sql, "?", literal, 1)
+		}
+		cmd := exec.Command(sqlite3, ":memory:")
+		cmd.Stdin = strings.NewReader(usersSQLite + `SELECT group_concat(id) FROM (SELECT id FROM "users" WHERE ` + sql + " ORDER BY id);\n")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s %s: %s: %s", tt.baseDN, tt.filter, err, out)
+		}
+		if ids := strings.TrimSpace(string(out)); ids != tt.ids {
+			t.Errorf("%s %s: expected entries %q, got %q", tt.baseDN, tt.filter, tt.ids, ids)
+		}
+	}
+}